@@ -0,0 +1,187 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"google.golang.org/api/compute/v1"
+)
+
+// LabelSelector matches a label by key and value, i.e. `env=prod` or `env!=prod`.
+// Without a value, it matches if the label exists, i.e. `env` or `!env`.
+type LabelSelector struct {
+	Key      string
+	Operator string // one of "=", "!=", "" (exists) or "!" (doesn't exist)
+	Value    string
+}
+
+func ParseLabelSelector(s string) (LabelSelector, error) {
+	s = strings.TrimSpace(s)
+
+	var l LabelSelector
+	switch {
+	case strings.Contains(s, "!="):
+		x := strings.SplitN(s, "!=", 2)
+		l = LabelSelector{Key: x[0], Operator: "!=", Value: x[1]}
+	case strings.Contains(s, "="):
+		x := strings.SplitN(s, "=", 2)
+		l = LabelSelector{Key: x[0], Operator: "=", Value: x[1]}
+	case strings.HasPrefix(s, "!"):
+		l = LabelSelector{Key: s[1:], Operator: "!"}
+	default:
+		l = LabelSelector{Key: s}
+	}
+
+	l.Key = strings.TrimSpace(l.Key)
+	l.Value = strings.TrimSpace(l.Value)
+	if l.Key == "" {
+		return l, fmt.Errorf("invalid label selector '%v'", s)
+	}
+	return l, nil
+}
+
+func (l LabelSelector) Match(labels map[string]string) bool {
+	v, ok := labels[l.Key]
+
+	switch l.Operator {
+	case "=":
+		return ok && v == l.Value
+	case "!=":
+		return !ok || v != l.Value
+	case "!":
+		return !ok
+	default:
+		return ok
+	}
+}
+
+func (l LabelSelector) String() string {
+	if l.Operator == "!" {
+		return "!" + l.Key
+	}
+	return l.Key + l.Operator + l.Value
+}
+
+// LabelSelectors implements flag.Value and matches if all selectors match.
+type LabelSelectors []LabelSelector
+
+func (l *LabelSelectors) Set(s string) error {
+	for _, x := range strings.Split(s, ",") {
+		sel, err := ParseLabelSelector(x)
+		if err != nil {
+			return err
+		}
+		*l = append(*l, sel)
+	}
+	return nil
+}
+
+func (l LabelSelectors) String() string {
+	x := make([]string, 0, len(l))
+	for _, sel := range l {
+		x = append(x, sel.String())
+	}
+	return strings.Join(x, ",")
+}
+
+func (l LabelSelectors) Match(labels map[string]string) bool {
+	for _, sel := range l {
+		if !sel.Match(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+// RunCleanup deletes old instance templates in all projects referenced by
+// the deploys in config without deploying anything.
+func RunCleanup(githubActionConfig *GithubActionConfig, config *Config, args []string) error {
+	fs := flag.NewFlagSet("cleanup", flag.ContinueOnError)
+	olderThan := fs.Duration("older-than", config.deleteInstanceTemplatesAfter, "Only delete instance templates older than duration. Defaults to delete_instance_templates_after.")
+	keepLast := fs.Int("keep-last", 0, "Always keep the n most recently created instance templates.")
+	dryRun := fs.Bool("dry-run", false, "Print what would be deleted, but don't delete anything.")
+	var labels LabelSelectors
+	fs.Var(&labels, "label", "Only delete instance templates matching label `selector`, i.e. env=staging, env!=prod or env. Can be repeated.")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *olderThan <= 0 && *keepLast <= 0 && !isFlagSet(fs, "older-than") {
+		return fmt.Errorf("cleanup: delete_instance_templates_after is disabled, set --older-than or --keep-last")
+	}
+
+	opts := CleanupOptions{
+		OlderThan: *olderThan,
+		KeepLast:  *keepLast,
+		Labels:    labels,
+		DryRun:    *dryRun,
+	}
+
+	projects, clients, err := NewGoogleClientsByProject(githubActionConfig, config)
+	if err != nil {
+		return err
+	}
+
+	results := make([]CleanupResult, 0)
+	hasErrors := false
+	for _, project := range projects {
+		computeService, err := compute.New(clients[project])
+		if err != nil {
+			return err
+		}
+
+		r, err := CleanupInstanceTemplates(computeService, project, opts)
+		if err != nil {
+			hasErrors = true
+			LogError(err.Error(), map[string]string{"project": project})
+			continue
+		}
+		results = append(results, r...)
+	}
+
+	printCleanupResults(os.Stdout, results, time.Now())
+
+	for _, r := range results {
+		if r.Err != nil {
+			hasErrors = true
+			LogError(r.Err.Error(), map[string]string{"project": r.Project})
+		}
+	}
+
+	if hasErrors {
+		return fmt.Errorf("cleanup: failed to delete some instance templates")
+	}
+	return nil
+}
+
+func printCleanupResults(w io.Writer, results []CleanupResult, now time.Time) {
+	if len(results) == 0 {
+		fmt.Fprintln(w, "No instance templates to delete.")
+		return
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "PROJECT\tINSTANCE TEMPLATE\tCREATED\tAGE\tACTION")
+	for _, r := range results {
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\n",
+			r.Project, r.InstanceTemplate, r.Created.Format(time.RFC3339),
+			now.Sub(r.Created).Truncate(time.Minute), r.Action)
+	}
+	tw.Flush()
+}
+
+func isFlagSet(fs *flag.FlagSet, name string) bool {
+	set := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
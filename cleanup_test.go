@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLabelSelector(t *testing.T) {
+	table := []struct {
+		in     string
+		expect LabelSelector
+	}{
+		{"env", LabelSelector{Key: "env"}},
+		{"!env", LabelSelector{Key: "env", Operator: "!"}},
+		{"env=prod", LabelSelector{Key: "env", Operator: "=", Value: "prod"}},
+		{"env!=prod", LabelSelector{Key: "env", Operator: "!=", Value: "prod"}},
+		{" env = prod ", LabelSelector{Key: "env", Operator: "=", Value: "prod"}},
+		{"env=", LabelSelector{Key: "env", Operator: "="}},
+	}
+
+	for _, test := range table {
+		out, err := ParseLabelSelector(test.in)
+		require.NoError(t, err, test.in)
+		require.Equal(t, test.expect, out, test.in)
+	}
+
+	_, err := ParseLabelSelector("=prod")
+	require.Error(t, err)
+}
+
+func TestLabelSelectorsMatch(t *testing.T) {
+	var l LabelSelectors
+	require.NoError(t, l.Set("env=staging,team"))
+	require.NoError(t, l.Set("!legacy"))
+	assert.Equal(t, "env=staging,team,!legacy", l.String())
+
+	assert.True(t, l.Match(map[string]string{"env": "staging", "team": "a"}))
+	assert.False(t, l.Match(map[string]string{"env": "prod", "team": "a"}))
+	assert.False(t, l.Match(map[string]string{"env": "staging"}))
+	assert.False(t, l.Match(map[string]string{"env": "staging", "team": "a", "legacy": "true"}))
+	assert.False(t, l.Match(nil))
+
+	assert.True(t, LabelSelectors{}.Match(nil))
+	assert.True(t, LabelSelectors{{Key: "env", Operator: "!=", Value: "prod"}}.Match(nil))
+}
+
+func TestPrintCleanupResults(t *testing.T) {
+	now := time.Date(2020, 10, 10, 12, 0, 0, 0, time.UTC)
+
+	b := &bytes.Buffer{}
+	printCleanupResults(b, nil, now)
+	assert.Equal(t, "No instance templates to delete.\n", b.String())
+
+	b.Reset()
+	printCleanupResults(b, []CleanupResult{
+		{Project: "p", InstanceTemplate: "t-1", Created: now.Add(-2 * time.Hour), Action: CleanupWouldDelete},
+		{Project: "p", InstanceTemplate: "t-2", Created: now.Add(-1 * time.Hour), Action: CleanupSkippedInUse},
+	}, now)
+	assert.Equal(t, `PROJECT  INSTANCE TEMPLATE  CREATED               AGE     ACTION
+p        t-1                2020-10-10T10:00:00Z  2h0m0s  would delete
+p        t-2                2020-10-10T11:00:00Z  1h0m0s  skipped (in use)
+`, b.String())
+}
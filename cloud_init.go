@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"mime/multipart"
+	"net/textproto"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// cloudInitBoundary separates the parts of a multi-part cloud-init document.
+const cloudInitBoundary = "gce-deploy-action-boundary"
+
+// cloudInitMergeType appends lists of cloud-config parts instead of
+// replacing them, so that packages, write_files etc. of all parts apply.
+const cloudInitMergeType = "list(append)+dict(no_replace,recurse_list)+str()"
+
+var filePermissionsRe = regexp.MustCompile(`^0?[0-7]{3}$`)
+
+var systemdUnitRe = regexp.MustCompile(`^[a-zA-Z0-9:_.@-]+\.(service|socket|timer|mount|path|target)$`)
+
+// renderCloudInit renders cloud_init_spec blocks as #cloud-config and
+// combines them with raw cloud-init files into a multi-part MIME document,
+// if there is more than one part.
+func renderCloudInit(raws []string, env *Env, specs ...*CloudInitSpec) (string, error) {
+	parts := make([]string, 0)
+	for _, raw := range raws {
+		if strings.TrimSpace(raw) != "" {
+			parts = append(parts, raw)
+		}
+	}
+
+	for _, spec := range specs {
+		if spec == nil {
+			continue
+		}
+		if err := parseCloudInitSpec(spec, env); err != nil {
+			return "", err
+		}
+		part, err := newCloudConfig(spec)
+		if err != nil {
+			return "", err
+		}
+		parts = append(parts, part)
+	}
+
+	switch len(parts) {
+	case 0:
+		return "", nil
+	case 1:
+		return parts[0], nil
+	}
+	return newMultipartCloudInit(parts)
+}
+
+func parseCloudInitSpec(spec *CloudInitSpec, env *Env) error {
+	expand := func(s string) string {
+		return expandVars(s, env)
+	}
+
+	for i := range spec.Packages {
+		spec.Packages[i] = strings.TrimSpace(expand(spec.Packages[i]))
+		if spec.Packages[i] == "" {
+			return fmt.Errorf("packages[%v]: required", i)
+		}
+	}
+
+	for i := range spec.WriteFiles {
+		f := &spec.WriteFiles[i]
+		f.Path = strings.TrimSpace(expand(f.Path))
+		if !path.IsAbs(f.Path) {
+			return fmt.Errorf("write_files[%v].path: must be an absolute path", i)
+		}
+		f.Content = expand(f.Content)
+		f.Permissions = strings.TrimSpace(expand(f.Permissions))
+		if f.Permissions != "" && !filePermissionsRe.MatchString(f.Permissions) {
+			return fmt.Errorf("write_files[%v].permissions: must be octal, i.e. 0644", i)
+		}
+		f.Owner = strings.TrimSpace(expand(f.Owner))
+	}
+
+	for i := range spec.SystemdUnits {
+		u := &spec.SystemdUnits[i]
+		u.Name = strings.TrimSpace(expand(u.Name))
+		if !systemdUnitRe.MatchString(u.Name) {
+			return fmt.Errorf("systemd_units[%v].name: must be a unit name, i.e. my-app.service", i)
+		}
+		u.Content = expand(u.Content)
+		u.Enable = strings.TrimSpace(expand(u.Enable))
+		if u.Enable != "" {
+			enable, err := strconv.ParseBool(u.Enable)
+			if err != nil {
+				return fmt.Errorf("systemd_units[%v].enable: %v", i, err)
+			}
+			u.enable = enable
+		} else {
+			u.enable = true // set default
+		}
+	}
+
+	for i := range spec.Runcmd {
+		spec.Runcmd[i] = expand(spec.Runcmd[i])
+	}
+
+	for i := range spec.Users {
+		u := &spec.Users[i]
+		u.Name = strings.TrimSpace(expand(u.Name))
+		if u.Name == "" {
+			return fmt.Errorf("users[%v].name: required", i)
+		}
+		for j := range u.Groups {
+			u.Groups[j] = strings.TrimSpace(expand(u.Groups[j]))
+		}
+		u.Sudo = strings.TrimSpace(expand(u.Sudo))
+		u.Shell = strings.TrimSpace(expand(u.Shell))
+		for j := range u.SSHAuthorizedKeys {
+			u.SSHAuthorizedKeys[j] = strings.TrimSpace(expand(u.SSHAuthorizedKeys[j]))
+		}
+	}
+
+	return nil
+}
+
+type cloudConfig struct {
+	Users      []interface{}     `yaml:"users,omitempty"`
+	Packages   []string          `yaml:"packages,omitempty"`
+	WriteFiles []cloudConfigFile `yaml:"write_files,omitempty"`
+	Runcmd     []string          `yaml:"runcmd,omitempty"`
+}
+
+type cloudConfigFile struct {
+	Path        string `yaml:"path"`
+	Content     string `yaml:"content"`
+	Permissions string `yaml:"permissions,omitempty"`
+	Owner       string `yaml:"owner,omitempty"`
+}
+
+type cloudConfigUser struct {
+	Name              string   `yaml:"name"`
+	Groups            string   `yaml:"groups,omitempty"`
+	Sudo              string   `yaml:"sudo,omitempty"`
+	Shell             string   `yaml:"shell,omitempty"`
+	SSHAuthorizedKeys []string `yaml:"ssh_authorized_keys,omitempty"`
+}
+
+// newCloudConfig renders spec as #cloud-config. Systemd units are written
+// to /etc/systemd/system and enabled before other commands run.
+func newCloudConfig(spec *CloudInitSpec) (string, error) {
+	c := cloudConfig{Packages: spec.Packages}
+
+	if len(spec.Users) > 0 {
+		// keep the default user of the image
+		c.Users = append(c.Users, "default")
+		for _, u := range spec.Users {
+			c.Users = append(c.Users, cloudConfigUser{
+				Name:              u.Name,
+				Groups:            strings.Join(u.Groups, ", "),
+				Sudo:              u.Sudo,
+				Shell:             u.Shell,
+				SSHAuthorizedKeys: u.SSHAuthorizedKeys,
+			})
+		}
+	}
+
+	for _, f := range spec.WriteFiles {
+		c.WriteFiles = append(c.WriteFiles, cloudConfigFile(f))
+	}
+
+	for _, u := range spec.SystemdUnits {
+		c.WriteFiles = append(c.WriteFiles, cloudConfigFile{
+			Path:        "/etc/systemd/system/" + u.Name,
+			Content:     u.Content,
+			Permissions: "0644",
+		})
+	}
+
+	if len(spec.SystemdUnits) > 0 {
+		c.Runcmd = append(c.Runcmd, "systemctl daemon-reload")
+		for _, u := range spec.SystemdUnits {
+			if u.enable {
+				c.Runcmd = append(c.Runcmd, "systemctl enable --now "+u.Name)
+			}
+		}
+	}
+	c.Runcmd = append(c.Runcmd, spec.Runcmd...)
+
+	b, err := yaml.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	return "#cloud-config\n" + string(b), nil
+}
+
+// cloudInitContentType returns the MIME type of a cloud-init part.
+func cloudInitContentType(part string) string {
+	switch {
+	case strings.HasPrefix(part, "#!"):
+		return "text/x-shellscript"
+	case strings.HasPrefix(part, "#cloud-boothook"):
+		return "text/cloud-boothook"
+	case strings.HasPrefix(part, "#include"):
+		return "text/x-include-url"
+	default:
+		return "text/cloud-config"
+	}
+}
+
+// newMultipartCloudInit combines parts into a multi-part MIME document.
+// https://cloudinit.readthedocs.io/en/latest/topics/format.html#mime-multi-part-archive
+func newMultipartCloudInit(parts []string) (string, error) {
+	var buf bytes.Buffer
+
+	w := multipart.NewWriter(&buf)
+	if err := w.SetBoundary(cloudInitBoundary); err != nil {
+		return "", err
+	}
+
+	for _, part := range parts {
+		h := textproto.MIMEHeader{}
+		h.Set("Content-Type", cloudInitContentType(part)+`; charset="utf-8"`)
+		h.Set("Mime-Version", "1.0")
+		h.Set("Merge-Type", cloudInitMergeType)
+
+		pw, err := w.CreatePart(h)
+		if err != nil {
+			return "", err
+		}
+		if _, err := pw.Write([]byte(part)); err != nil {
+			return "", err
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+
+	return "Content-Type: multipart/mixed; boundary=\"" + cloudInitBoundary + "\"\r\n" +
+		"MIME-Version: 1.0\r\n\r\n" + buf.String(), nil
+}
+
+// hasCloudInit returns true if the deploy sets user-data.
+func hasCloudInit(dy *Deploy) bool {
+	return dy.CloudInitPath != "" || dy.CloudInitSpec != nil || dy.commonCloudInitSpec != nil
+}
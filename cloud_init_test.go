@@ -0,0 +1,211 @@
+package main
+
+import (
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewCloudConfig(t *testing.T) {
+	spec := &CloudInitSpec{
+		Packages:   []string{"nginx"},
+		WriteFiles: []CloudInitFile{{Path: "/etc/app.conf", Content: "port=${{PORT}}\n", Permissions: "0600"}},
+		SystemdUnits: []CloudInitSystemd{
+			{Name: "app.service", Content: "[Unit]\n"},
+			{Name: "app.timer", Content: "[Timer]\n", Enable: "false"},
+		},
+		Runcmd: []string{"echo done"},
+		Users:  []CloudInitUser{{Name: "deploy", Groups: []string{"docker", "adm"}}},
+	}
+	require.NoError(t, parseCloudInitSpec(spec, newEnv(map[string]string{"PORT": "8080"})))
+
+	c, err := newCloudConfig(spec)
+	require.NoError(t, err)
+
+	expect := `#cloud-config
+users:
+- default
+- name: deploy
+  groups: docker, adm
+packages:
+- nginx
+write_files:
+- path: /etc/app.conf
+  content: |
+    port=8080
+  permissions: "0600"
+- path: /etc/systemd/system/app.service
+  content: |
+    [Unit]
+  permissions: "0644"
+- path: /etc/systemd/system/app.timer
+  content: |
+    [Timer]
+  permissions: "0644"
+runcmd:
+- systemctl daemon-reload
+- systemctl enable --now app.service
+- echo done
+`
+	require.Equal(t, expect, c)
+}
+
+func TestParseCloudInitSpecErrors(t *testing.T) {
+	for _, spec := range []*CloudInitSpec{
+		{Packages: []string{" "}},
+		{WriteFiles: []CloudInitFile{{Path: "etc/app.conf"}}},
+		{WriteFiles: []CloudInitFile{{Path: "/etc/app.conf", Permissions: "rw"}}},
+		{SystemdUnits: []CloudInitSystemd{{Name: "app"}}},
+		{SystemdUnits: []CloudInitSystemd{{Name: "app.service", Enable: "maybe"}}},
+		{Users: []CloudInitUser{{Groups: []string{"adm"}}}},
+	} {
+		require.Error(t, parseCloudInitSpec(spec, nil))
+	}
+}
+
+func TestRenderCloudInit(t *testing.T) {
+	// single part is returned as is
+	c, err := renderCloudInit([]string{"#cloud-config\nruncmd: [a]\n"}, nil)
+	require.NoError(t, err)
+	require.Equal(t, "#cloud-config\nruncmd: [a]\n", c)
+
+	c, err = renderCloudInit(nil, nil, nil, &CloudInitSpec{Runcmd: []string{"b"}})
+	require.NoError(t, err)
+	require.Equal(t, "#cloud-config\nruncmd:\n- b\n", c)
+
+	// multiple parts are combined
+	c, err = renderCloudInit([]string{"#!/bin/sh\necho a\n"}, nil, &CloudInitSpec{Runcmd: []string{"b"}}, &CloudInitSpec{Runcmd: []string{"c"}})
+	require.NoError(t, err)
+
+	msg, err := mail.ReadMessage(strings.NewReader(c))
+	require.NoError(t, err)
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	require.NoError(t, err)
+	require.Equal(t, "multipart/mixed", mediaType)
+
+	r := multipart.NewReader(msg.Body, params["boundary"])
+	types, bodies := []string{}, []string{}
+	for {
+		p, err := r.NextPart()
+		if err != nil {
+			break
+		}
+		b, err := ioutil.ReadAll(p)
+		require.NoError(t, err)
+		require.Equal(t, cloudInitMergeType, p.Header.Get("Merge-Type"))
+		types = append(types, p.Header.Get("Content-Type"))
+		bodies = append(bodies, string(b))
+	}
+
+	require.Equal(t, []string{`text/x-shellscript; charset="utf-8"`, `text/cloud-config; charset="utf-8"`, `text/cloud-config; charset="utf-8"`}, types)
+	require.Equal(t, []string{"#!/bin/sh\necho a\n", "#cloud-config\nruncmd:\n- b\n", "#cloud-config\nruncmd:\n- c\n"}, bodies)
+}
+
+func TestParseConfigCloudInitSpec(t *testing.T) {
+	config := `
+common:
+  cloud_init_spec:
+    packages: [curl]
+
+deploys:
+  - name: test
+    region: w
+    instance_group: x
+    instance_template_base: y
+    instance_template: z
+    cloud_init_spec:
+      runcmd: ["echo ${{NAME}}"]
+    vars:
+      name: test
+  - name: test2
+    region: w
+    instance_group: x
+    instance_template_base: y
+    instance_template: z
+`
+
+	c, err := ParseConfig(strings.NewReader(config))
+	require.NoError(t, err)
+
+	assert.True(t, hasCloudInit(&c.Deploys[0]))
+	assert.True(t, strings.HasPrefix(c.Deploys[0].cloudInit, "Content-Type: multipart/mixed"))
+	assert.Contains(t, c.Deploys[0].cloudInit, "packages:\n- curl\n")
+	assert.Contains(t, c.Deploys[0].cloudInit, "runcmd:\n- echo test\n")
+
+	assert.True(t, hasCloudInit(&c.Deploys[1]))
+	assert.Equal(t, "#cloud-config\npackages:\n- curl\n", c.Deploys[1].cloudInit)
+}
+
+func TestParseConfigCommonCloudInit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	common := filepath.Join(dir, "common.yml")
+	require.NoError(t, ioutil.WriteFile(common, []byte("#cloud-config\npackages: [curl]\n"), 0644))
+	app := filepath.Join(dir, "app.yml")
+	require.NoError(t, ioutil.WriteFile(app, []byte("#cloud-config\nruncmd: [\"echo ${{NAME}}\"]\n"), 0644))
+
+	config := `
+cloud_init_merge: true
+common:
+  cloud_init: ` + common + `
+
+deploys:
+  - name: test
+    region: w
+    instance_group: x
+    instance_template_base: y
+    instance_template: z
+    cloud_init: ` + app + `
+    vars:
+      name: test
+  - name: test2
+    region: w
+    instance_group: x
+    instance_template_base: y
+    instance_template: z
+  - name: test3
+    region: w
+    instance_group: x
+    instance_template_base: y
+    instance_template: z
+    cloud_init: ` + common + `
+`
+
+	c, err := ParseConfig(strings.NewReader(config))
+	require.NoError(t, err)
+
+	// common and deploy files are separate parts
+	assert.True(t, strings.HasPrefix(c.Deploys[0].cloudInit, "Content-Type: multipart/mixed"))
+	assert.Contains(t, c.Deploys[0].cloudInit, "#cloud-config\npackages: [curl]\n")
+	assert.Contains(t, c.Deploys[0].cloudInit, "#cloud-config\nruncmd: [\"echo test\"]\n")
+	assert.True(t, strings.Index(c.Deploys[0].cloudInit, "packages") < strings.Index(c.Deploys[0].cloudInit, "runcmd"))
+
+	assert.Equal(t, "#cloud-config\npackages: [curl]\n", c.Deploys[1].cloudInit)
+	assert.Equal(t, "#cloud-config\npackages: [curl]\n", c.Deploys[2].cloudInit)
+
+	// version 2 merges by default
+	c, err = ParseConfig(strings.NewReader(strings.Replace(config, "cloud_init_merge: true", "version: 2", 1)))
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(c.Deploys[0].cloudInit, "Content-Type: multipart/mixed"))
+
+	// deploys.*.cloud_init overrides common.cloud_init by default
+	for _, s := range []string{"", "cloud_init_merge: false"} {
+		c, err = ParseConfig(strings.NewReader(strings.Replace(config, "cloud_init_merge: true", s, 1)))
+		require.NoError(t, err)
+		assert.Equal(t, "#cloud-config\nruncmd: [\"echo test\"]\n", c.Deploys[0].cloudInit)
+		assert.Equal(t, "#cloud-config\npackages: [curl]\n", c.Deploys[1].cloudInit)
+	}
+
+	_, err = ParseConfig(strings.NewReader(strings.Replace(config, "cloud_init_merge: true", "cloud_init_merge: maybe", 1)))
+	require.Error(t, err)
+}
@@ -1,12 +1,18 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -39,6 +45,7 @@ func ReadGithubActionConfig() (*GithubActionConfig, error) {
 	} else {
 		c.googleApplicationCredentialsData = c.GoogleApplicationCredentials
 	}
+	maskCredentials(c.googleApplicationCredentialsData)
 
 	return c, nil
 }
@@ -64,23 +71,65 @@ func ReadConfigFile(path string) (io.ReadCloser, error) {
 }
 
 type Config struct {
-	DeleteInstanceTemplatesAfter string `yaml:"delete_instance_templates_after"`
+	Version                      string `yaml:"version"`
+	StrictVars                   string `yaml:"strict_vars"`
+	strictVars                   bool
+	CloudInitMerge               string `yaml:"cloud_init_merge"`
+	cloudInitMerge               bool
+	VarFiles                     []VarFile         `yaml:"var_files"`
+	VarCommands                  map[string]string `yaml:"var_commands"`
+	DeleteInstanceTemplatesAfter string            `yaml:"delete_instance_templates_after"`
 	deleteInstanceTemplatesAfter time.Duration
 	Common                       Common   `yaml:"common"`
 	Deploys                      []Deploy `yaml:"deploys"`
+
+	eventVars  map[string]string // see loadEventVars
+	configVars map[string]string // see parseVarFiles
+	env        *Env              // ENV, event and config vars
 }
 
 type Common struct {
-	Project            string            `yaml:"project"`
-	Region             string            `yaml:"region"`
-	StartupScriptPath  string            `yaml:"startup_script"`
-	ShutdownScriptPath string            `yaml:"shutdown_script"`
-	CloudInitPath      string            `yaml:"cloud_init"`
-	Vars               map[string]string `yaml:"vars"`
-	Labels             map[string]string `yaml:"labels"`
-	Metadata           map[string]string `yaml:"metadata"`
-	Tags               []string          `yaml:"tags"`
-	UpdatePolicy       UpdatePolicy      `yaml:"update_policy"`
+	Project              string                `yaml:"project"`
+	Region               string                `yaml:"region"`
+	StartupScriptPath    string                `yaml:"startup_script"`
+	ShutdownScriptPath   string                `yaml:"shutdown_script"`
+	SpecializeScriptPath string                `yaml:"specialize_script"`
+	OS                   string                `yaml:"os"`
+	ScriptType           string                `yaml:"script_type"`
+	CloudInitPath        string                `yaml:"cloud_init"`
+	CloudInitSpec        *CloudInitSpec        `yaml:"cloud_init_spec"`
+	UploadTo             string                `yaml:"upload_to"`
+	Compress             string                `yaml:"compress"`
+	Files                *Files                `yaml:"files"`
+	Vars                 Vars                  `yaml:"vars"`
+	Labels               map[string]string     `yaml:"labels"`
+	Metadata             map[string]string     `yaml:"metadata"`
+	Tags                 []string              `yaml:"tags"`
+	RemoveLabels         []string              `yaml:"remove_labels"`
+	RemoveMetadata       []string              `yaml:"remove_metadata"`
+	RemoveTags           []string              `yaml:"remove_tags"`
+	UpdatePolicy         UpdatePolicy          `yaml:"update_policy"`
+	Preview              Preview               `yaml:"preview"`
+	TTL                  string                `yaml:"ttl"`
+	InstanceGroupSpec    *InstanceGroupSpec    `yaml:"instance_group_spec"`
+	InstanceTemplateSpec *InstanceTemplateSpec `yaml:"instance_template_spec"`
+	MachineType          string                `yaml:"machine_type"`
+	MinCpuPlatform       string                `yaml:"min_cpu_platform"`
+	BootDisk             *BootDisk             `yaml:"boot_disk"`
+	GuestAccelerators    []GuestAccelerator    `yaml:"guest_accelerators"`
+	Image                string                `yaml:"image"`
+	Network              string                `yaml:"network"`
+	Subnetwork           string                `yaml:"subnetwork"`
+	NetworkTier          string                `yaml:"network_tier"`
+	ExternalIP           string                `yaml:"external_ip"`
+	AliasIPRanges        []AliasIPRange        `yaml:"alias_ip_ranges"`
+	Scheduling           *Scheduling           `yaml:"scheduling"`
+	ServiceAccount       *ServiceAccount       `yaml:"service_account"`
+	ShieldedVM           *ShieldedVM           `yaml:"shielded_vm"`
+	ConfidentialCompute  string                `yaml:"confidential_compute"`
+	DiskEncryptionKey    string                `yaml:"disk_encryption_key"`
+
+	secretVars map[string]bool // vars marked with secret: true
 }
 
 type Deploy struct {
@@ -96,13 +145,67 @@ type Deploy struct {
 	startupScript                    string
 	ShutdownScriptPath               string `yaml:"shutdown_script"`
 	shutdownScript                   string
+	SpecializeScriptPath             string `yaml:"specialize_script"`
+	specializeScript                 string
+	OS                               string `yaml:"os"`
+	ScriptType                       string `yaml:"script_type"`
+	scriptType                       string
 	CloudInitPath                    string `yaml:"cloud_init"`
+	commonCloudInitPath              string
 	cloudInit                        string
-	Vars                             map[string]string `yaml:"vars"`
+	CloudInitSpec                    *CloudInitSpec `yaml:"cloud_init_spec"`
+	commonCloudInitSpec              *CloudInitSpec
+	UploadTo                         string `yaml:"upload_to"`
+	uploadScripts                    bool
+	startupScriptURL                 string // set after upload
+	shutdownScriptURL                string // set after upload
+	specializeScriptURL              string // set after upload
+	Compress                         string `yaml:"compress"`
+	compress                         bool
+	compressed                       []compressedScript
+	Files                            *Files            `yaml:"files"`
+	filesArchive                     string            // base64 encoded tar.gz
+	filesURL                         string            // gs:// url, if uploaded
+	Container                        *Container        `yaml:"container"`
+	Vars                             Vars              `yaml:"vars"`
+	secretVars                       map[string]bool   // vars marked with secret: true
+	env                              *Env              // config env, see Config.env
 	Labels                           map[string]string `yaml:"labels"`
 	Metadata                         map[string]string `yaml:"metadata"`
 	Tags                             []string          `yaml:"tags"`
+	ownLabels                        map[string]bool   // not inherited from common
+	ownMetadata                      map[string]bool   // not inherited from common
+	ownTags                          []string          // not inherited from common
+	RemoveLabels                     []string          `yaml:"remove_labels"`
+	RemoveMetadata                   []string          `yaml:"remove_metadata"`
+	RemoveTags                       []string          `yaml:"remove_tags"`
 	UpdatePolicy                     UpdatePolicy      `yaml:"update_policy"`
+	Preview                          Preview           `yaml:"preview"`
+	TTL                              string            `yaml:"ttl"`
+	ttl                              time.Duration
+	InstanceGroupSpec                *InstanceGroupSpec    `yaml:"instance_group_spec"`
+	InstanceTemplateSpec             *InstanceTemplateSpec `yaml:"instance_template_spec"`
+	MachineType                      string                `yaml:"machine_type"`
+	MinCpuPlatform                   string                `yaml:"min_cpu_platform"`
+	BootDisk                         *BootDisk             `yaml:"boot_disk"`
+	GuestAccelerators                []GuestAccelerator    `yaml:"guest_accelerators"`
+	Image                            string                `yaml:"image"`
+	image                            string                // image name or url
+	imageFamily                      string                // image family, resolved on deploy
+	imageFamilyProject               string
+	sourceImage                      string // resolved image url
+	Network                          string `yaml:"network"`
+	Subnetwork                       string `yaml:"subnetwork"`
+	NetworkTier                      string `yaml:"network_tier"`
+	ExternalIP                       string `yaml:"external_ip"`
+	externalIP                       bool
+	AliasIPRanges                    []AliasIPRange  `yaml:"alias_ip_ranges"`
+	Scheduling                       *Scheduling     `yaml:"scheduling"`
+	ServiceAccount                   *ServiceAccount `yaml:"service_account"`
+	ShieldedVM                       *ShieldedVM     `yaml:"shielded_vm"`
+	ConfidentialCompute              string          `yaml:"confidential_compute"`
+	confidentialCompute              bool
+	DiskEncryptionKey                string `yaml:"disk_encryption_key"`
 }
 
 type UpdatePolicy struct {
@@ -119,43 +222,261 @@ type UpdatePolicy struct {
 	maxUnavailableInPercent bool
 }
 
+// Preview deploys create their own instance group per pull request.
+type Preview struct {
+	Enabled     string `yaml:"enabled"`
+	enabled     bool
+	PullRequest string `yaml:"pull_request"`
+	pullRequest int
+	TargetSize  string `yaml:"target_size"`
+	targetSize  int
+
+	instanceGroupBase string // instance_group before the pull request suffix is added
+}
+
+// InstanceGroupSpec is used to create a missing instance group.
+type InstanceGroupSpec struct {
+	TargetSize  string `yaml:"target_size"`
+	targetSize  int
+	Zones       []string          `yaml:"zones"`
+	NamedPorts  map[string]string `yaml:"named_ports"`
+	namedPorts  map[string]int64
+	Autohealing Autohealing `yaml:"autohealing"`
+}
+
+// InstanceTemplateSpec is used to create instance templates without
+// instance template base.
+type InstanceTemplateSpec struct {
+	MachineType       string             `yaml:"machine_type"`
+	BootDisk          BootDisk           `yaml:"boot_disk"`
+	NetworkInterfaces []NetworkInterface `yaml:"network_interfaces"`
+	ServiceAccount    *ServiceAccount    `yaml:"service_account"`
+	Scheduling        *Scheduling        `yaml:"scheduling"`
+	Labels            map[string]string  `yaml:"labels"`
+	Metadata          map[string]string  `yaml:"metadata"`
+}
+
+type BootDisk struct {
+	Image  string `yaml:"image"`
+	SizeGb string `yaml:"size_gb"`
+	sizeGb int64
+	Type   string `yaml:"type"`
+}
+
+type GuestAccelerator struct {
+	Type  string `yaml:"type"`
+	Count string `yaml:"count"`
+	count int64
+}
+
+type NetworkInterface struct {
+	Network       string `yaml:"network"`
+	Subnetwork    string `yaml:"subnetwork"`
+	NetworkTier   string `yaml:"network_tier"`
+	ExternalIP    string `yaml:"external_ip"`
+	externalIP    bool
+	AliasIPRanges []AliasIPRange `yaml:"alias_ip_ranges"`
+}
+
+type AliasIPRange struct {
+	IPCidrRange         string `yaml:"ip_cidr_range"`
+	SubnetworkRangeName string `yaml:"subnetwork_range_name"`
+}
+
+type ServiceAccount struct {
+	Email  string   `yaml:"email"`
+	Scopes []string `yaml:"scopes"`
+}
+
+type Container struct {
+	Image         string            `yaml:"image"`
+	Command       []string          `yaml:"command"`
+	Args          []string          `yaml:"args"`
+	Env           map[string]string `yaml:"env"`
+	SecretEnv     []string          `yaml:"secret_env"` // env names masked in logs
+	Volumes       []ContainerVolume `yaml:"volumes"`
+	RestartPolicy string            `yaml:"restart_policy"`
+	Privileged    string            `yaml:"privileged"`
+	privileged    bool
+}
+
+type ContainerVolume struct {
+	HostPath  string `yaml:"host_path"`
+	Tmpfs     string `yaml:"tmpfs"`
+	tmpfs     bool
+	MountPath string `yaml:"mount_path"`
+	ReadOnly  string `yaml:"read_only"`
+	readOnly  bool
+}
+
+type CloudInitSpec struct {
+	Packages     []string           `yaml:"packages"`
+	WriteFiles   []CloudInitFile    `yaml:"write_files"`
+	SystemdUnits []CloudInitSystemd `yaml:"systemd_units"`
+	Runcmd       []string           `yaml:"runcmd"`
+	Users        []CloudInitUser    `yaml:"users"`
+}
+
+type CloudInitFile struct {
+	Path        string `yaml:"path"`
+	Content     string `yaml:"content"`
+	Permissions string `yaml:"permissions"`
+	Owner       string `yaml:"owner"`
+}
+
+type CloudInitSystemd struct {
+	Name    string `yaml:"name"`
+	Content string `yaml:"content"`
+	Enable  string `yaml:"enable"`
+	enable  bool
+}
+
+type CloudInitUser struct {
+	Name              string   `yaml:"name"`
+	Groups            []string `yaml:"groups"`
+	Sudo              string   `yaml:"sudo"`
+	Shell             string   `yaml:"shell"`
+	SSHAuthorizedKeys []string `yaml:"ssh_authorized_keys"`
+}
+
+type Files struct {
+	Dir       string   `yaml:"dir"`
+	Dest      string   `yaml:"dest"`
+	Templates []string `yaml:"templates"`
+}
+
+type ShieldedVM struct {
+	SecureBoot          string `yaml:"secure_boot"`
+	secureBoot          *bool
+	Vtpm                string `yaml:"vtpm"`
+	vtpm                *bool
+	IntegrityMonitoring string `yaml:"integrity_monitoring"`
+	integrityMonitoring *bool
+}
+
+type Scheduling struct {
+	ProvisioningModel         string `yaml:"provisioning_model"`
+	Preemptible               string `yaml:"preemptible"`
+	preemptible               bool
+	AutomaticRestart          string `yaml:"automatic_restart"`
+	automaticRestart          bool
+	OnHostMaintenance         string `yaml:"on_host_maintenance"`
+	InstanceTerminationAction string `yaml:"instance_termination_action"`
+}
+
+type Autohealing struct {
+	HealthCheck     string `yaml:"health_check"`
+	InitialDelaySec string `yaml:"initial_delay_sec"`
+	initialDelaySec int
+}
+
 func ParseConfig(b io.Reader) (*Config, error) {
+	raw, err := ioutil.ReadAll(b)
+	if err != nil {
+		return nil, fmt.Errorf("config: %v", err)
+	}
+
+	// file name used in annotations
+	file := "deploy.yml"
+	if f, ok := b.(interface{ Name() string }); ok {
+		file = f.Name()
+	}
+
 	c := &Config{}
-	d := yaml.NewDecoder(b)
+	d := yaml.NewDecoder(bytes.NewReader(raw))
 	d.SetStrict(true)
 	if err := d.Decode(c); err != nil && err != io.EOF {
 		return nil, fmt.Errorf("config: %v", err)
 	}
 
+	if err := loadEventVars(c); err != nil {
+		return nil, err
+	}
+
+	// variable errors are collected and reported at once
+	annotations := make([]Annotation, 0)
+	usedVars := make(map[string]bool)
+
+	// secrets are resolved with github action creds, unless a deploy has creds
+	secrets := newSecretResolver()
+	c.env = newEnv(environVars(), c.eventVars).Record(&varRecorder{used: usedVars}).WithSecrets(secrets, "")
+
+	if err := parseVarFiles(c); err != nil {
+		return nil, err
+	}
+
+	if err := parseStrictVars(c); err != nil {
+		return nil, err
+	}
+
+	if err := parseCloudInitMerge(c); err != nil {
+		return nil, err
+	}
+
 	// merge common config
 	for i := 0; i < len(c.Deploys); i++ {
 		deploy := &c.Deploys[i]
 
-		if strings.TrimSpace(deploy.Project) == "" {
-			deploy.Project = c.Common.Project
-		}
-		if strings.TrimSpace(deploy.Region) == "" {
-			deploy.Region = c.Common.Region
-		}
+		mergeCommonTarget(deploy, &c.Common)
+
 		if strings.TrimSpace(deploy.StartupScriptPath) == "" {
 			deploy.StartupScriptPath = c.Common.StartupScriptPath
 		}
 		if strings.TrimSpace(deploy.ShutdownScriptPath) == "" {
 			deploy.ShutdownScriptPath = c.Common.ShutdownScriptPath
 		}
+		if strings.TrimSpace(deploy.SpecializeScriptPath) == "" {
+			deploy.SpecializeScriptPath = c.Common.SpecializeScriptPath
+		}
+		if strings.TrimSpace(deploy.OS) == "" {
+			deploy.OS = c.Common.OS
+		}
+		if strings.TrimSpace(deploy.ScriptType) == "" {
+			deploy.ScriptType = c.Common.ScriptType
+		}
+		// common.cloud_init is combined with deploys.*.cloud_init, if cloud_init_merge is set
 		if strings.TrimSpace(deploy.CloudInitPath) == "" {
 			deploy.CloudInitPath = c.Common.CloudInitPath
+		} else if c.cloudInitMerge && strings.TrimSpace(c.Common.CloudInitPath) != "" && c.Common.CloudInitPath != deploy.CloudInitPath {
+			deploy.commonCloudInitPath = c.Common.CloudInitPath
+		}
+		// common.cloud_init_spec is combined with deploys.*.cloud_init_spec
+		if c.Common.CloudInitSpec != nil {
+			deploy.commonCloudInitSpec = &CloudInitSpec{}
+			if err := deepCopy(c.Common.CloudInitSpec, deploy.commonCloudInitSpec); err != nil {
+				return nil, err
+			}
+		}
+		if strings.TrimSpace(deploy.UploadTo) == "" {
+			deploy.UploadTo = c.Common.UploadTo
+		}
+		if strings.TrimSpace(deploy.Compress) == "" {
+			deploy.Compress = c.Common.Compress
 		}
 
 		if deploy.Vars == nil {
 			deploy.Vars = make(map[string]string)
 		}
+		if deploy.secretVars == nil {
+			deploy.secretVars = make(map[string]bool)
+		}
 		for k, v := range c.Common.Vars {
 			if _, ok := deploy.Vars[k]; !ok {
 				deploy.Vars[k] = v
+				deploy.secretVars[k] = c.Common.secretVars[k]
 			}
 		}
 
+		deploy.ownLabels = make(map[string]bool)
+		for k := range deploy.Labels {
+			deploy.ownLabels[k] = true
+		}
+		deploy.ownMetadata = make(map[string]bool)
+		for k := range deploy.Metadata {
+			deploy.ownMetadata[k] = true
+		}
+		deploy.ownTags = append([]string{}, deploy.Tags...)
+
 		if deploy.Labels == nil {
 			deploy.Labels = make(map[string]string)
 		}
@@ -176,6 +497,10 @@ func ParseConfig(b io.Reader) (*Config, error) {
 
 		deploy.Tags = append(deploy.Tags, c.Common.Tags...)
 
+		deploy.RemoveLabels = append(deploy.RemoveLabels, c.Common.RemoveLabels...)
+		deploy.RemoveMetadata = append(deploy.RemoveMetadata, c.Common.RemoveMetadata...)
+		deploy.RemoveTags = append(deploy.RemoveTags, c.Common.RemoveTags...)
+
 		if strings.TrimSpace(deploy.UpdatePolicy.Type) == "" {
 			deploy.UpdatePolicy.Type = c.Common.UpdatePolicy.Type
 		}
@@ -197,92 +522,170 @@ func ParseConfig(b io.Reader) (*Config, error) {
 		if strings.TrimSpace(deploy.UpdatePolicy.MaxUnavailable) == "" {
 			deploy.UpdatePolicy.MaxUnavailable = c.Common.UpdatePolicy.MaxUnavailable
 		}
-	}
 
-	// if DeleteInstanceTemplatesAfter is not set to false
-	if c.DeleteInstanceTemplatesAfter != "false" {
-		// parse and set duration if set
-		if c.DeleteInstanceTemplatesAfter != "" {
-			duration, err := time.ParseDuration(c.DeleteInstanceTemplatesAfter)
-			if err != nil {
+		if strings.TrimSpace(deploy.TTL) == "" {
+			deploy.TTL = c.Common.TTL
+		}
+
+		if deploy.InstanceGroupSpec == nil && c.Common.InstanceGroupSpec != nil {
+			deploy.InstanceGroupSpec = &InstanceGroupSpec{}
+			if err := deepCopy(c.Common.InstanceGroupSpec, deploy.InstanceGroupSpec); err != nil {
+				return nil, err
+			}
+		}
+
+		if strings.TrimSpace(deploy.MachineType) == "" {
+			deploy.MachineType = c.Common.MachineType
+		}
+		if strings.TrimSpace(deploy.MinCpuPlatform) == "" {
+			deploy.MinCpuPlatform = c.Common.MinCpuPlatform
+		}
+		if deploy.BootDisk == nil && c.Common.BootDisk != nil {
+			bootDisk := *c.Common.BootDisk
+			deploy.BootDisk = &bootDisk
+		}
+		if len(deploy.GuestAccelerators) == 0 {
+			deploy.GuestAccelerators = append(deploy.GuestAccelerators, c.Common.GuestAccelerators...)
+		}
+		if strings.TrimSpace(deploy.Image) == "" {
+			deploy.Image = c.Common.Image
+		}
+		if strings.TrimSpace(deploy.Network) == "" {
+			deploy.Network = c.Common.Network
+		}
+		if strings.TrimSpace(deploy.Subnetwork) == "" {
+			deploy.Subnetwork = c.Common.Subnetwork
+		}
+		if strings.TrimSpace(deploy.NetworkTier) == "" {
+			deploy.NetworkTier = c.Common.NetworkTier
+		}
+		if strings.TrimSpace(deploy.ExternalIP) == "" {
+			deploy.ExternalIP = c.Common.ExternalIP
+		}
+		if len(deploy.AliasIPRanges) == 0 {
+			deploy.AliasIPRanges = append(deploy.AliasIPRanges, c.Common.AliasIPRanges...)
+		}
+		if deploy.Files == nil && c.Common.Files != nil {
+			files := *c.Common.Files
+			files.Templates = append([]string{}, c.Common.Files.Templates...)
+			deploy.Files = &files
+		}
+		if deploy.Scheduling == nil && c.Common.Scheduling != nil {
+			scheduling := *c.Common.Scheduling
+			deploy.Scheduling = &scheduling
+		}
+		if deploy.ServiceAccount == nil && c.Common.ServiceAccount != nil {
+			serviceAccount := *c.Common.ServiceAccount
+			serviceAccount.Scopes = append([]string{}, c.Common.ServiceAccount.Scopes...)
+			deploy.ServiceAccount = &serviceAccount
+		}
+		if deploy.ShieldedVM == nil && c.Common.ShieldedVM != nil {
+			shieldedVM := *c.Common.ShieldedVM
+			deploy.ShieldedVM = &shieldedVM
+		}
+		if strings.TrimSpace(deploy.ConfidentialCompute) == "" {
+			deploy.ConfidentialCompute = c.Common.ConfidentialCompute
+		}
+		if strings.TrimSpace(deploy.DiskEncryptionKey) == "" {
+			deploy.DiskEncryptionKey = c.Common.DiskEncryptionKey
+		}
+
+		if deploy.InstanceTemplateSpec == nil && c.Common.InstanceTemplateSpec != nil && strings.TrimSpace(deploy.InstanceTemplateBase) == "" {
+			deploy.InstanceTemplateSpec = &InstanceTemplateSpec{}
+			if err := deepCopy(c.Common.InstanceTemplateSpec, deploy.InstanceTemplateSpec); err != nil {
 				return nil, err
 			}
-			c.deleteInstanceTemplatesAfter = duration
-		} else {
-			// or set default
-			c.deleteInstanceTemplatesAfter = 24 * time.Hour * 14 // 14 days
 		}
 	}
 
+	if err := parseDeleteInstanceTemplatesAfter(c); err != nil {
+		return nil, err
+	}
+
 	// expand env variables
 	for i := range c.Deploys {
 		dy := &c.Deploys[i]
+		dy.env = c.env.Record(&varRecorder{used: usedVars})
 
-		dy.Name = expandVars(dy.Name, getEnv(nil))
+		// creds are expanded with the github action creds, all other
+		// fields with the creds of the deploy
+		parseCreds(dy)
+		dy.env = dy.env.WithSecrets(secrets, dy.googleApplicationCredentialsData)
+
+		dy.Name = expandVars(dy.Name, dy.env)
 		if dy.Name == "" {
 			return nil, fmt.Errorf("deploy item #%v needs name", i+1)
 		}
 
-		dy.Project = expandVars(dy.Project, getEnv(nil))
-
-		dy.GoogleApplicationCredentials = expandVars(dy.GoogleApplicationCredentials, getEnv(nil))
-
-		f, err := ioutil.ReadFile(dy.GoogleApplicationCredentials)
-		if err == nil {
-			dy.googleApplicationCredentialsData = string(f)
-		} else {
-			dy.googleApplicationCredentialsData = dy.GoogleApplicationCredentials
-		}
+		dy.Project = expandVars(dy.Project, dy.env)
 
-		dy.Region = expandVars(dy.Region, getEnv(nil))
+		dy.Region = expandVars(dy.Region, dy.env)
 		if dy.Region == "" {
 			return nil, fmt.Errorf("deploy '%v' needs region", dy.Name)
 		}
 
-		dy.InstanceGroup = expandVars(dy.InstanceGroup, getEnv(nil))
+		dy.InstanceGroup = expandVars(dy.InstanceGroup, dy.env)
 		if dy.InstanceGroup == "" {
 			return nil, fmt.Errorf("deploy '%v' needs instance_group", dy.Name)
 		}
 
-		dy.InstanceTemplateBase = expandVars(dy.InstanceTemplateBase, getEnv(nil))
-		if dy.InstanceTemplateBase == "" {
-			return nil, fmt.Errorf("deploy '%v' needs instance_template_base", dy.Name)
+		dy.InstanceTemplateBase = expandVars(dy.InstanceTemplateBase, dy.env)
+		if dy.InstanceTemplateBase == "" && dy.InstanceTemplateSpec == nil {
+			return nil, fmt.Errorf("deploy '%v' needs instance_template_base or instance_template_spec", dy.Name)
+		}
+		if dy.InstanceTemplateBase != "" && dy.InstanceTemplateSpec != nil {
+			return nil, fmt.Errorf("deploy '%v' can't have both instance_template_base and instance_template_spec", dy.Name)
 		}
 
-		dy.InstanceTemplate = expandVars(dy.InstanceTemplate, getEnv(nil))
+		dy.InstanceTemplate = expandVars(dy.InstanceTemplate, dy.env)
 		if dy.InstanceTemplate == "" {
 			return nil, fmt.Errorf("deploy '%v' needs instance_template", dy.Name)
 		}
 
-		dy.StartupScriptPath = expandVars(dy.StartupScriptPath, getEnv(nil))
+		dy.StartupScriptPath = expandVars(dy.StartupScriptPath, dy.env)
+
+		dy.ShutdownScriptPath = expandVars(dy.ShutdownScriptPath, dy.env)
 
-		dy.ShutdownScriptPath = expandVars(dy.ShutdownScriptPath, getEnv(nil))
+		dy.SpecializeScriptPath = expandVars(dy.SpecializeScriptPath, dy.env)
 
-		dy.CloudInitPath = expandVars(dy.CloudInitPath, getEnv(nil))
+		dy.CloudInitPath = expandVars(dy.CloudInitPath, dy.env)
+		dy.commonCloudInitPath = expandVars(dy.commonCloudInitPath, dy.env)
+
+		if err := parseScriptType(dy); err != nil {
+			return nil, fmt.Errorf("deploy '%v': %v", dy.Name, err)
+		}
 
 		for k, v := range dy.Vars {
-			dy.Vars[k] = expandVars(v, getEnv(nil))
+			dy.Vars[k] = expandVars(v, dy.env)
+			if dy.secretVars[k] {
+				addSecretMask(dy.Vars[k])
+			}
 		}
 
 		for k, v := range dy.Labels {
-			dy.Labels[k] = expandVars(v, getEnv(nil))
+			dy.Labels[k] = expandVars(v, dy.env)
 		}
 
 		for k, v := range dy.Metadata {
-			dy.Metadata[k] = expandVars(v, getEnv(nil))
+			dy.Metadata[k] = expandVars(v, dy.env)
 		}
 
 		for j := range dy.Tags {
-			dy.Tags[j] = expandVars(dy.Tags[j], getEnv(nil))
+			dy.Tags[j] = expandVars(dy.Tags[j], dy.env)
+		}
+		dy.Tags = dedupe(dy.Tags)
+
+		if err := parseRemovals(dy); err != nil {
+			return nil, fmt.Errorf("deploy '%v': %v", dy.Name, err)
 		}
 
 		// expand vars in update policy
-		dy.UpdatePolicy.Type = expandVars(dy.UpdatePolicy.Type, getEnv(nil))
-		dy.UpdatePolicy.MinimalAction = expandVars(dy.UpdatePolicy.MinimalAction, getEnv(nil))
-		dy.UpdatePolicy.ReplacementMethod = expandVars(dy.UpdatePolicy.ReplacementMethod, getEnv(nil))
-		dy.UpdatePolicy.MinReadySec = expandVars(dy.UpdatePolicy.MinReadySec, getEnv(nil))
-		dy.UpdatePolicy.MaxSurge = expandVars(dy.UpdatePolicy.MaxSurge, getEnv(nil))
-		dy.UpdatePolicy.MaxUnavailable = expandVars(dy.UpdatePolicy.MaxUnavailable, getEnv(nil))
+		dy.UpdatePolicy.Type = expandVars(dy.UpdatePolicy.Type, dy.env)
+		dy.UpdatePolicy.MinimalAction = expandVars(dy.UpdatePolicy.MinimalAction, dy.env)
+		dy.UpdatePolicy.ReplacementMethod = expandVars(dy.UpdatePolicy.ReplacementMethod, dy.env)
+		dy.UpdatePolicy.MinReadySec = expandVars(dy.UpdatePolicy.MinReadySec, dy.env)
+		dy.UpdatePolicy.MaxSurge = expandVars(dy.UpdatePolicy.MaxSurge, dy.env)
+		dy.UpdatePolicy.MaxUnavailable = expandVars(dy.UpdatePolicy.MaxUnavailable, dy.env)
 
 		if strings.TrimSpace(dy.UpdatePolicy.Type) == "" {
 			dy.UpdatePolicy.Type = "PROACTIVE"
@@ -346,6 +749,41 @@ func ParseConfig(b io.Reader) (*Config, error) {
 		} else {
 			dy.UpdatePolicy.maxUnavailable = 0 // set default
 		}
+
+		if err := parsePreview(dy); err != nil {
+			return nil, err
+		}
+
+		// stamp expiry label on created resources
+		dy.TTL = expandVars(dy.TTL, dy.env)
+		if strings.TrimSpace(dy.TTL) != "" {
+			ttl, err := time.ParseDuration(strings.TrimSpace(dy.TTL))
+			if err != nil {
+				return nil, fmt.Errorf("ttl: %v", err)
+			}
+			dy.ttl = ttl
+
+			if dy.Labels == nil {
+				dy.Labels = make(map[string]string)
+			}
+			dy.Labels[expiresLabel] = formatExpiresLabel(time.Now().Add(ttl))
+		}
+
+		if dy.InstanceGroupSpec != nil {
+			if err := parseInstanceGroupSpec(dy.InstanceGroupSpec, dy.env); err != nil {
+				return nil, fmt.Errorf("deploy '%v': instance_group_spec.%v", dy.Name, err)
+			}
+		}
+
+		if dy.InstanceTemplateSpec != nil {
+			if err := parseInstanceTemplateSpec(dy.InstanceTemplateSpec, dy.env); err != nil {
+				return nil, fmt.Errorf("deploy '%v': instance_template_spec.%v", dy.Name, err)
+			}
+		}
+
+		if err := parseInstanceTemplateOverrides(dy); err != nil {
+			return nil, fmt.Errorf("deploy '%v': %v", dy.Name, err)
+		}
 	}
 
 	// read contents of scripts and expand env vars
@@ -357,7 +795,11 @@ func ParseConfig(b io.Reader) (*Config, error) {
 			if err != nil {
 				return nil, fmt.Errorf("startup_script: %v", err)
 			}
-			dy.startupScript = expandVars(string(f), getEnv(dy.Vars))
+			annotations = append(annotations, findVarErrors(dy.StartupScriptPath, string(f), scriptVariableRe(dy), dy.env.With(dy.Vars), usedVars, c.strictVars)...)
+			dy.startupScript = expandScriptVars(dy, string(f))
+			if err := logAnnotations(validateDeployScript(dy, dy.StartupScriptPath, string(f))); err != nil {
+				return nil, fmt.Errorf("deploy '%v': startup_script: %v", dy.Name, err)
+			}
 		}
 
 		if dy.ShutdownScriptPath != "" {
@@ -365,86 +807,1208 @@ func ParseConfig(b io.Reader) (*Config, error) {
 			if err != nil {
 				return nil, fmt.Errorf("shutdown_script: %v", err)
 			}
-			dy.shutdownScript = expandVars(string(f), getEnv(dy.Vars))
+			annotations = append(annotations, findVarErrors(dy.ShutdownScriptPath, string(f), scriptVariableRe(dy), dy.env.With(dy.Vars), usedVars, c.strictVars)...)
+			dy.shutdownScript = expandScriptVars(dy, string(f))
+			if err := logAnnotations(validateDeployScript(dy, dy.ShutdownScriptPath, string(f))); err != nil {
+				return nil, fmt.Errorf("deploy '%v': shutdown_script: %v", dy.Name, err)
+			}
+		}
+
+		if dy.SpecializeScriptPath != "" {
+			f, err := downloadOrReadFile(dy.SpecializeScriptPath)
+			if err != nil {
+				return nil, fmt.Errorf("specialize_script: %v", err)
+			}
+			annotations = append(annotations, findVarErrors(dy.SpecializeScriptPath, string(f), scriptVariableRe(dy), dy.env.With(dy.Vars), usedVars, c.strictVars)...)
+			dy.specializeScript = expandScriptVars(dy, string(f))
+			if err := logAnnotations(validateDeployScript(dy, dy.SpecializeScriptPath, string(f))); err != nil {
+				return nil, fmt.Errorf("deploy '%v': specialize_script: %v", dy.Name, err)
+			}
 		}
 
-		if dy.CloudInitPath != "" {
-			f, err := downloadOrReadFile(dy.CloudInitPath)
+		cloudInits := make([]string, 0)
+		for _, p := range []string{dy.commonCloudInitPath, dy.CloudInitPath} {
+			if p == "" {
+				continue
+			}
+			f, err := downloadOrReadFile(p)
 			if err != nil {
 				return nil, fmt.Errorf("cloud_init: %v", err)
 			}
-			dy.cloudInit = expandVars(string(f), getEnv(dy.Vars))
+			annotations = append(annotations, findVarErrors(p, string(f), variableRe, dy.env.With(dy.Vars), usedVars, c.strictVars)...)
+			cloudInit := expandVars(string(f), dy.env.With(dy.Vars).Record(nil))
+			if err := logAnnotations(validateCloudInit(p, cloudInit)); err != nil {
+				return nil, fmt.Errorf("deploy '%v': cloud_init: %v", dy.Name, err)
+			}
+			cloudInits = append(cloudInits, cloudInit)
+		}
+
+		if len(cloudInits) > 0 || dy.commonCloudInitSpec != nil || dy.CloudInitSpec != nil {
+			cloudInit, err := renderCloudInit(cloudInits, dy.env.With(dy.Vars), dy.commonCloudInitSpec, dy.CloudInitSpec)
+			if err != nil {
+				return nil, fmt.Errorf("deploy '%v': cloud_init_spec.%v", dy.Name, err)
+			}
+			dy.cloudInit = cloudInit
+		}
+
+		if dy.Files != nil {
+			a, err := parseFiles(dy, usedVars, c.strictVars)
+			if err != nil {
+				return nil, fmt.Errorf("deploy '%v': files.%v", dy.Name, err)
+			}
+			annotations = append(annotations, a...)
+		}
+
+		if dy.Container != nil {
+			if err := parseContainer(dy.Container, dy.env.With(dy.Vars)); err != nil {
+				return nil, fmt.Errorf("deploy '%v': container.%v", dy.Name, err)
+			}
+			if _, ok := dy.Metadata[containerDeclarationKey]; ok {
+				return nil, fmt.Errorf("deploy '%v': container: %v is also set in metadata", dy.Name, containerDeclarationKey)
+			}
+		}
+
+		if err := parseCompress(dy); err != nil {
+			return nil, fmt.Errorf("deploy '%v': %v", dy.Name, err)
+		}
+
+		if err := parseUploadTo(dy); err != nil {
+			return nil, fmt.Errorf("deploy '%v': %v", dy.Name, err)
 		}
 	}
 
+	// deploy.yml is expanded with ENV, only cloud_init_spec and container
+	// are expanded with the vars of the deploy, too
+	configAnnotations := findRecordedVarErrors(file, string(raw), "", c.env.rec, c.strictVars)
+	for _, dy := range c.Deploys {
+		configAnnotations = append(configAnnotations, findRecordedVarErrors(file, string(raw), fmt.Sprintf("deploy '%v': ", dy.Name), dy.env.rec, c.strictVars)...)
+	}
+	sort.SliceStable(configAnnotations, func(i, j int) bool {
+		return configAnnotations[i].Line < configAnnotations[j].Line
+	})
+	annotations = append(annotations, configAnnotations...)
+	if c.strictVars {
+		annotations = append(annotations, findUnusedVars(file, string(raw), c, usedVars)...)
+	}
+
+	if err := logAnnotations(annotations); err != nil {
+		return nil, err
+	}
+
 	return c, nil
 }
 
-func getEnv(locals map[string]string) map[string]string {
-	m := make(map[string]string)
+// ParseMaintenanceConfig parses the config for the cleanup, teardown and
+// reap commands, which only need the creds, project, region, instance group
+// and preview of each deploy. Scripts and files aren't read, var_files and
+// var_commands aren't loaded and secrets aren't resolved.
+func ParseMaintenanceConfig(b io.Reader) (*Config, error) {
+	c := &Config{}
+	d := yaml.NewDecoder(b)
+	d.SetStrict(true)
+	if err := d.Decode(c); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("config: %v", err)
+	}
 
-	for _, v := range environ {
-		x := strings.SplitN(v, "=", 2)
-		m[strings.ToLower(x[0])] = x[1]
+	if err := loadEventVars(c); err != nil {
+		return nil, err
 	}
+	c.env = newEnv(environVars(), c.eventVars)
 
-	for k, v := range locals {
-		m[strings.ToLower(k)] = v
+	if err := parseDeleteInstanceTemplatesAfter(c); err != nil {
+		return nil, err
 	}
 
-	return m
-}
+	for i := range c.Deploys {
+		dy := &c.Deploys[i]
+		dy.env = c.env
+		mergeCommonTarget(dy, &c.Common)
+		parseCreds(dy)
 
-var (
-	variableRe = regexp.MustCompile(`\\?\$\{\{ *([a-zA-Z]([a-zA-Z0-9-_]+[a-zA-Z0-9]|[a-zA-Z0-9]*)(:\d(:\d)?)?) *\}\}`)
-)
+		dy.Name = expandVars(dy.Name, dy.env)
+		if dy.Name == "" {
+			return nil, fmt.Errorf("deploy item #%v needs name", i+1)
+		}
 
-// expandVars replaces ${{VAR}}
-func expandVars(str string, vars map[string]string) string {
-	return variableRe.ReplaceAllStringFunc(str, func(x string) string {
-		if strings.HasPrefix(x, `\$`) {
-			return x
+		dy.Project = expandVars(dy.Project, dy.env)
+
+		dy.Region = expandVars(dy.Region, dy.env)
+		if dy.Region == "" {
+			return nil, fmt.Errorf("deploy '%v' needs region", dy.Name)
 		}
 
-		x = strings.Trim(x, "${}")
-		x = strings.TrimSpace(x)
+		dy.InstanceGroup = expandVars(dy.InstanceGroup, dy.env)
+		if dy.InstanceGroup == "" {
+			return nil, fmt.Errorf("deploy '%v' needs instance_group", dy.Name)
+		}
 
-		if !strings.Contains(x, ":") {
-			return vars[strings.ToLower(x)]
+		if err := parsePreview(dy); err != nil {
+			return nil, err
 		}
+	}
 
-		// parse ${{string:position[:length]}} and truncate string
-		parts := strings.Split(x, ":")
-		switch len(parts) {
-		default:
-			fallthrough
-		case 1:
-			return vars[strings.ToLower(parts[0])]
+	return c, nil
+}
 
-		case 2:
-			v := vars[strings.ToLower(parts[0])]
+// mergeCommonTarget sets the project, region and preview of the deploy
+// from common, unless they are set.
+func mergeCommonTarget(dy *Deploy, common *Common) {
+	if strings.TrimSpace(dy.Project) == "" {
+		dy.Project = common.Project
+	}
+	if strings.TrimSpace(dy.Region) == "" {
+		dy.Region = common.Region
+	}
+	if strings.TrimSpace(dy.Preview.Enabled) == "" {
+		dy.Preview.Enabled = common.Preview.Enabled
+	}
+	if strings.TrimSpace(dy.Preview.PullRequest) == "" {
+		dy.Preview.PullRequest = common.Preview.PullRequest
+	}
+	if strings.TrimSpace(dy.Preview.TargetSize) == "" {
+		dy.Preview.TargetSize = common.Preview.TargetSize
+	}
+}
 
-			from, err := strconv.Atoi(parts[1])
+// parseDeleteInstanceTemplatesAfter sets delete_instance_templates_after,
+// which defaults to 14 days.
+func parseDeleteInstanceTemplatesAfter(c *Config) error {
+	// if DeleteInstanceTemplatesAfter is not set to false
+	if c.DeleteInstanceTemplatesAfter != "false" {
+		// parse and set duration if set
+		if c.DeleteInstanceTemplatesAfter != "" {
+			duration, err := time.ParseDuration(c.DeleteInstanceTemplatesAfter)
 			if err != nil {
-				return v
+				return err
 			}
-			return v[from:]
+			c.deleteInstanceTemplatesAfter = duration
+		} else {
+			// or set default
+			c.deleteInstanceTemplatesAfter = 24 * time.Hour * 14 // 14 days
+		}
+	}
+	return nil
+}
 
-		case 3:
-			v := vars[strings.ToLower(parts[0])]
+// parseCreds expands creds, which are either a path or JSON, and masks
+// them in logs.
+func parseCreds(dy *Deploy) {
+	dy.GoogleApplicationCredentials = expandVars(dy.GoogleApplicationCredentials, dy.env)
 
-			from, err := strconv.Atoi(parts[1])
-			if err != nil {
-				return v
-			}
+	f, err := ioutil.ReadFile(dy.GoogleApplicationCredentials)
+	if err == nil {
+		dy.googleApplicationCredentialsData = string(f)
+	} else {
+		dy.googleApplicationCredentialsData = dy.GoogleApplicationCredentials
+	}
+	maskCredentials(dy.googleApplicationCredentialsData)
+}
 
-			to, err := strconv.Atoi(parts[2])
-			if err != nil {
-				return v
-			}
-			return v[from : from+to]
+// parsePreview parses the preview of a deploy. Call after instance_group
+// is expanded.
+func parsePreview(dy *Deploy) error {
+	dy.Preview.Enabled = expandVars(dy.Preview.Enabled, dy.env)
+	dy.Preview.PullRequest = expandVars(dy.Preview.PullRequest, dy.env)
+	dy.Preview.TargetSize = expandVars(dy.Preview.TargetSize, dy.env)
+
+	if strings.TrimSpace(dy.Preview.Enabled) != "" {
+		enabled, err := strconv.ParseBool(strings.TrimSpace(dy.Preview.Enabled))
+		if err != nil {
+			return fmt.Errorf("preview.enabled: %v", err)
 		}
-	})
+		dy.Preview.enabled = enabled
+	}
+
+	if strings.TrimSpace(dy.Preview.PullRequest) != "" {
+		pullRequest, err := strconv.Atoi(strings.TrimSpace(dy.Preview.PullRequest))
+		if err != nil {
+			return fmt.Errorf("preview.pull_request: %v", err)
+		}
+		dy.Preview.pullRequest = pullRequest
+	} else {
+		dy.Preview.pullRequest = pullRequestFromRef(dy.env.Get("github_ref"))
+	}
+
+	if strings.TrimSpace(dy.Preview.TargetSize) != "" {
+		targetSize, err := strconv.Atoi(strings.TrimSpace(dy.Preview.TargetSize))
+		if err != nil {
+			return fmt.Errorf("preview.target_size: %v", err)
+		}
+		dy.Preview.targetSize = targetSize
+	} else {
+		dy.Preview.targetSize = 1 // set default
+	}
+
+	// preview deploys get their own instance group per pull request,
+	// the label is used to find their instance templates on teardown
+	dy.Preview.instanceGroupBase = dy.InstanceGroup
+	if dy.Preview.enabled && dy.Preview.pullRequest > 0 {
+		dy.InstanceGroup = previewInstanceGroupName(dy.InstanceGroup, dy.Preview.pullRequest)
+		if dy.Labels == nil {
+			dy.Labels = make(map[string]string)
+		}
+		dy.Labels[previewLabel] = dy.InstanceGroup
+	}
+
+	return nil
+}
+
+// parseStrictVars sets strict_vars, which defaults to true for version 2
+// configs.
+func parseStrictVars(c *Config) error {
+	c.Version = strings.TrimSpace(c.Version)
+	switch c.Version {
+	case "", "1":
+		c.strictVars = false // set default
+	case "2":
+		c.strictVars = true // set default
+	default:
+		return fmt.Errorf("version: must be 1 or 2")
+	}
+
+	c.StrictVars = strings.TrimSpace(c.StrictVars)
+	if c.StrictVars != "" {
+		strictVars, err := strconv.ParseBool(c.StrictVars)
+		if err != nil {
+			return fmt.Errorf("strict_vars: %v", err)
+		}
+		c.strictVars = strictVars
+	}
+
+	return nil
+}
+
+// parseCloudInitMerge sets cloud_init_merge, which defaults to true for
+// version 2 and false otherwise. Call after parseStrictVars.
+func parseCloudInitMerge(c *Config) error {
+	c.cloudInitMerge = c.Version == "2" // set default
+
+	c.CloudInitMerge = strings.TrimSpace(c.CloudInitMerge)
+	if c.CloudInitMerge != "" {
+		cloudInitMerge, err := strconv.ParseBool(c.CloudInitMerge)
+		if err != nil {
+			return fmt.Errorf("cloud_init_merge: %v", err)
+		}
+		c.cloudInitMerge = cloudInitMerge
+	}
+
+	return nil
+}
+
+// GCE metadata limits
+// https://cloud.google.com/compute/docs/metadata/setting-custom-metadata#limitations
+const (
+	metadataValueLimit = 256 * 1024
+	metadataTotalLimit = 512 * 1024
+)
+
+// metadataBudget returns the remaining metadata budget of the deploy,
+// not accounting for metadata of the base instance template.
+func metadataBudget(dy *Deploy) int {
+	n := len(dy.cloudInit)
+	if dy.filesURL == "" {
+		n += len(dy.filesArchive)
+	}
+	for k, v := range dy.Metadata {
+		n += len(k) + len(v)
+	}
+	if !dy.uploadScripts {
+		n += len(dy.startupScript) + len(dy.shutdownScript) + len(dy.specializeScript)
+	}
+	return metadataTotalLimit - n
+}
+
+type compressedScript struct {
+	Key    string
+	Before int
+	After  int
+}
+
+// parseCompress gzips and base64 encodes the rendered scripts. Shell
+// scripts are wrapped in a bootstrap script that decodes and runs them,
+// cloud-init decodes gzip and base64 encoded user-data itself.
+func parseCompress(dy *Deploy) error {
+	dy.Compress = strings.TrimSpace(expandVars(dy.Compress, dy.env))
+	if dy.Compress == "" {
+		return nil
+	}
+
+	compress, err := strconv.ParseBool(dy.Compress)
+	if err != nil {
+		return fmt.Errorf("compress: %v", err)
+	}
+	dy.compress = compress
+	if !dy.compress {
+		return nil
+	}
+	if isWindows(dy) {
+		return fmt.Errorf("compress: is not supported on windows")
+	}
+
+	if hasStartupScript(dy) {
+		before := len(dy.startupScript)
+		if dy.startupScript, err = compressScript(dy.startupScript); err != nil {
+			return fmt.Errorf("startup_script: %v", err)
+		}
+		dy.compressed = append(dy.compressed, compressedScript{"startup-script", before, len(dy.startupScript)})
+	}
+
+	if dy.ShutdownScriptPath != "" {
+		before := len(dy.shutdownScript)
+		if dy.shutdownScript, err = compressScript(dy.shutdownScript); err != nil {
+			return fmt.Errorf("shutdown_script: %v", err)
+		}
+		dy.compressed = append(dy.compressed, compressedScript{"shutdown-script", before, len(dy.shutdownScript)})
+	}
+
+	if hasCloudInit(dy) {
+		before := len(dy.cloudInit)
+		if dy.cloudInit, err = gzipBase64(dy.cloudInit, 0); err != nil {
+			return fmt.Errorf("cloud_init: %v", err)
+		}
+		dy.compressed = append(dy.compressed, compressedScript{"user-data", before, len(dy.cloudInit)})
+	}
+
+	return nil
+}
+
+// compressScript returns a self-extracting shell script. The script is run
+// with the interpreter of its shebang, so that it works on a noexec /tmp.
+// Scripts without shebang are run with bash, like the guest agent does.
+func compressScript(script string) (string, error) {
+	payload, err := gzipBase64(script, 76)
+	if err != nil {
+		return "", err
+	}
+
+	interpreter := "/bin/bash"
+	if strings.HasPrefix(script, "#!") {
+		interpreter = strings.TrimSpace(strings.SplitN(script[2:], "\n", 2)[0])
+	}
+
+	return "#!/bin/sh\n" +
+		"# compressed by gce-deploy-action\n" +
+		"set -e\n" +
+		"f=$(mktemp)\n" +
+		"trap 'rm -f \"$f\"' EXIT\n" +
+		"base64 -d <<'GCE_DEPLOY_ACTION_EOF' | gunzip > \"$f\"\n" +
+		payload + "\n" +
+		"GCE_DEPLOY_ACTION_EOF\n" +
+		interpreter + " \"$f\" \"$@\"\n", nil
+}
+
+// gzipBase64 compresses s and base64 encodes it, wrapping lines after
+// width characters, if width > 0.
+func gzipBase64(s string, width int) (string, error) {
+	var buf bytes.Buffer
+	zw, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	if err != nil {
+		return "", err
+	}
+	if _, err := zw.Write([]byte(s)); err != nil {
+		return "", err
+	}
+	if err := zw.Close(); err != nil {
+		return "", err
+	}
+
+	encoded := base64.StdEncoding.EncodeToString(buf.Bytes())
+	if width <= 0 {
+		return encoded, nil
+	}
+
+	lines := make([]string, 0, len(encoded)/width+1)
+	for len(encoded) > width {
+		lines = append(lines, encoded[:width])
+		encoded = encoded[width:]
+	}
+	lines = append(lines, encoded)
+	return strings.Join(lines, "\n"), nil
+}
+
+// parseUploadTo measures the rendered scripts and decides if they are
+// uploaded to Cloud Storage instead of being set as metadata values.
+func parseUploadTo(dy *Deploy) error {
+	dy.UploadTo = strings.TrimSpace(expandVars(dy.UploadTo, dy.env))
+	if dy.UploadTo != "" {
+		if _, _, err := parseGCSURL(dy.UploadTo); err != nil {
+			return fmt.Errorf("upload_to: %v", err)
+		}
+	}
+
+	scriptsSize := len(dy.startupScript) + len(dy.shutdownScript) + len(dy.specializeScript)
+	otherSize := len(dy.cloudInit)
+	if dy.filesURL == "" {
+		otherSize += len(dy.filesArchive)
+	}
+	for k, v := range dy.Metadata {
+		otherSize += len(k) + len(v)
+	}
+
+	tooLarge := len(dy.startupScript) > metadataValueLimit ||
+		len(dy.shutdownScript) > metadataValueLimit ||
+		len(dy.specializeScript) > metadataValueLimit ||
+		scriptsSize+otherSize > metadataTotalLimit
+
+	dy.uploadScripts = (dy.UploadTo != "" || tooLarge) && scriptsSize > 0
+
+	if dy.uploadScripts && dy.UploadTo == "" {
+		return fmt.Errorf("scripts are %v in total and exceed the metadata limits of %v per key and %v in total, set upload_to",
+			formatBytes(scriptsSize), formatBytes(metadataValueLimit), formatBytes(metadataTotalLimit))
+	}
+
+	if len(dy.cloudInit) > metadataValueLimit {
+		return fmt.Errorf("cloud_init: %v exceeds the metadata limit of %v per key", formatBytes(len(dy.cloudInit)), formatBytes(metadataValueLimit))
+	}
+
+	if budget := metadataBudget(dy); budget < 0 {
+		return fmt.Errorf("metadata: %v exceeds the metadata limit of %v in total", formatBytes(metadataTotalLimit-budget), formatBytes(metadataTotalLimit))
+	}
+
+	return nil
+}
+
+func parseInstanceGroupSpec(spec *InstanceGroupSpec, env *Env) error {
+	spec.TargetSize = strings.TrimSpace(expandVars(spec.TargetSize, env))
+	if spec.TargetSize != "" {
+		targetSize, err := strconv.Atoi(spec.TargetSize)
+		if err != nil {
+			return fmt.Errorf("target_size: %v", err)
+		}
+		spec.targetSize = targetSize
+	} else {
+		spec.targetSize = 1 // set default
+	}
+
+	for i := range spec.Zones {
+		spec.Zones[i] = strings.TrimSpace(expandVars(spec.Zones[i], env))
+	}
+
+	spec.namedPorts = make(map[string]int64)
+	for k, v := range spec.NamedPorts {
+		spec.NamedPorts[k] = strings.TrimSpace(expandVars(v, env))
+		port, err := strconv.ParseInt(spec.NamedPorts[k], 10, 64)
+		if err != nil || port < 1 || port > 65535 {
+			return fmt.Errorf("named_ports.%v: invalid port '%v'", k, spec.NamedPorts[k])
+		}
+		spec.namedPorts[k] = port
+	}
+
+	spec.Autohealing.HealthCheck = strings.TrimSpace(expandVars(spec.Autohealing.HealthCheck, env))
+	spec.Autohealing.InitialDelaySec = strings.TrimSpace(expandVars(spec.Autohealing.InitialDelaySec, env))
+	if spec.Autohealing.InitialDelaySec != "" {
+		if spec.Autohealing.HealthCheck == "" {
+			return fmt.Errorf("autohealing.initial_delay_sec: needs autohealing.health_check")
+		}
+		initialDelaySec, err := strconv.Atoi(spec.Autohealing.InitialDelaySec)
+		if err != nil {
+			return fmt.Errorf("autohealing.initial_delay_sec: %v", err)
+		}
+		spec.Autohealing.initialDelaySec = initialDelaySec
+	} else {
+		spec.Autohealing.initialDelaySec = 300 // set default
+	}
+
+	return nil
+}
+
+func parseInstanceTemplateSpec(spec *InstanceTemplateSpec, env *Env) error {
+	spec.MachineType = strings.TrimSpace(expandVars(spec.MachineType, env))
+	if spec.MachineType == "" {
+		return fmt.Errorf("machine_type: required")
+	}
+	if !machineTypeRe.MatchString(spec.MachineType) {
+		return fmt.Errorf("machine_type: must be a machine type, i.e. e2-medium")
+	}
+
+	if err := parseBootDisk(&spec.BootDisk, env); err != nil {
+		return fmt.Errorf("boot_disk.%v", err)
+	}
+
+	if len(spec.NetworkInterfaces) == 0 {
+		spec.NetworkInterfaces = []NetworkInterface{{Network: "default"}}
+	}
+	for i := range spec.NetworkInterfaces {
+		if err := parseNetworkInterface(&spec.NetworkInterfaces[i], env); err != nil {
+			return fmt.Errorf("network_interfaces[%v].%v", i, err)
+		}
+	}
+
+	if spec.ServiceAccount != nil {
+		if err := parseServiceAccount(spec.ServiceAccount, env); err != nil {
+			return fmt.Errorf("service_account.%v", err)
+		}
+	}
+
+	if spec.Scheduling != nil {
+		if err := parseScheduling(spec.Scheduling, env); err != nil {
+			return fmt.Errorf("scheduling.%v", err)
+		}
+	}
+
+	for k, v := range spec.Labels {
+		spec.Labels[k] = expandVars(v, env)
+	}
+
+	for k, v := range spec.Metadata {
+		spec.Metadata[k] = expandVars(v, env)
+	}
+
+	return nil
+}
+
+var (
+	// i.e. e2-medium, n2-custom-4-5120-ext
+	machineTypeRe = regexp.MustCompile(`^[a-z]([a-z0-9-]*[a-z0-9])?$`)
+
+	// i.e. Intel Skylake, AMD Milan or Automatic
+	minCpuPlatformRe = regexp.MustCompile(`^((Intel|AMD|Ampere)( [A-Z][a-z]+)+|Automatic)$`)
+)
+
+// parseInstanceTemplateOverrides parses the deploy fields which override
+// the properties of the base instance template.
+func parseInstanceTemplateOverrides(dy *Deploy) error {
+	if strings.TrimSpace(dy.MachineType) != "" {
+		dy.MachineType = strings.TrimSpace(expandVars(dy.MachineType, dy.env))
+		if !machineTypeRe.MatchString(dy.MachineType) {
+			return fmt.Errorf("machine_type: must be a machine type, i.e. e2-medium")
+		}
+	}
+
+	if strings.TrimSpace(dy.MinCpuPlatform) != "" {
+		dy.MinCpuPlatform = strings.TrimSpace(expandVars(dy.MinCpuPlatform, dy.env))
+		if !minCpuPlatformRe.MatchString(dy.MinCpuPlatform) {
+			return fmt.Errorf("min_cpu_platform: must be a CPU platform, i.e. Intel Skylake")
+		}
+	}
+
+	if dy.BootDisk != nil {
+		if err := parseBootDisk(dy.BootDisk, dy.env); err != nil {
+			return fmt.Errorf("boot_disk.%v", err)
+		}
+		if dy.BootDisk.Image != "" {
+			return fmt.Errorf("boot_disk.image: use image instead")
+		}
+	}
+
+	for i := range dy.GuestAccelerators {
+		if err := parseGuestAccelerator(&dy.GuestAccelerators[i], dy.env); err != nil {
+			return fmt.Errorf("guest_accelerators[%v].%v", i, err)
+		}
+	}
+
+	dy.ConfidentialCompute = strings.TrimSpace(expandVars(dy.ConfidentialCompute, dy.env))
+	if dy.ConfidentialCompute != "" {
+		confidentialCompute, err := strconv.ParseBool(dy.ConfidentialCompute)
+		if err != nil {
+			return fmt.Errorf("confidential_compute: %v", err)
+		}
+		dy.confidentialCompute = confidentialCompute
+	}
+	if dy.confidentialCompute {
+		machineType := path.Base(dy.MachineType)
+		if dy.MachineType != "" && !strings.HasPrefix(machineType, "n2d-") && !strings.HasPrefix(machineType, "c2d-") {
+			return fmt.Errorf("confidential_compute: requires a N2D or C2D machine_type")
+		}
+	}
+
+	if dy.Scheduling != nil {
+		onHostMaintenance := strings.TrimSpace(dy.Scheduling.OnHostMaintenance)
+		if err := parseScheduling(dy.Scheduling, dy.env); err != nil {
+			return fmt.Errorf("scheduling.%v", err)
+		}
+		if len(dy.GuestAccelerators) > 0 {
+			if onHostMaintenance != "" && dy.Scheduling.OnHostMaintenance != "TERMINATE" {
+				return fmt.Errorf("scheduling.on_host_maintenance: instances with guest_accelerators must use TERMINATE")
+			}
+			dy.Scheduling.OnHostMaintenance = "TERMINATE"
+		}
+		if dy.confidentialCompute {
+			if onHostMaintenance != "" && dy.Scheduling.OnHostMaintenance != "TERMINATE" {
+				return fmt.Errorf("confidential_compute: requires scheduling.on_host_maintenance TERMINATE")
+			}
+			dy.Scheduling.OnHostMaintenance = "TERMINATE"
+		}
+	}
+
+	if err := parseImage(dy); err != nil {
+		return fmt.Errorf("image: %v", err)
+	}
+
+	if dy.ServiceAccount != nil {
+		if err := parseServiceAccount(dy.ServiceAccount, dy.env); err != nil {
+			return fmt.Errorf("service_account.%v", err)
+		}
+	}
+
+	if dy.ShieldedVM != nil {
+		if err := parseShieldedVM(dy.ShieldedVM, dy.env); err != nil {
+			return fmt.Errorf("shielded_vm.%v", err)
+		}
+	}
+
+	dy.DiskEncryptionKey = strings.TrimSpace(expandVars(dy.DiskEncryptionKey, dy.env))
+	if dy.DiskEncryptionKey != "" && !kmsKeyNameRe.MatchString(dy.DiskEncryptionKey) {
+		return fmt.Errorf("disk_encryption_key: must be projects/<project>/locations/<location>/keyRings/<key ring>/cryptoKeys/<key>")
+	}
+
+	dy.Network = strings.TrimSpace(expandVars(dy.Network, dy.env))
+	dy.Subnetwork = strings.TrimSpace(expandVars(dy.Subnetwork, dy.env))
+
+	dy.NetworkTier = strings.ToUpper(strings.TrimSpace(expandVars(dy.NetworkTier, dy.env)))
+	if err := validateNetworkTier(dy.NetworkTier); err != nil {
+		return err
+	}
+
+	dy.ExternalIP = strings.TrimSpace(expandVars(dy.ExternalIP, dy.env))
+	if dy.ExternalIP != "" {
+		externalIP, err := strconv.ParseBool(dy.ExternalIP)
+		if err != nil {
+			return fmt.Errorf("external_ip: %v", err)
+		}
+		dy.externalIP = externalIP
+	}
+	if dy.NetworkTier != "" && dy.ExternalIP != "" && !dy.externalIP {
+		return fmt.Errorf("network_tier: needs external_ip")
+	}
+
+	for i := range dy.AliasIPRanges {
+		if err := parseAliasIPRange(&dy.AliasIPRanges[i], dy.env); err != nil {
+			return fmt.Errorf("alias_ip_ranges[%v].%v", i, err)
+		}
+	}
+
+	if dy.InstanceTemplateSpec != nil && dy.InstanceTemplateSpec.BootDisk.Image == "" && dy.Image == "" {
+		return fmt.Errorf("instance_template_spec.boot_disk.image: required")
+	}
+
+	return nil
+}
+
+// parseImage parses an image, `family:[project/]family` or the path to
+// a Packer manifest.
+func parseImage(dy *Deploy) error {
+	dy.Image = strings.TrimSpace(expandVars(dy.Image, dy.env))
+
+	switch {
+	case dy.Image == "":
+		return nil
+
+	case strings.HasPrefix(dy.Image, "family:"):
+		family := strings.TrimPrefix(dy.Image, "family:")
+		if strings.Contains(family, "/") {
+			x := strings.SplitN(family, "/", 2)
+			dy.imageFamilyProject, dy.imageFamily = x[0], x[1]
+		} else {
+			dy.imageFamily = family
+		}
+		if dy.imageFamily == "" {
+			return fmt.Errorf("missing family in '%v'", dy.Image)
+		}
+
+	case strings.HasSuffix(dy.Image, ".json"):
+		f, err := ioutil.ReadFile(dy.Image)
+		if err != nil {
+			return err
+		}
+		image, err := imageFromPackerManifest(f)
+		if err != nil {
+			return fmt.Errorf("%v: %v", dy.Image, err)
+		}
+		dy.image = image
+
+	default:
+		dy.image = dy.Image
+	}
+
+	return nil
+}
+
+type packerManifest struct {
+	Builds []struct {
+		ArtifactID    string `json:"artifact_id"`
+		PackerRunUUID string `json:"packer_run_uuid"`
+	} `json:"builds"`
+	LastRunUUID string `json:"last_run_uuid"`
+}
+
+// imageFromPackerManifest returns the artifact id of the last build
+// of the last run from a Packer manifest.
+func imageFromPackerManifest(data []byte) (string, error) {
+	m := &packerManifest{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return "", err
+	}
+
+	for i := len(m.Builds) - 1; i >= 0; i-- {
+		b := m.Builds[i]
+		if b.ArtifactID != "" && (m.LastRunUUID == "" || b.PackerRunUUID == m.LastRunUUID) {
+			return b.ArtifactID, nil
+		}
+	}
+
+	return "", fmt.Errorf("no artifact found in packer manifest")
+}
+
+func parseGuestAccelerator(g *GuestAccelerator, env *Env) error {
+	g.Type = strings.TrimSpace(expandVars(g.Type, env))
+	if g.Type == "" {
+		return fmt.Errorf("type: required")
+	}
+
+	g.Count = strings.TrimSpace(expandVars(g.Count, env))
+	if g.Count != "" {
+		count, err := strconv.ParseInt(g.Count, 10, 64)
+		if err != nil || count < 1 {
+			return fmt.Errorf("count: invalid count '%v'", g.Count)
+		}
+		g.count = count
+	} else {
+		g.count = 1 // set default
+	}
+
+	return nil
+}
+
+func parseBootDisk(d *BootDisk, env *Env) error {
+	d.Image = strings.TrimSpace(expandVars(d.Image, env))
+	d.Type = strings.TrimSpace(expandVars(d.Type, env))
+
+	d.SizeGb = strings.TrimSpace(expandVars(d.SizeGb, env))
+	if d.SizeGb != "" {
+		sizeGb, err := strconv.ParseInt(d.SizeGb, 10, 64)
+		if err != nil || sizeGb < 1 {
+			return fmt.Errorf("size_gb: invalid size '%v'", d.SizeGb)
+		}
+		d.sizeGb = sizeGb
+	}
+
+	return nil
+}
+
+func parseNetworkInterface(n *NetworkInterface, env *Env) error {
+	n.Network = strings.TrimSpace(expandVars(n.Network, env))
+	n.Subnetwork = strings.TrimSpace(expandVars(n.Subnetwork, env))
+	if n.Network == "" && n.Subnetwork == "" {
+		return fmt.Errorf("network: network or subnetwork required")
+	}
+
+	n.ExternalIP = strings.TrimSpace(expandVars(n.ExternalIP, env))
+	if n.ExternalIP != "" {
+		externalIP, err := strconv.ParseBool(n.ExternalIP)
+		if err != nil {
+			return fmt.Errorf("external_ip: %v", err)
+		}
+		n.externalIP = externalIP
+	} else {
+		n.externalIP = true // set default
+	}
+
+	n.NetworkTier = strings.ToUpper(strings.TrimSpace(expandVars(n.NetworkTier, env)))
+	if err := validateNetworkTier(n.NetworkTier); err != nil {
+		return err
+	}
+	if n.NetworkTier != "" && !n.externalIP {
+		return fmt.Errorf("network_tier: needs external_ip")
+	}
+
+	for i := range n.AliasIPRanges {
+		if err := parseAliasIPRange(&n.AliasIPRanges[i], env); err != nil {
+			return fmt.Errorf("alias_ip_ranges[%v].%v", i, err)
+		}
+	}
+
+	return nil
+}
+
+func validateNetworkTier(tier string) error {
+	if tier != "" && tier != "PREMIUM" && tier != "STANDARD" {
+		return fmt.Errorf("network_tier: must be either PREMIUM or STANDARD")
+	}
+	return nil
+}
+
+func parseAliasIPRange(r *AliasIPRange, env *Env) error {
+	r.IPCidrRange = strings.TrimSpace(expandVars(r.IPCidrRange, env))
+	if r.IPCidrRange == "" {
+		return fmt.Errorf("ip_cidr_range: required")
+	}
+	r.SubnetworkRangeName = strings.TrimSpace(expandVars(r.SubnetworkRangeName, env))
+	return nil
+}
+
+func parseServiceAccount(sa *ServiceAccount, env *Env) error {
+	sa.Email = strings.TrimSpace(expandVars(sa.Email, env))
+	if sa.Email == "" {
+		sa.Email = "default"
+	}
+
+	for i := range sa.Scopes {
+		sa.Scopes[i] = strings.TrimSpace(expandVars(sa.Scopes[i], env))
+		if !strings.Contains(sa.Scopes[i], "/") {
+			// allow short scope names, i.e. cloud-platform
+			sa.Scopes[i] = "https://www.googleapis.com/auth/" + sa.Scopes[i]
+		}
+	}
+	if len(sa.Scopes) == 0 {
+		sa.Scopes = []string{"https://www.googleapis.com/auth/cloud-platform"}
+	}
+
+	return nil
+}
+
+// parseRemovals expands and dedupes the remove_* lists. Items inherited from
+// common are dropped if they are removed, items set by the deploy itself can't
+// be removed.
+func parseRemovals(dy *Deploy) error {
+	for i := range dy.RemoveLabels {
+		dy.RemoveLabels[i] = strings.TrimSpace(expandVars(dy.RemoveLabels[i], dy.env))
+		if _, ok := dy.Labels[dy.RemoveLabels[i]]; ok {
+			if dy.ownLabels[dy.RemoveLabels[i]] {
+				return fmt.Errorf("remove_labels: '%v' is also set in labels", dy.RemoveLabels[i])
+			}
+			delete(dy.Labels, dy.RemoveLabels[i])
+		}
+	}
+	dy.RemoveLabels = dedupe(dy.RemoveLabels)
+
+	for i := range dy.RemoveMetadata {
+		dy.RemoveMetadata[i] = strings.TrimSpace(expandVars(dy.RemoveMetadata[i], dy.env))
+		if _, ok := dy.Metadata[dy.RemoveMetadata[i]]; ok {
+			if dy.ownMetadata[dy.RemoveMetadata[i]] {
+				return fmt.Errorf("remove_metadata: '%v' is also set in metadata", dy.RemoveMetadata[i])
+			}
+			delete(dy.Metadata, dy.RemoveMetadata[i])
+		}
+		if (dy.RemoveMetadata[i] == scriptMetadataKey(dy, "startup") && hasStartupScript(dy)) ||
+			(dy.RemoveMetadata[i] == scriptMetadataKey(dy, "shutdown") && dy.ShutdownScriptPath != "") ||
+			(dy.RemoveMetadata[i] == scriptMetadataKey(dy, "specialize") && dy.SpecializeScriptPath != "") ||
+			(dy.RemoveMetadata[i] == "user-data" && hasCloudInit(dy)) {
+			return fmt.Errorf("remove_metadata: '%v' is also set by a script", dy.RemoveMetadata[i])
+		}
+	}
+	dy.RemoveMetadata = dedupe(dy.RemoveMetadata)
+
+	ownTags := make(map[string]bool)
+	for _, t := range dy.ownTags {
+		ownTags[expandVars(t, dy.env)] = true
+	}
+	removeTags := make(map[string]bool)
+	for i := range dy.RemoveTags {
+		dy.RemoveTags[i] = strings.TrimSpace(expandVars(dy.RemoveTags[i], dy.env))
+		if ownTags[dy.RemoveTags[i]] {
+			return fmt.Errorf("remove_tags: '%v' is also set in tags", dy.RemoveTags[i])
+		}
+		removeTags[dy.RemoveTags[i]] = true
+	}
+	dy.RemoveTags = dedupe(dy.RemoveTags)
+
+	tags := make([]string, 0, len(dy.Tags))
+	for _, t := range dy.Tags {
+		if !removeTags[t] {
+			tags = append(tags, t)
+		}
+	}
+	dy.Tags = tags
+
+	return nil
+}
+
+func parseShieldedVM(s *ShieldedVM, env *Env) error {
+	var err error
+
+	if s.secureBoot, err = parseOptionalBool(s.SecureBoot, env); err != nil {
+		return fmt.Errorf("secure_boot: %v", err)
+	}
+	if s.vtpm, err = parseOptionalBool(s.Vtpm, env); err != nil {
+		return fmt.Errorf("vtpm: %v", err)
+	}
+	if s.integrityMonitoring, err = parseOptionalBool(s.IntegrityMonitoring, env); err != nil {
+		return fmt.Errorf("integrity_monitoring: %v", err)
+	}
+
+	if s.vtpm != nil && !*s.vtpm && s.integrityMonitoring != nil && *s.integrityMonitoring {
+		return fmt.Errorf("integrity_monitoring: requires vtpm")
+	}
+
+	return nil
+}
+
+// parseOptionalBool returns nil if s is empty.
+func parseOptionalBool(s string, env *Env) (*bool, error) {
+	s = strings.TrimSpace(expandVars(s, env))
+	if s == "" {
+		return nil, nil
+	}
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+var kmsKeyNameRe = regexp.MustCompile(`^projects/[^/]+/locations/[^/]+/keyRings/[^/]+/cryptoKeys/[^/]+(/cryptoKeyVersions/[^/]+)?$`)
+
+func parseScheduling(s *Scheduling, env *Env) error {
+	s.ProvisioningModel = strings.ToUpper(strings.TrimSpace(expandVars(s.ProvisioningModel, env)))
+	if s.ProvisioningModel != "" && s.ProvisioningModel != "STANDARD" && s.ProvisioningModel != "SPOT" {
+		return fmt.Errorf("provisioning_model: must be either STANDARD or SPOT")
+	}
+	spot := s.ProvisioningModel == "SPOT"
+
+	s.Preemptible = strings.TrimSpace(expandVars(s.Preemptible, env))
+	if s.Preemptible != "" {
+		preemptible, err := strconv.ParseBool(s.Preemptible)
+		if err != nil {
+			return fmt.Errorf("preemptible: %v", err)
+		}
+		s.preemptible = preemptible
+	}
+	if spot && s.preemptible {
+		return fmt.Errorf("preemptible: can't be used with provisioning_model SPOT")
+	}
+
+	s.AutomaticRestart = strings.TrimSpace(expandVars(s.AutomaticRestart, env))
+	if s.AutomaticRestart != "" {
+		automaticRestart, err := strconv.ParseBool(s.AutomaticRestart)
+		if err != nil {
+			return fmt.Errorf("automatic_restart: %v", err)
+		}
+		s.automaticRestart = automaticRestart
+	} else {
+		s.automaticRestart = !s.preemptible && !spot // set default
+	}
+
+	s.OnHostMaintenance = strings.ToUpper(strings.TrimSpace(expandVars(s.OnHostMaintenance, env)))
+	if s.OnHostMaintenance == "" {
+		if s.preemptible || spot {
+			s.OnHostMaintenance = "TERMINATE"
+		} else {
+			s.OnHostMaintenance = "MIGRATE"
+		}
+	}
+	if s.OnHostMaintenance != "MIGRATE" && s.OnHostMaintenance != "TERMINATE" {
+		return fmt.Errorf("on_host_maintenance: must be either MIGRATE or TERMINATE")
+	}
+
+	if s.preemptible && s.automaticRestart {
+		return fmt.Errorf("automatic_restart: preemptible instances can't restart automatically")
+	}
+	if s.preemptible && s.OnHostMaintenance != "TERMINATE" {
+		return fmt.Errorf("on_host_maintenance: preemptible instances must use TERMINATE")
+	}
+	if spot && s.automaticRestart {
+		return fmt.Errorf("automatic_restart: spot instances can't restart automatically")
+	}
+	if spot && s.OnHostMaintenance != "TERMINATE" {
+		return fmt.Errorf("on_host_maintenance: spot instances must use TERMINATE")
+	}
+
+	s.InstanceTerminationAction = strings.ToUpper(strings.TrimSpace(expandVars(s.InstanceTerminationAction, env)))
+	if s.InstanceTerminationAction != "" && s.InstanceTerminationAction != "STOP" && s.InstanceTerminationAction != "DELETE" {
+		return fmt.Errorf("instance_termination_action: must be either STOP or DELETE")
+	}
+	if s.InstanceTerminationAction != "" && !spot {
+		return fmt.Errorf("instance_termination_action: requires provisioning_model SPOT")
+	}
+
+	return nil
+}
+
+var (
+	pullRequestRefRe = regexp.MustCompile(`^refs/pull/(\d+)/`)
+)
+
+// pullRequestFromRef returns the pull request number from a ref like
+// `refs/pull/123/merge` or 0 if ref doesn't belong to a pull request.
+func pullRequestFromRef(ref string) int {
+	m := pullRequestRefRe.FindStringSubmatch(strings.TrimSpace(ref))
+	if m == nil {
+		return 0
+	}
+	n, err := strconv.Atoi(m[1])
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+// previewInstanceGroupName returns the instance group name for a pull request.
+// Names are truncated to 63 characters to stay a valid resource name.
+func previewInstanceGroupName(instanceGroup string, pullRequest int) string {
+	suffix := fmt.Sprintf("-pr-%v", pullRequest)
+	if len(instanceGroup)+len(suffix) > 63 {
+		instanceGroup = strings.TrimRight(instanceGroup[:63-len(suffix)], "-")
+	}
+	return instanceGroup + suffix
+}
+
+// Env holds the variables available in ${{VAR}} expressions. Names are
+// case-insensitive. Locals, i.e. common.vars and deploys.*.vars, override
+// the other vars.
+type Env struct {
+	vars   map[string]string
+	locals map[string]string
+	rec    *varRecorder // records expansions, if set
+
+	secrets *secretResolver
+	creds   string // creds to access secrets with
+}
+
+// varRecorder records used variables and the errors of expressions, while
+// fields of deploy.yml are expanded.
+type varRecorder struct {
+	used map[string]bool
+	errs []varError
+}
+
+// varError is the error of an expression, i.e. ${{VAR:?message}}.
+type varError struct {
+	Expr string
+	Err  error
+}
+
+// newEnv returns an Env with vars, later maps override earlier maps.
+func newEnv(vars ...map[string]string) *Env {
+	m := make(map[string]string)
+	for _, x := range vars {
+		for k, v := range x {
+			m[strings.ToLower(k)] = v
+		}
+	}
+	return &Env{vars: m}
+}
+
+// clone returns a copy of the Env. A nil Env has no variables.
+func (e *Env) clone() *Env {
+	if e == nil {
+		return &Env{}
+	}
+	x := *e
+	return &x
+}
+
+// Add returns a copy of the Env with vars added, which override existing vars.
+func (e *Env) Add(vars map[string]string) *Env {
+	x := e.clone()
+	m := make(map[string]string, len(x.vars)+len(vars))
+	for k, v := range x.vars {
+		m[k] = v
+	}
+	for k, v := range vars {
+		m[strings.ToLower(k)] = v
+	}
+	x.vars = m
+	return x
+}
+
+// With returns a copy of the Env with locals.
+func (e *Env) With(locals map[string]string) *Env {
+	x := e.clone()
+	x.locals = make(map[string]string, len(locals))
+	for k, v := range locals {
+		x.locals[strings.ToLower(k)] = v
+	}
+	return x
+}
+
+// Record returns a copy of the Env, which records expansions in r. Expansions
+// aren't recorded, if r is nil.
+func (e *Env) Record(r *varRecorder) *Env {
+	x := e.clone()
+	x.rec = r
+	return x
+}
+
+// WithSecrets returns a copy of the Env, which resolves secrets with r and
+// creds, or the github action creds, if creds is empty.
+func (e *Env) WithSecrets(r *secretResolver, creds string) *Env {
+	x := e.clone()
+	x.secrets = r
+	x.creds = creds
+	return x
+}
+
+// resolveSecret returns the value of the secret version name.
+func (e *Env) resolveSecret(name string) (string, error) {
+	if e == nil || e.secrets == nil {
+		return "", fmt.Errorf("secret '%v': secrets aren't available", name)
+	}
+	return e.secrets.Resolve(e.creds, name)
+}
+
+// Lookup returns the value of the variable name and whether it's defined.
+// A nil Env has no variables.
+func (e *Env) Lookup(name string) (string, bool) {
+	if e == nil {
+		return "", false
+	}
+	name = strings.ToLower(name)
+	if v, ok := e.locals[name]; ok {
+		return v, true
+	}
+	v, ok := e.vars[name]
+	return v, ok
+}
+
+// Get returns the value of the variable name or an empty string.
+func (e *Env) Get(name string) string {
+	v, _ := e.Lookup(name)
+	return v
+}
+
+// environVars returns ENV as map.
+func environVars() map[string]string {
+	m := make(map[string]string)
+	for _, v := range environ {
+		x := strings.SplitN(v, "=", 2)
+		m[x[0]] = x[1]
+	}
+	return m
+}
+
+const variablePattern = `\$\{\{(.*?)\}\}`
+
+var (
+	variableRe = regexp.MustCompile(`\\?` + variablePattern)
+)
+
+// expandVars replaces ${{VAR}}, see vars.go for the syntax
+func expandVars(str string, env *Env) string {
+	return variableRe.ReplaceAllStringFunc(str, func(x string) string {
+		if strings.HasPrefix(x, `\$`) {
+			return x
+		}
+		return expandVar(x, env)
+	})
+}
+
+// expandVar returns the value of a single ${{VAR}}. Invalid expressions are
+// kept as-is, undefined variables and errors are replaced with an empty
+// string. Both are recorded, if the env records, see Env.Record.
+func expandVar(x string, env *Env) string {
+	var rec *varRecorder
+	if env != nil {
+		rec = env.rec
+	}
+
+	e, err := parseVarExpr(strings.TrimSuffix(strings.TrimPrefix(x, "${{"), "}}"))
+	if err != nil {
+		if rec != nil {
+			rec.errs = append(rec.errs, varError{x, fmt.Errorf("invalid variable '%v': %v", x, err)})
+		}
+		return x
+	}
+
+	if rec != nil && e.Name != "" {
+		rec.used[strings.ToLower(e.Name)] = true
+	}
+
+	v, err := e.eval(env)
+	if err != nil && rec != nil {
+		rec.errs = append(rec.errs, varError{x, err})
+	}
+	return v
 }
 
 func downloadOrReadFile(path string) ([]byte, error) {
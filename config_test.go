@@ -1,8 +1,12 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
 	"io/ioutil"
 	"os"
+	"os/exec"
 	"strings"
 	"testing"
 	"time"
@@ -214,7 +218,7 @@ func TestExpandVars(t *testing.T) {
 		"foo": "bar",
 	}
 
-	out := expandVars(in, vars)
+	out := expandVars(in, newEnv(vars))
 	assert.Equal(t, `f fo foo $f $fo $foo ${f} ${fo} ${foo} \${{f}} \${{fo}} \${{foo}} b ba bar b ba bar abb abab abarb a\${{f}}b a\${{fo}}b a\${{foo}}b`, out)
 }
 
@@ -225,7 +229,7 @@ func TestVariableCaseInsensitive(t *testing.T) {
 		"foo": "bar",
 	}
 
-	out := expandVars(in, vars)
+	out := expandVars(in, newEnv(vars))
 	assert.Equal(t, `bar bar`, out)
 }
 
@@ -236,6 +240,906 @@ func TestVariableTruncate(t *testing.T) {
 		"foo": "abcABC123ABCabc",
 	}
 
-	out := expandVars(in, vars)
+	out := expandVars(in, newEnv(vars))
 	assert.Equal(t, `abcABC123ABCabc bcABC123ABCabc 23ABCabc 23A b`, out)
 }
+
+func TestParseConfigPreview(t *testing.T) {
+	config := `
+common:
+  preview:
+    target_size: 2
+
+deploys:
+  - name: test
+    region: w
+    instance_group: x
+    instance_template_base: y
+    instance_template: z
+    preview:
+      enabled: true
+      pull_request: 123
+  - name: test2
+    region: w
+    instance_group: x
+    instance_template_base: y
+    instance_template: z
+`
+
+	c, err := ParseConfig(strings.NewReader(config))
+	require.NoError(t, err)
+
+	assert.Equal(t, true, c.Deploys[0].Preview.enabled)
+	assert.Equal(t, 123, c.Deploys[0].Preview.pullRequest)
+	assert.Equal(t, 2, c.Deploys[0].Preview.targetSize)
+	assert.Equal(t, "x-pr-123", c.Deploys[0].InstanceGroup)
+	assert.Equal(t, "x", c.Deploys[0].Preview.instanceGroupBase)
+	assert.Equal(t, "x-pr-123", c.Deploys[0].Labels[previewLabel])
+
+	assert.Equal(t, false, c.Deploys[1].Preview.enabled)
+	assert.Equal(t, "x", c.Deploys[1].InstanceGroup)
+	assert.Len(t, c.Deploys[1].Labels, 0)
+}
+
+func TestParseMaintenanceConfig(t *testing.T) {
+	config := `
+var_files:
+  - does-not-exist.env
+var_commands:
+  fail: exit 1
+
+common:
+  project: p
+  region: w
+  startup_script: does-not-exist.sh
+  preview:
+    enabled: true
+
+deploys:
+  - name: test
+    instance_group: x
+    instance_template_base: y
+    instance_template: z
+    labels:
+      secret: ${{secret:projects/p/secrets/name}}
+    preview:
+      pull_request: 123
+  - name: test2
+    project: p2
+    instance_group: x
+    instance_template: z
+`
+
+	_, err := ParseConfig(strings.NewReader(config))
+	require.Error(t, err)
+
+	c, err := ParseMaintenanceConfig(strings.NewReader(config))
+	require.NoError(t, err)
+	assert.Equal(t, 24*time.Hour*14, c.deleteInstanceTemplatesAfter)
+	require.Len(t, c.Deploys, 2)
+
+	assert.Equal(t, "p", c.Deploys[0].Project)
+	assert.Equal(t, "w", c.Deploys[0].Region)
+	assert.Equal(t, "x-pr-123", c.Deploys[0].InstanceGroup)
+	assert.Equal(t, "x", c.Deploys[0].Preview.instanceGroupBase)
+
+	assert.Equal(t, "p2", c.Deploys[1].Project)
+	assert.Equal(t, true, c.Deploys[1].Preview.enabled)
+
+	_, err = ParseMaintenanceConfig(strings.NewReader("deploys:\n  - name: test\n    region: w\n"))
+	require.EqualError(t, err, "deploy 'test' needs instance_group")
+}
+
+func TestPullRequestFromRef(t *testing.T) {
+	assert.Equal(t, 123, pullRequestFromRef("refs/pull/123/merge"))
+	assert.Equal(t, 4, pullRequestFromRef("refs/pull/4/head"))
+	assert.Equal(t, 0, pullRequestFromRef("refs/heads/master"))
+	assert.Equal(t, 0, pullRequestFromRef(""))
+}
+
+func TestPreviewInstanceGroupName(t *testing.T) {
+	assert.Equal(t, "my-app-pr-12", previewInstanceGroupName("my-app", 12))
+	out := previewInstanceGroupName(strings.Repeat("a", 52)+"-bbbbbbb", 12345)
+	assert.Len(t, out, 63)
+	assert.Equal(t, strings.Repeat("a", 52)+"-b-pr-12345", out)
+	assert.Equal(t, strings.Repeat("a", 53)+"-pr-12345", previewInstanceGroupName(strings.Repeat("a", 53)+"-bbbbbbb", 12345))
+}
+
+func TestParseConfigTTL(t *testing.T) {
+	config := `
+common:
+  ttl: 72h
+
+deploys:
+  - name: test
+    region: w
+    instance_group: x
+    instance_template_base: y
+    instance_template: z
+`
+
+	c, err := ParseConfig(strings.NewReader(config))
+	require.NoError(t, err)
+
+	assert.Equal(t, 72*time.Hour, c.Deploys[0].ttl)
+	expires, ok := parseExpiresLabel(c.Deploys[0].Labels)
+	require.True(t, ok)
+	assert.WithinDuration(t, time.Now().Add(72*time.Hour), expires, time.Minute)
+}
+
+func TestParseConfigInstanceGroupSpec(t *testing.T) {
+	config := `
+common:
+  instance_group_spec:
+    target_size: 3
+    zones:
+      - us-central1-a
+    named_ports:
+      http: 8080
+
+deploys:
+  - name: test
+    region: w
+    instance_group: x
+    instance_template_base: y
+    instance_template: z
+    instance_group_spec:
+      zones:
+        - us-central1-b
+        - us-central1-c
+      autohealing:
+        health_check: my-health-check
+  - name: test2
+    region: w
+    instance_group: x
+    instance_template_base: y
+    instance_template: z
+`
+
+	c, err := ParseConfig(strings.NewReader(config))
+	require.NoError(t, err)
+
+	spec := c.Deploys[0].InstanceGroupSpec
+	require.NotNil(t, spec)
+	assert.Equal(t, 1, spec.targetSize)
+	assert.Equal(t, []string{"us-central1-b", "us-central1-c"}, spec.Zones)
+	assert.Len(t, spec.namedPorts, 0)
+	assert.Equal(t, "my-health-check", spec.Autohealing.HealthCheck)
+	assert.Equal(t, 300, spec.Autohealing.initialDelaySec)
+
+	spec = c.Deploys[1].InstanceGroupSpec
+	require.NotNil(t, spec)
+	assert.Equal(t, 3, spec.targetSize)
+	assert.Equal(t, []string{"us-central1-a"}, spec.Zones)
+	assert.Equal(t, map[string]int64{"http": 8080}, spec.namedPorts)
+
+	_, err = ParseConfig(strings.NewReader(`
+deploys:
+  - name: test
+    region: w
+    instance_group: x
+    instance_template_base: y
+    instance_template: z
+    instance_group_spec:
+      named_ports:
+        http: 99999
+`))
+	require.Error(t, err)
+}
+
+func TestParseConfigInstanceTemplateSpec(t *testing.T) {
+	config := `
+common:
+  instance_template_spec:
+    machine_type: e2-small
+    boot_disk:
+      image: debian-cloud/family/debian-10
+      size_gb: 20
+    service_account:
+      scopes:
+        - cloud-platform
+    scheduling:
+      preemptible: true
+
+deploys:
+  - name: test
+    region: w
+    instance_group: x
+    instance_template: z
+  - name: test2
+    region: w
+    instance_group: x
+    instance_template_base: y
+    instance_template: z
+`
+
+	c, err := ParseConfig(strings.NewReader(config))
+	require.NoError(t, err)
+
+	spec := c.Deploys[0].InstanceTemplateSpec
+	require.NotNil(t, spec)
+	assert.Equal(t, "e2-small", spec.MachineType)
+	assert.Equal(t, int64(20), spec.BootDisk.sizeGb)
+	assert.Equal(t, []NetworkInterface{{Network: "default", externalIP: true}}, spec.NetworkInterfaces)
+	assert.Equal(t, "default", spec.ServiceAccount.Email)
+	assert.Equal(t, []string{"https://www.googleapis.com/auth/cloud-platform"}, spec.ServiceAccount.Scopes)
+	assert.Equal(t, true, spec.Scheduling.preemptible)
+	assert.Equal(t, false, spec.Scheduling.automaticRestart)
+	assert.Equal(t, "TERMINATE", spec.Scheduling.OnHostMaintenance)
+
+	assert.Nil(t, c.Deploys[1].InstanceTemplateSpec)
+
+	table := []string{
+		// missing base and spec
+		`
+deploys:
+  - name: test
+    region: w
+    instance_group: x
+    instance_template: z
+`,
+		// both base and spec
+		`
+deploys:
+  - name: test
+    region: w
+    instance_group: x
+    instance_template_base: y
+    instance_template: z
+    instance_template_spec:
+      machine_type: e2-small
+      boot_disk:
+        image: debian-cloud/family/debian-10
+`,
+		// missing image
+		`
+deploys:
+  - name: test
+    region: w
+    instance_group: x
+    instance_template: z
+    instance_template_spec:
+      machine_type: e2-small
+`,
+		// preemptible with automatic restart
+		`
+deploys:
+  - name: test
+    region: w
+    instance_group: x
+    instance_template: z
+    instance_template_spec:
+      machine_type: e2-small
+      boot_disk:
+        image: debian-cloud/family/debian-10
+      scheduling:
+        preemptible: true
+        automatic_restart: true
+`,
+	}
+
+	for _, config := range table {
+		_, err := ParseConfig(strings.NewReader(config))
+		require.Error(t, err, config)
+	}
+}
+
+func TestParseConfigInstanceTemplateOverrides(t *testing.T) {
+	config := `
+common:
+  machine_type: e2-small
+  boot_disk:
+    size_gb: 20
+
+deploys:
+  - name: test
+    region: w
+    instance_group: x
+    instance_template_base: y
+    instance_template: z
+    machine_type: n1-standard-4
+    min_cpu_platform: Intel Skylake
+    guest_accelerators:
+      - type: nvidia-tesla-t4
+  - name: test2
+    region: w
+    instance_group: x
+    instance_template_base: y
+    instance_template: z
+    boot_disk:
+      type: pd-ssd
+`
+
+	c, err := ParseConfig(strings.NewReader(config))
+	require.NoError(t, err)
+
+	assert.Equal(t, "n1-standard-4", c.Deploys[0].MachineType)
+	assert.Equal(t, "Intel Skylake", c.Deploys[0].MinCpuPlatform)
+	assert.Equal(t, int64(20), c.Deploys[0].BootDisk.sizeGb)
+	require.Len(t, c.Deploys[0].GuestAccelerators, 1)
+	assert.Equal(t, "nvidia-tesla-t4", c.Deploys[0].GuestAccelerators[0].Type)
+	assert.Equal(t, int64(1), c.Deploys[0].GuestAccelerators[0].count)
+
+	assert.Equal(t, "e2-small", c.Deploys[1].MachineType)
+	assert.Equal(t, int64(0), c.Deploys[1].BootDisk.sizeGb)
+	assert.Equal(t, "pd-ssd", c.Deploys[1].BootDisk.Type)
+	assert.Len(t, c.Deploys[1].GuestAccelerators, 0)
+
+	_, err = ParseConfig(strings.NewReader(`
+deploys:
+  - name: test
+    region: w
+    instance_group: x
+    instance_template_base: y
+    instance_template: z
+    guest_accelerators:
+      - type: nvidia-tesla-t4
+        count: 0
+`))
+	require.Error(t, err)
+
+	for _, override := range []string{
+		"machine_type: ${{UNDEFINED_MACHINE_TYPE}}",
+		"machine_type: e2 medium",
+		"machine_type: zones/z/machineTypes/e2-medium",
+		"min_cpu_platform: ${{UNDEFINED_CPU_PLATFORM}}",
+		"min_cpu_platform: skylake",
+	} {
+		_, err = ParseConfig(strings.NewReader(`
+common:
+  ` + override + `
+deploys:
+  - name: test
+    region: w
+    instance_group: x
+    instance_template_base: y
+    instance_template: z
+`))
+		require.Error(t, err, override)
+	}
+}
+
+func TestParseConfigNetworkOverrides(t *testing.T) {
+	config := `
+common:
+  network: default
+  network_tier: standard
+
+deploys:
+  - name: test
+    region: w
+    instance_group: x
+    instance_template_base: y
+    instance_template: z
+    subnetwork: projects/host/regions/w/subnetworks/shared
+    external_ip: false
+    network_tier: ""
+    alias_ip_ranges:
+      - ip_cidr_range: /24
+        subnetwork_range_name: pods
+  - name: test2
+    region: w
+    instance_group: x
+    instance_template_base: y
+    instance_template: z
+`
+
+	c, err := ParseConfig(strings.NewReader(config))
+	require.Error(t, err) // network_tier without external ip
+
+	config = strings.Replace(config, "network_tier: standard", "", 1)
+	c, err = ParseConfig(strings.NewReader(config))
+	require.NoError(t, err)
+
+	assert.Equal(t, "default", c.Deploys[0].Network)
+	assert.Equal(t, "projects/host/regions/w/subnetworks/shared", c.Deploys[0].Subnetwork)
+	assert.Equal(t, "false", c.Deploys[0].ExternalIP)
+	assert.False(t, c.Deploys[0].externalIP)
+	require.Len(t, c.Deploys[0].AliasIPRanges, 1)
+	assert.Equal(t, "/24", c.Deploys[0].AliasIPRanges[0].IPCidrRange)
+	assert.Equal(t, "pods", c.Deploys[0].AliasIPRanges[0].SubnetworkRangeName)
+
+	assert.Equal(t, "default", c.Deploys[1].Network)
+	assert.Equal(t, "", c.Deploys[1].ExternalIP)
+	assert.Len(t, c.Deploys[1].AliasIPRanges, 0)
+
+	_, err = ParseConfig(strings.NewReader(`
+deploys:
+  - name: test
+    region: w
+    instance_group: x
+    instance_template_base: y
+    instance_template: z
+    network_tier: GOLD
+`))
+	require.Error(t, err)
+}
+
+func TestParseConfigScheduling(t *testing.T) {
+	config := `
+common:
+  scheduling:
+    provisioning_model: spot
+    instance_termination_action: delete
+
+deploys:
+  - name: staging
+    region: w
+    instance_group: x
+    instance_template_base: y
+    instance_template: z
+  - name: prod
+    region: w
+    instance_group: x
+    instance_template_base: y
+    instance_template: z
+    scheduling:
+      provisioning_model: STANDARD
+    guest_accelerators:
+      - type: nvidia-tesla-t4
+`
+
+	c, err := ParseConfig(strings.NewReader(config))
+	require.NoError(t, err)
+
+	assert.Equal(t, "SPOT", c.Deploys[0].Scheduling.ProvisioningModel)
+	assert.Equal(t, "DELETE", c.Deploys[0].Scheduling.InstanceTerminationAction)
+	assert.Equal(t, false, c.Deploys[0].Scheduling.automaticRestart)
+	assert.Equal(t, "TERMINATE", c.Deploys[0].Scheduling.OnHostMaintenance)
+
+	assert.Equal(t, "STANDARD", c.Deploys[1].Scheduling.ProvisioningModel)
+	assert.Equal(t, true, c.Deploys[1].Scheduling.automaticRestart)
+	assert.Equal(t, "TERMINATE", c.Deploys[1].Scheduling.OnHostMaintenance)
+
+	for _, scheduling := range []string{
+		"{provisioning_model: SPOT, preemptible: true}",
+		"{provisioning_model: SPOT, automatic_restart: true}",
+		"{provisioning_model: SPOT, on_host_maintenance: MIGRATE}",
+		"{preemptible: true, on_host_maintenance: MIGRATE}",
+		"{instance_termination_action: STOP}",
+		"{provisioning_model: SPOT, instance_termination_action: PAUSE}",
+		"{provisioning_model: RESERVED}",
+	} {
+		_, err = ParseConfig(strings.NewReader(`
+deploys:
+  - name: test
+    region: w
+    instance_group: x
+    instance_template_base: y
+    instance_template: z
+    scheduling: ` + scheduling))
+		require.Error(t, err, scheduling)
+	}
+
+	_, err = ParseConfig(strings.NewReader(`
+deploys:
+  - name: test
+    region: w
+    instance_group: x
+    instance_template_base: y
+    instance_template: z
+    scheduling:
+      on_host_maintenance: MIGRATE
+    guest_accelerators:
+      - type: nvidia-tesla-t4
+`))
+	require.Error(t, err)
+}
+
+func TestParseConfigSecurityOverrides(t *testing.T) {
+	config := `
+common:
+  service_account:
+    email: staging@p.iam.gserviceaccount.com
+  shielded_vm:
+    secure_boot: true
+
+deploys:
+  - name: staging
+    region: w
+    instance_group: x
+    instance_template_base: y
+    instance_template: z
+  - name: prod
+    region: w
+    instance_group: x
+    instance_template_base: y
+    instance_template: z
+    service_account:
+      email: prod@p.iam.gserviceaccount.com
+      scopes: [logging.write]
+    machine_type: n2d-standard-2
+    confidential_compute: true
+    scheduling:
+      automatic_restart: true
+    disk_encryption_key: projects/p/locations/global/keyRings/r/cryptoKeys/k
+`
+
+	c, err := ParseConfig(strings.NewReader(config))
+	require.NoError(t, err)
+
+	assert.Equal(t, "staging@p.iam.gserviceaccount.com", c.Deploys[0].ServiceAccount.Email)
+	assert.Equal(t, []string{"https://www.googleapis.com/auth/cloud-platform"}, c.Deploys[0].ServiceAccount.Scopes)
+	assert.Equal(t, true, *c.Deploys[0].ShieldedVM.secureBoot)
+	assert.Nil(t, c.Deploys[0].ShieldedVM.vtpm)
+	assert.False(t, c.Deploys[0].confidentialCompute)
+
+	assert.Equal(t, "prod@p.iam.gserviceaccount.com", c.Deploys[1].ServiceAccount.Email)
+	assert.Equal(t, []string{"https://www.googleapis.com/auth/logging.write"}, c.Deploys[1].ServiceAccount.Scopes)
+	assert.True(t, c.Deploys[1].confidentialCompute)
+	assert.Equal(t, "TERMINATE", c.Deploys[1].Scheduling.OnHostMaintenance)
+	assert.Equal(t, "projects/p/locations/global/keyRings/r/cryptoKeys/k", c.Deploys[1].DiskEncryptionKey)
+
+	for _, override := range []string{
+		"shielded_vm: {vtpm: false, integrity_monitoring: true}",
+		"shielded_vm: {secure_boot: maybe}",
+		"confidential_compute: true\n    machine_type: e2-small",
+		"confidential_compute: true\n    scheduling: {on_host_maintenance: MIGRATE}",
+		"disk_encryption_key: my-key",
+	} {
+		_, err = ParseConfig(strings.NewReader(`
+deploys:
+  - name: test
+    region: w
+    instance_group: x
+    instance_template_base: y
+    instance_template: z
+    ` + override))
+		require.Error(t, err, override)
+	}
+}
+
+func TestParseConfigRemovals(t *testing.T) {
+	config := `
+common:
+  tags: [http, ssh]
+  remove_tags: [legacy]
+  remove_metadata: [debug]
+
+deploys:
+  - name: test
+    region: w
+    instance_group: x
+    instance_template_base: y
+    instance_template: z
+    tags: [http, https]
+    remove_labels: [old, old]
+`
+
+	c, err := ParseConfig(strings.NewReader(config))
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"http", "https", "ssh"}, c.Deploys[0].Tags)
+	assert.Equal(t, []string{"legacy"}, c.Deploys[0].RemoveTags)
+	assert.Equal(t, []string{"old"}, c.Deploys[0].RemoveLabels)
+	assert.Equal(t, []string{"debug"}, c.Deploys[0].RemoveMetadata)
+
+	for _, override := range []string{
+		"tags: [http]\n    remove_tags: [http]",
+		"labels: {env: prod}\n    remove_labels: [env]",
+		"metadata: {debug: 'true'}\n    remove_metadata: [debug]",
+		"startup_script: startup.sh\n    remove_metadata: [startup-script]",
+	} {
+		_, err = ParseConfig(strings.NewReader(`
+deploys:
+  - name: test
+    region: w
+    instance_group: x
+    instance_template_base: y
+    instance_template: z
+    ` + override))
+		require.Error(t, err, override)
+	}
+
+	// items inherited from common can be removed
+	c, err = ParseConfig(strings.NewReader(`
+common:
+  labels: {env: prod, team: a}
+  metadata: {debug: 'true', owner: a}
+  tags: [http, ssh]
+
+deploys:
+  - name: test
+    region: w
+    instance_group: x
+    instance_template_base: y
+    instance_template: z
+    tags: [https]
+    remove_labels: [env]
+    remove_metadata: [debug]
+    remove_tags: [ssh]
+`))
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"team": "a"}, c.Deploys[0].Labels)
+	assert.Equal(t, map[string]string{"owner": "a"}, c.Deploys[0].Metadata)
+	assert.Equal(t, []string{"https", "http"}, c.Deploys[0].Tags)
+	assert.Equal(t, []string{"env"}, c.Deploys[0].RemoveLabels)
+	assert.Equal(t, []string{"debug"}, c.Deploys[0].RemoveMetadata)
+	assert.Equal(t, []string{"ssh"}, c.Deploys[0].RemoveTags)
+}
+
+func TestParseConfigStrictVars(t *testing.T) {
+	tmpFile, err := ioutil.TempFile("", "")
+	require.NoError(t, err)
+	tmpFile.WriteString("#!/bin/sh\necho ${{STRICT_VAR}}\necho ${{STRICT_UNDEFINED}}\n")
+	tmpFile.Close()
+	defer os.Remove(tmpFile.Name())
+
+	config := `
+deploys:
+  - name: test
+    region: w
+    instance_group: x
+    instance_template_base: y
+    instance_template: z-${{STRICT_ENV}}
+    startup_script: ` + tmpFile.Name() + `
+    vars:
+      strict_var: a
+`
+
+	environ = append(environ, "STRICT_ENV=1")
+
+	// version 1 isn't strict by default
+	_, err = ParseConfig(strings.NewReader(config))
+	require.NoError(t, err)
+
+	_, err = ParseConfig(strings.NewReader("version: 2\n" + config))
+	require.EqualError(t, err, tmpFile.Name()+":3: undefined variable 'STRICT_UNDEFINED'")
+
+	_, err = ParseConfig(strings.NewReader("version: 2\nstrict_vars: false\n" + config))
+	require.NoError(t, err)
+
+	_, err = ParseConfig(strings.NewReader(`strict_vars: true
+deploys:
+  - name: test
+    region: w
+    instance_group: x
+    instance_template_base: y
+    instance_template: z-${{STRICT_MISSING}}
+`))
+	require.EqualError(t, err, "deploy.yml:7: deploy 'test': undefined variable 'STRICT_MISSING'")
+
+	// required variables fail without strict_vars
+	_, err = ParseConfig(strings.NewReader(`
+deploys:
+  - name: test
+    region: w
+    instance_group: x
+    instance_template_base: y
+    instance_template: z-${{STRICT_MISSING:?set it}}
+`))
+	require.EqualError(t, err, "deploy.yml:7: deploy 'test': STRICT_MISSING: set it")
+
+	_, err = ParseConfig(strings.NewReader("version: 3\n" + config))
+	require.Error(t, err)
+
+	// vars aren't available in deploy.yml, except cloud_init_spec and container
+	_, err = ParseConfig(strings.NewReader(`version: 2
+common:
+  vars:
+    version: v1
+deploys:
+  - name: test
+    region: w
+    instance_group: x
+    instance_template_base: y
+    instance_template: app-${{VERSION}}
+    container:
+      image: app:${{VERSION}}
+    cloud_init_spec:
+      runcmd: ["echo ${{VERSION}}"]
+`))
+	require.EqualError(t, err, "deploy.yml:10: deploy 'test': undefined variable 'VERSION'")
+
+	_, err = ParseConfig(strings.NewReader(`version: 2
+common:
+  vars:
+    version: v1
+deploys:
+  - name: test
+    region: w
+    instance_group: x
+    instance_template_base: y
+    container:
+      image: app:${{VERSION}}
+    instance_template: app
+`))
+	require.NoError(t, err)
+
+	// vars are checked per deploy
+	_, err = ParseConfig(strings.NewReader(`version: 2
+common:
+  cloud_init_spec:
+    runcmd: ["echo ${{VERSION}}"]
+deploys:
+  - name: a
+    region: w
+    instance_group: x
+    instance_template_base: y
+    instance_template: app
+    vars:
+      version: v1
+  - name: b
+    region: w
+    instance_group: x
+    instance_template_base: y
+    instance_template: app
+`))
+	require.EqualError(t, err, "deploy.yml:4: deploy 'b': undefined variable 'VERSION'")
+
+	// flow-style YAML and multi-line scalars
+	_, err = ParseConfig(strings.NewReader(`version: 2
+deploys:
+  - {name: test, region: w, instance_group: x, instance_template_base: y, instance_template: app,
+     vars: {version: v1}, container: {image: "app:${{VERSION}}"}}
+  - name: test2
+    region: w
+    instance_group: x
+    instance_template_base: y
+    instance_template: app
+    vars:
+      version: v1
+    cloud_init_spec:
+      runcmd:
+        - >
+          echo
+          ${{VERSION}}
+`))
+	require.NoError(t, err)
+}
+
+func TestParseUploadTo(t *testing.T) {
+	small := strings.Repeat("x", 1024)
+	large := strings.Repeat("x", metadataValueLimit+1)
+
+	d := Deploy{StartupScriptPath: "startup.sh", startupScript: small}
+	require.NoError(t, parseUploadTo(&d))
+	require.False(t, d.uploadScripts)
+
+	d = Deploy{StartupScriptPath: "startup.sh", startupScript: small, UploadTo: "gs://bucket/prefix"}
+	require.NoError(t, parseUploadTo(&d))
+	require.True(t, d.uploadScripts)
+
+	d = Deploy{UploadTo: "gs://bucket/prefix"}
+	require.NoError(t, parseUploadTo(&d))
+	require.False(t, d.uploadScripts)
+
+	d = Deploy{StartupScriptPath: "startup.sh", startupScript: large}
+	require.Error(t, parseUploadTo(&d))
+
+	d = Deploy{StartupScriptPath: "startup.sh", startupScript: large, UploadTo: "gs://bucket"}
+	require.NoError(t, parseUploadTo(&d))
+	require.True(t, d.uploadScripts)
+
+	d = Deploy{CloudInitPath: "cloud-init.yml", cloudInit: large, UploadTo: "gs://bucket"}
+	require.Error(t, parseUploadTo(&d))
+
+	d = Deploy{StartupScriptPath: "startup.sh", startupScript: small, UploadTo: "bucket"}
+	require.Error(t, parseUploadTo(&d))
+}
+
+func TestParseCompress(t *testing.T) {
+	script := "#!/bin/sh\necho " + strings.Repeat("hello ", 1000) + "\n"
+
+	d := Deploy{Compress: "true", StartupScriptPath: "startup.sh", startupScript: script, CloudInitPath: "cloud-init.yml", cloudInit: "#cloud-config\n"}
+	require.NoError(t, parseCompress(&d))
+	require.True(t, d.compress)
+	require.True(t, strings.HasPrefix(d.startupScript, "#!/bin/sh\n# compressed by gce-deploy-action\n"))
+	require.Len(t, d.compressed, 2)
+	require.Equal(t, compressedScript{"startup-script", len(script), len(d.startupScript)}, d.compressed[0])
+	require.True(t, d.compressed[0].After < d.compressed[0].Before)
+	require.Equal(t, "user-data", d.compressed[1].Key)
+
+	// cloud-init decodes base64 and gzip itself
+	b, err := base64.StdEncoding.DecodeString(d.cloudInit)
+	require.NoError(t, err)
+	zr, err := gzip.NewReader(bytes.NewReader(b))
+	require.NoError(t, err)
+	b, err = ioutil.ReadAll(zr)
+	require.NoError(t, err)
+	require.Equal(t, "#cloud-config\n", string(b))
+
+	d = Deploy{Compress: "false", StartupScriptPath: "startup.sh", startupScript: script}
+	require.NoError(t, parseCompress(&d))
+	require.Equal(t, script, d.startupScript)
+
+	require.Error(t, parseCompress(&Deploy{Compress: "yes please"}))
+}
+
+func TestCompressScript(t *testing.T) {
+	for _, x := range []string{"sh", "bash", "base64", "gunzip"} {
+		if _, err := exec.LookPath(x); err != nil {
+			t.Skipf("%v not found", x)
+		}
+	}
+
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	run := func(script string) (string, error) {
+		wrapper, err := compressScript(script)
+		require.NoError(t, err)
+
+		f, err := ioutil.TempFile("", "startup-script")
+		require.NoError(t, err)
+		defer os.Remove(f.Name())
+		_, err = f.WriteString(wrapper)
+		require.NoError(t, err)
+		f.Close()
+
+		cmd := exec.Command("sh", f.Name(), "world")
+		cmd.Env = append(os.Environ(), "TMPDIR="+tmpDir)
+		out, err := cmd.CombinedOutput()
+		return string(out), err
+	}
+
+	for _, script := range []string{
+		"#!/bin/sh\necho \"hello $1\"\n",
+		"#!/usr/bin/env bash\necho \"hello $1\"\n",
+		"echo \"hello $1\"", // no shebang, run with bash
+	} {
+		out, err := run(script)
+		require.NoError(t, err, out)
+		require.Equal(t, "hello world\n", out)
+	}
+
+	// exit code is kept
+	_, err = run("#!/bin/sh\nexit 3\n")
+	require.Error(t, err)
+	require.Equal(t, 3, err.(*exec.ExitError).ExitCode())
+
+	// decompressed script is removed
+	files, err := ioutil.ReadDir(tmpDir)
+	require.NoError(t, err)
+	require.Empty(t, files)
+}
+
+func TestParseImage(t *testing.T) {
+	tmpFile, err := ioutil.TempFile("", "*.json")
+	require.NoError(t, err)
+	tmpFile.WriteString(`{
+  "builds": [
+    {"name": "googlecompute", "artifact_id": "my-image-1", "packer_run_uuid": "a"},
+    {"name": "googlecompute", "artifact_id": "my-image-2", "packer_run_uuid": "b"},
+    {"name": "googlecompute", "artifact_id": "my-image-3", "packer_run_uuid": "a"}
+  ],
+  "last_run_uuid": "b"
+}`)
+	tmpFile.Close()
+	defer os.Remove(tmpFile.Name())
+
+	table := []struct {
+		image               string
+		expectImage         string
+		expectFamily        string
+		expectFamilyProject string
+	}{
+		{"", "", "", ""},
+		{"my-image", "my-image", "", ""},
+		{"debian-cloud/debian-10-buster-v20201014", "debian-cloud/debian-10-buster-v20201014", "", ""},
+		{"family:my-family", "", "my-family", ""},
+		{"family:debian-cloud/debian-10", "", "debian-10", "debian-cloud"},
+		{tmpFile.Name(), "my-image-2", "", ""},
+	}
+
+	for _, test := range table {
+		d := &Deploy{Image: test.image}
+		require.NoError(t, parseImage(d), test.image)
+		assert.Equal(t, test.expectImage, d.image, test.image)
+		assert.Equal(t, test.expectFamily, d.imageFamily, test.image)
+		assert.Equal(t, test.expectFamilyProject, d.imageFamilyProject, test.image)
+	}
+
+	require.Error(t, parseImage(&Deploy{Image: "family:"}))
+	require.Error(t, parseImage(&Deploy{Image: "does-not-exist.json"}))
+}
+
+func TestImageFromPackerManifest(t *testing.T) {
+	image, err := imageFromPackerManifest([]byte(`{"builds": [{"artifact_id": "a"}, {"artifact_id": "b"}]}`))
+	require.NoError(t, err)
+	assert.Equal(t, "b", image)
+
+	_, err = imageFromPackerManifest([]byte(`{"builds": []}`))
+	require.Error(t, err)
+}
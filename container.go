@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// containerDeclarationKey is read by Container-Optimized OS to run a container.
+const containerDeclarationKey = "gce-container-declaration"
+
+func parseContainer(c *Container, env *Env) error {
+	c.Image = strings.TrimSpace(expandVars(c.Image, env))
+	if c.Image == "" {
+		return fmt.Errorf("image: required")
+	}
+
+	for i := range c.Command {
+		c.Command[i] = expandVars(c.Command[i], env)
+	}
+	for i := range c.Args {
+		c.Args[i] = expandVars(c.Args[i], env)
+	}
+	for k, v := range c.Env {
+		c.Env[k] = expandVars(v, env)
+	}
+
+	for _, k := range c.SecretEnv {
+		if _, ok := c.Env[k]; !ok {
+			return fmt.Errorf("secret_env: '%v' is not set in env", k)
+		}
+	}
+
+	for i := range c.Volumes {
+		if err := parseContainerVolume(&c.Volumes[i], env); err != nil {
+			return fmt.Errorf("volumes[%v].%v", i, err)
+		}
+	}
+
+	c.RestartPolicy = strings.TrimSpace(expandVars(c.RestartPolicy, env))
+	switch strings.ToLower(c.RestartPolicy) {
+	case "", "always":
+		c.RestartPolicy = "Always" // set default
+	case "onfailure", "on_failure", "on-failure":
+		c.RestartPolicy = "OnFailure"
+	case "never":
+		c.RestartPolicy = "Never"
+	default:
+		return fmt.Errorf("restart_policy: must be either Always, OnFailure or Never")
+	}
+
+	c.Privileged = strings.TrimSpace(expandVars(c.Privileged, env))
+	if c.Privileged != "" {
+		privileged, err := strconv.ParseBool(c.Privileged)
+		if err != nil {
+			return fmt.Errorf("privileged: %v", err)
+		}
+		c.privileged = privileged
+	}
+
+	return nil
+}
+
+func parseContainerVolume(v *ContainerVolume, env *Env) error {
+	v.HostPath = strings.TrimSpace(expandVars(v.HostPath, env))
+
+	v.Tmpfs = strings.TrimSpace(expandVars(v.Tmpfs, env))
+	if v.Tmpfs != "" {
+		tmpfs, err := strconv.ParseBool(v.Tmpfs)
+		if err != nil {
+			return fmt.Errorf("tmpfs: %v", err)
+		}
+		v.tmpfs = tmpfs
+	}
+
+	if (v.HostPath == "") == !v.tmpfs {
+		return fmt.Errorf("host_path: either host_path or tmpfs required")
+	}
+
+	v.MountPath = strings.TrimSpace(expandVars(v.MountPath, env))
+	if v.MountPath == "" {
+		return fmt.Errorf("mount_path: required")
+	}
+
+	v.ReadOnly = strings.TrimSpace(expandVars(v.ReadOnly, env))
+	if v.ReadOnly != "" {
+		readOnly, err := strconv.ParseBool(v.ReadOnly)
+		if err != nil {
+			return fmt.Errorf("read_only: %v", err)
+		}
+		v.readOnly = readOnly
+	}
+
+	return nil
+}
+
+// containerSecrets returns the env values to mask in logs.
+func containerSecrets(c *Container) []string {
+	secrets := make([]string, 0, len(c.SecretEnv))
+	for _, k := range c.SecretEnv {
+		if v := c.Env[k]; v != "" {
+			secrets = append(secrets, v)
+		}
+	}
+	return secrets
+}
+
+// container declaration format, as written by
+// `gcloud compute instance-templates create-with-container`
+type containerDeclaration struct {
+	Spec containerDeclarationSpec `yaml:"spec"`
+}
+
+type containerDeclarationSpec struct {
+	Containers    []containerDeclarationContainer `yaml:"containers"`
+	RestartPolicy string                          `yaml:"restartPolicy"`
+	Volumes       []containerDeclarationVolume    `yaml:"volumes,omitempty"`
+}
+
+type containerDeclarationContainer struct {
+	Name            string                            `yaml:"name"`
+	Image           string                            `yaml:"image"`
+	Command         []string                          `yaml:"command,omitempty"`
+	Args            []string                          `yaml:"args,omitempty"`
+	Env             []containerDeclarationEnv         `yaml:"env,omitempty"`
+	SecurityContext containerDeclarationSecurity      `yaml:"securityContext"`
+	Stdin           bool                              `yaml:"stdin"`
+	TTY             bool                              `yaml:"tty"`
+	VolumeMounts    []containerDeclarationVolumeMount `yaml:"volumeMounts,omitempty"`
+}
+
+type containerDeclarationEnv struct {
+	Name  string `yaml:"name"`
+	Value string `yaml:"value"`
+}
+
+type containerDeclarationSecurity struct {
+	Privileged bool `yaml:"privileged"`
+}
+
+type containerDeclarationVolumeMount struct {
+	Name      string `yaml:"name"`
+	MountPath string `yaml:"mountPath"`
+	ReadOnly  bool   `yaml:"readOnly"`
+}
+
+type containerDeclarationVolume struct {
+	Name     string                        `yaml:"name"`
+	HostPath *containerDeclarationHostPath `yaml:"hostPath,omitempty"`
+	EmptyDir *containerDeclarationEmptyDir `yaml:"emptyDir,omitempty"`
+}
+
+type containerDeclarationHostPath struct {
+	Path string `yaml:"path"`
+}
+
+type containerDeclarationEmptyDir struct {
+	Medium string `yaml:"medium"`
+}
+
+// newContainerDeclaration renders the gce-container-declaration metadata value.
+func newContainerDeclaration(name string, c *Container) (string, error) {
+	container := containerDeclarationContainer{
+		Name:            name,
+		Image:           c.Image,
+		Command:         c.Command,
+		Args:            c.Args,
+		SecurityContext: containerDeclarationSecurity{Privileged: c.privileged},
+	}
+
+	for _, k := range sortedKeys(c.Env) {
+		container.Env = append(container.Env, containerDeclarationEnv{Name: k, Value: c.Env[k]})
+	}
+
+	volumes := make([]containerDeclarationVolume, 0, len(c.Volumes))
+	for i, v := range c.Volumes {
+		volume := containerDeclarationVolume{}
+		if v.tmpfs {
+			volume.Name = fmt.Sprintf("tmpfs-%v", i)
+			volume.EmptyDir = &containerDeclarationEmptyDir{Medium: "Memory"}
+		} else {
+			volume.Name = fmt.Sprintf("host-path-%v", i)
+			volume.HostPath = &containerDeclarationHostPath{Path: v.HostPath}
+		}
+		volumes = append(volumes, volume)
+
+		container.VolumeMounts = append(container.VolumeMounts, containerDeclarationVolumeMount{
+			Name:      volume.Name,
+			MountPath: v.MountPath,
+			ReadOnly:  v.readOnly,
+		})
+	}
+
+	b, err := yaml.Marshal(containerDeclaration{
+		Spec: containerDeclarationSpec{
+			Containers:    []containerDeclarationContainer{container},
+			RestartPolicy: c.RestartPolicy,
+			Volumes:       volumes,
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return "# DISCLAIMER:\n" +
+		"# This container declaration format is not a public API and may change without\n" +
+		"# notice. Please use gcloud command-line tool or Google Cloud Console to run\n" +
+		"# Containers on Google Compute Engine.\n\n" + string(b), nil
+}
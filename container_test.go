@@ -0,0 +1,121 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseConfigContainer(t *testing.T) {
+	environ = []string{"GITHUB_SHA=abc123", "API_KEY=s3cr3t"}
+
+	config := `
+deploys:
+  - name: test
+    region: w
+    instance_group: x
+    instance_template_base: y
+    instance_template: z
+    vars:
+      port: 8080
+    container:
+      image: gcr.io/p/app:${{GITHUB_SHA}}
+      command: [/app]
+      args: [--port, "${{PORT}}"]
+      env:
+        API_KEY: ${{API_KEY}}
+        LOG_LEVEL: debug
+      secret_env: [API_KEY]
+      volumes:
+        - host_path: /mnt/disks/data
+          mount_path: /data
+        - tmpfs: true
+          mount_path: /tmp
+          read_only: false
+      restart_policy: on-failure
+      privileged: true
+`
+
+	c, err := ParseConfig(strings.NewReader(config))
+	require.NoError(t, err)
+
+	ct := c.Deploys[0].Container
+	assert.Equal(t, "gcr.io/p/app:abc123", ct.Image)
+	assert.Equal(t, []string{"--port", "8080"}, ct.Args)
+	assert.Equal(t, "s3cr3t", ct.Env["API_KEY"])
+	assert.Equal(t, "OnFailure", ct.RestartPolicy)
+	assert.True(t, ct.privileged)
+	assert.True(t, ct.Volumes[1].tmpfs)
+	assert.Equal(t, []string{"s3cr3t"}, containerSecrets(ct))
+
+	for _, container := range []string{
+		"{command: [/app]}",
+		"{image: app, restart_policy: sometimes}",
+		"{image: app, secret_env: [MISSING]}",
+		"{image: app, volumes: [{mount_path: /data}]}",
+		"{image: app, volumes: [{host_path: /data}]}",
+	} {
+		_, err = ParseConfig(strings.NewReader(`
+deploys:
+  - name: test
+    region: w
+    instance_group: x
+    instance_template_base: y
+    instance_template: z
+    container: ` + container))
+		require.Error(t, err, container)
+	}
+}
+
+func TestNewContainerDeclaration(t *testing.T) {
+	c := &Container{
+		Image:         "gcr.io/p/app:v1",
+		Args:          []string{"--port", "8080"},
+		Env:           map[string]string{"B": "2", "A": "1"},
+		RestartPolicy: "Always",
+		Volumes: []ContainerVolume{
+			{HostPath: "/mnt/disks/data", MountPath: "/data", readOnly: true},
+			{tmpfs: true, MountPath: "/tmp"},
+		},
+	}
+
+	decl, err := newContainerDeclaration("my-app-v1", c)
+	require.NoError(t, err)
+
+	expect := `spec:
+  containers:
+  - name: my-app-v1
+    image: gcr.io/p/app:v1
+    args:
+    - --port
+    - "8080"
+    env:
+    - name: A
+      value: "1"
+    - name: B
+      value: "2"
+    securityContext:
+      privileged: false
+    stdin: false
+    tty: false
+    volumeMounts:
+    - name: host-path-0
+      mountPath: /data
+      readOnly: true
+    - name: tmpfs-1
+      mountPath: /tmp
+      readOnly: false
+  restartPolicy: Always
+  volumes:
+  - name: host-path-0
+    hostPath:
+      path: /mnt/disks/data
+  - name: tmpfs-1
+    emptyDir:
+      medium: Memory
+`
+	require.True(t, strings.HasPrefix(decl, "# DISCLAIMER:\n"))
+	require.True(t, strings.HasSuffix(decl, "\n\n"+expect), decl)
+}
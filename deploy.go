@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"net/http"
+	"regexp"
 
 	computeBeta "google.golang.org/api/compute/v0.beta"
 	"google.golang.org/api/compute/v1"
@@ -10,30 +11,17 @@ import (
 
 func Run(githubActionConfig *GithubActionConfig, config *Config, deploy Deploy) error {
 
-	// create google client with application credentials from deploy config or
-	// github action config
-	var googleClient *http.Client
-	if deploy.googleApplicationCredentialsData != "" {
-		client, f, err := NewClientFromJSON(deploy.googleApplicationCredentialsData)
-		if err != nil {
-			Fatalf("Invalid deploys.*.creds: %v", err)
+	// mask secrets in logs
+	if deploy.Container != nil {
+		for _, secret := range containerSecrets(deploy.Container) {
+			addSecretMask(secret)
 		}
-		googleClient = client
-
-		if deploy.Project == "" {
-			deploy.Project = f.ProjectID
-		}
-
-	} else {
-		client, f, err := NewClientFromJSON(githubActionConfig.googleApplicationCredentialsData)
-		if err != nil {
-			Fatalf("Invalid github_action.creds: %v", err)
-		}
-		googleClient = client
+	}
 
-		if deploy.Project == "" {
-			deploy.Project = f.ProjectID
-		}
+	// create google client and resolve project
+	googleClient, err := NewGoogleClient(githubActionConfig, &deploy)
+	if err != nil {
+		return err
 	}
 
 	// create compute service client
@@ -48,13 +36,55 @@ func Run(githubActionConfig *GithubActionConfig, config *Config, deploy Deploy)
 		return err
 	}
 
+	// resolve image
+	deploy.sourceImage, err = ResolveImage(computeService, deploy)
+	if err != nil {
+		return err
+	}
+	if deploy.sourceImage != "" {
+		Infof("%v: Using image '%v'", deploy.Name, deploy.sourceImage)
+		LogSetOutput(outputName(deploy.Name, "image"), deploy.sourceImage)
+	}
+
+	// log compressed script sizes
+	for _, x := range deploy.compressed {
+		Infof("%v: Compressed %v from %v to %v", deploy.Name, x.Key, formatBytes(x.Before), formatBytes(x.After))
+	}
+	if deploy.compress {
+		Infof("%v: Remaining metadata budget is %v of %v", deploy.Name, formatBytes(metadataBudget(&deploy)), formatBytes(metadataTotalLimit))
+	}
+
+	// upload scripts to cloud storage
+	if deploy.uploadScripts {
+		storageClient, err := NewGoogleClient(githubActionConfig, &deploy, storageScope)
+		if err != nil {
+			return err
+		}
+		if err := UploadScripts(storageClient, &deploy); err != nil {
+			return err
+		}
+		if deploy.startupScriptURL != "" {
+			Infof("%v: Uploaded startup script to '%v'", deploy.Name, deploy.startupScriptURL)
+		}
+		if deploy.shutdownScriptURL != "" {
+			Infof("%v: Uploaded shutdown script to '%v'", deploy.Name, deploy.shutdownScriptURL)
+		}
+		if deploy.specializeScriptURL != "" {
+			Infof("%v: Uploaded specialize script to '%v'", deploy.Name, deploy.specializeScriptURL)
+		}
+	}
+
 	// clone instance template and update instance group
-	instanceTemplateURL, err := CloneInstanceTemplate(computeService, deploy)
+	instanceTemplateURL, err := CloneInstanceTemplate(googleClient, computeService, deploy)
 	if err != nil {
 		return err
 	}
 
-	Infof("%v: Created new instance template '%v/%v'", deploy.Name, deploy.Project, deploy.InstanceTemplate)
+	if overrides := describeInstanceTemplateOverrides(deploy); overrides != "" {
+		Infof("%v: Created new instance template '%v/%v' with %v", deploy.Name, deploy.Project, deploy.InstanceTemplate, overrides)
+	} else {
+		Infof("%v: Created new instance template '%v/%v'", deploy.Name, deploy.Project, deploy.InstanceTemplate)
+	}
 
 	maxSurge := fmt.Sprintf("%v", deploy.UpdatePolicy.maxSurge)
 	if deploy.UpdatePolicy.maxSurgeInPercent {
@@ -74,10 +104,81 @@ func Run(githubActionConfig *GithubActionConfig, config *Config, deploy Deploy)
 	}
 
 	if config.deleteInstanceTemplatesAfter > 0 {
-		if err := CleanupInstanceTemplates(computeService, deploy.Project, config.deleteInstanceTemplatesAfter); err != nil {
+		results, err := CleanupInstanceTemplates(computeService, deploy.Project, CleanupOptions{OlderThan: config.deleteInstanceTemplatesAfter})
+		if err != nil {
 			LogWarning(err.Error(), map[string]string{"project": deploy.Project})
 		}
+		for _, r := range results {
+			switch r.Action {
+			case CleanupDeleted:
+				Infof("Deleted old instance template '%v/%v'", r.Project, r.InstanceTemplate)
+			case CleanupFailed:
+				LogWarning(r.Err.Error(), map[string]string{"project": deploy.Project})
+			default:
+				Infof("Old instance template '%v/%v' %v", r.Project, r.InstanceTemplate, r.Action)
+			}
+		}
 	}
 
 	return nil
 }
+
+// NewGoogleClient creates a google client with application credentials from
+// deploy config or github action config. If the deploy has no project set,
+// the project from the credentials is used. Scopes default to compute.
+func NewGoogleClient(githubActionConfig *GithubActionConfig, deploy *Deploy, scopes ...string) (*http.Client, error) {
+	if deploy.googleApplicationCredentialsData != "" {
+		client, f, err := NewClientFromJSON(deploy.googleApplicationCredentialsData, scopes...)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid deploys.*.creds: %v", err)
+		}
+
+		if deploy.Project == "" {
+			deploy.Project = f.ProjectID
+		}
+		return client, nil
+	}
+
+	client, f, err := NewClientFromJSON(githubActionConfig.googleApplicationCredentialsData, scopes...)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid github_action.creds: %v", err)
+	}
+
+	if deploy.Project == "" {
+		deploy.Project = f.ProjectID
+	}
+	return client, nil
+}
+
+// NewGoogleClientsByProject creates a google client for every project
+// referenced by the deploys in config. The credentials of the first deploy
+// of a project are used. Projects are returned in order of appearance.
+func NewGoogleClientsByProject(githubActionConfig *GithubActionConfig, config *Config) ([]string, map[string]*http.Client, error) {
+	clients := make(map[string]*http.Client)
+	projects := make([]string, 0)
+
+	for _, deploy := range config.Deploys {
+		googleClient, err := NewGoogleClient(githubActionConfig, &deploy)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if _, ok := clients[deploy.Project]; ok {
+			continue
+		}
+
+		clients[deploy.Project] = googleClient
+		projects = append(projects, deploy.Project)
+	}
+
+	return projects, clients, nil
+}
+
+var (
+	outputNameRe = regexp.MustCompile(`[^a-zA-Z0-9_-]+`)
+)
+
+// outputName returns the name of an output for a deploy, i.e. `my-deploy_image`.
+func outputName(deployName, name string) string {
+	return outputNameRe.ReplaceAllString(deployName, "_") + "_" + name
+}
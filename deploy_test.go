@@ -0,0 +1,12 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOutputName(t *testing.T) {
+	assert.Equal(t, "my-deploy_image", outputName("my-deploy", "image"))
+	assert.Equal(t, "my_deploy_1_image", outputName("my deploy/1", "image"))
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+)
+
+// loadEventVars flattens the event which triggered the workflow into
+// event.* variables, i.e. event.inputs.version or event.pull_request.number.
+// The event is loaded from the JSON file at $GITHUB_EVENT_PATH.
+func loadEventVars(c *Config) error {
+	c.eventVars = make(map[string]string)
+
+	eventPath := newEnv(environVars()).Get("github_event_path")
+	if eventPath == "" {
+		return nil
+	}
+
+	b, err := ioutil.ReadFile(eventPath)
+	if err != nil {
+		return fmt.Errorf("GITHUB_EVENT_PATH: %v", err)
+	}
+
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return fmt.Errorf("GITHUB_EVENT_PATH: %v", err)
+	}
+
+	m, err := flattenVars(v, ".")
+	if err != nil {
+		return fmt.Errorf("GITHUB_EVENT_PATH: %v", err)
+	}
+	for k, v := range m {
+		c.eventVars["event."+k] = v
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadEventVars(t *testing.T) {
+	tmpFile, err := ioutil.TempFile("", "")
+	require.NoError(t, err)
+	tmpFile.WriteString(`{
+		"release": {"tag_name": "v1.2.3", "prerelease": false},
+		"inputs": {"Version": "2.0.0"},
+		"pull_request": {"number": 42, "labels": [{"name": "deploy"}]}
+	}`)
+	tmpFile.Close()
+	defer os.Remove(tmpFile.Name())
+
+	environ = append(environ, "GITHUB_EVENT_PATH="+tmpFile.Name())
+	defer func() { environ = append(environ, "GITHUB_EVENT_PATH=") }()
+
+	c := &Config{}
+	require.NoError(t, loadEventVars(c))
+	require.Equal(t, map[string]string{
+		"event.release.tag_name":           "v1.2.3",
+		"event.release.prerelease":         "false",
+		"event.inputs.Version":             "2.0.0",
+		"event.pull_request.number":        "42",
+		"event.pull_request.labels.0.name": "deploy",
+	}, c.eventVars)
+
+	config := `
+deploys:
+  - name: test
+    region: w
+    instance_group: x
+    instance_template_base: y
+    instance_template: z-${{event.release.tag_name | replace "." "-"}}-${{ event.inputs.version }}
+    labels:
+      pr: ${{event.pull_request.number}}
+      missing: ${{event.inputs.missing:-none}}
+`
+	c, err = ParseConfig(strings.NewReader(config))
+	require.NoError(t, err)
+	require.Equal(t, "z-v1-2-3-2.0.0", c.Deploys[0].InstanceTemplate)
+	require.Equal(t, map[string]string{"pr": "42", "missing": "none"}, c.Deploys[0].Labels)
+
+	tmpFile, err = os.Create(tmpFile.Name())
+	require.NoError(t, err)
+	tmpFile.WriteString("{")
+	tmpFile.Close()
+	require.Error(t, loadEventVars(c))
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// filesMetadataKey holds the files bundle, unless it's uploaded.
+const filesMetadataKey = "gce-deploy-action-files"
+
+// hasStartupScript returns true if the deploy sets a startup script,
+// either from startup_script or for extracting files.
+func hasStartupScript(dy *Deploy) bool {
+	return dy.StartupScriptPath != "" || dy.Files != nil
+}
+
+// parseFiles bundles files.dir and prepends the extraction to the startup
+// script. Must be called after the startup script was read. Returns the
+// variable errors of templates, see findVarErrors.
+func parseFiles(dy *Deploy, used map[string]bool, strict bool) ([]Annotation, error) {
+	f := dy.Files
+
+	f.Dir = strings.TrimSpace(expandVars(f.Dir, dy.env))
+	if f.Dir == "" {
+		return nil, fmt.Errorf("dir: required")
+	}
+
+	f.Dest = strings.TrimSpace(expandVars(f.Dest, dy.env))
+	if !path.IsAbs(f.Dest) {
+		return nil, fmt.Errorf("dest: must be an absolute path")
+	}
+
+	for i := range f.Templates {
+		f.Templates[i] = strings.TrimSpace(expandVars(f.Templates[i], dy.env))
+		if _, err := path.Match(f.Templates[i], ""); err != nil {
+			return nil, fmt.Errorf("templates[%v]: %v", i, err)
+		}
+	}
+
+	annotations := make([]Annotation, 0)
+	archive, err := bundleFiles(f.Dir, func(name string, b []byte) []byte {
+		if isTemplateFile(f.Templates, name) {
+			annotations = append(annotations, findVarErrors(path.Join(f.Dir, name), string(b), variableRe, dy.env.With(dy.Vars), used, strict)...)
+			return []byte(expandVars(string(b), dy.env.With(dy.Vars).Record(nil)))
+		}
+		return b
+	})
+	if err != nil {
+		return nil, fmt.Errorf("dir: %v", err)
+	}
+	dy.filesArchive = archive
+
+	var extract string
+	uploadTo := strings.TrimSpace(expandVars(dy.UploadTo, dy.env))
+	if uploadTo != "" {
+		bucket, prefix, err := parseGCSURL(uploadTo)
+		if err != nil {
+			return nil, fmt.Errorf("upload_to: %v", err)
+		}
+		name := scriptObjectName(prefix, "files", archive)
+		dy.filesURL = "gs://" + bucket + "/" + name
+		extract = extractFilesFromStorageScript(bucket, name, f.Dest)
+
+	} else {
+		if len(archive) > metadataValueLimit {
+			return nil, fmt.Errorf("dir: %v exceeds the metadata limit of %v per key, set upload_to", formatBytes(len(archive)), formatBytes(metadataValueLimit))
+		}
+		extract = extractFilesFromMetadataScript(f.Dest)
+	}
+
+	dy.startupScript = prependToScript(dy.startupScript, extract)
+	return annotations, nil
+}
+
+// isTemplateFile returns true if name or its base name matches a pattern.
+func isTemplateFile(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+		if ok, _ := path.Match(p, path.Base(name)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// bundleFiles returns a base64 encoded tar.gz of dir. The archive only
+// depends on names, modes and contents of the files, so that it can be
+// content addressed. transform is called for every regular file.
+func bundleFiles(dir string, transform func(name string, b []byte) []byte) (string, error) {
+	names := make([]string, 0)
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == dir {
+			return nil
+		}
+		if !info.IsDir() && !info.Mode().IsRegular() {
+			return fmt.Errorf("'%v' is not a regular file", p)
+		}
+		names = append(names, p)
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(zw)
+
+	for _, p := range names {
+		info, err := os.Stat(p)
+		if err != nil {
+			return "", err
+		}
+
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return "", err
+		}
+		name := filepath.ToSlash(rel)
+
+		h := &tar.Header{
+			Name:    name,
+			Mode:    int64(info.Mode().Perm()),
+			ModTime: time.Unix(0, 0),
+			Format:  tar.FormatPAX,
+		}
+
+		if info.IsDir() {
+			h.Typeflag = tar.TypeDir
+			h.Name += "/"
+			if err := tw.WriteHeader(h); err != nil {
+				return "", err
+			}
+			continue
+		}
+
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			return "", err
+		}
+		b = transform(name, b)
+
+		h.Typeflag = tar.TypeReg
+		h.Size = int64(len(b))
+		if err := tw.WriteHeader(h); err != nil {
+			return "", err
+		}
+		if _, err := tw.Write(b); err != nil {
+			return "", err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return "", err
+	}
+	if err := zw.Close(); err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+func extractFilesFromMetadataScript(dest string) string {
+	return extractFilesScript(
+		"curl -sSf -H 'Metadata-Flavor: Google' -o \"$d/files\" "+
+			"'http://metadata.google.internal/computeMetadata/v1/instance/attributes/"+filesMetadataKey+"'", dest)
+}
+
+func extractFilesFromStorageScript(bucket, name, dest string) string {
+	return extractFilesScript(
+		"token=$(curl -sSf -H 'Metadata-Flavor: Google' "+
+			"'http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token?alt=text' | "+
+			"awk '$1 == \"access_token\" { print $2 }') &&\n"+
+			"  [ -n \"$token\" ] &&\n"+
+			"  curl -sSf -H \"Authorization: Bearer $token\" -o \"$d/files\" "+
+			shellQuote("https://storage.googleapis.com/storage/v1/b/"+bucket+"/o/"+strings.Replace(name, "/", "%2F", -1)+"?alt=media"), dest)
+}
+
+// extractFilesScript returns a snippet that runs download, which writes the
+// bundle to "$d/files", and extracts it to dest. The startup script exits
+// if any step fails, even without set -e.
+func extractFilesScript(download, dest string) string {
+	return "# extract files bundled by gce-deploy-action\n" +
+		"(\n" +
+		"  d=$(mktemp -d) || exit 1\n" +
+		"  trap 'rm -rf \"$d\"' EXIT\n" +
+		"  " + download + " &&\n" +
+		"  base64 -d \"$d/files\" > \"$d/files.tar.gz\" &&\n" +
+		"  mkdir -p " + shellQuote(dest) + " &&\n" +
+		"  tar -xzf \"$d/files.tar.gz\" -C " + shellQuote(dest) + "\n" +
+		") || { echo 'gce-deploy-action: failed to extract files to " + strings.Replace(dest, "'", "", -1) + "' >&2; exit 1; }\n"
+}
+
+// prependToScript inserts snippet after the shebang of script. Without
+// script, a new bash script is returned.
+func prependToScript(script, snippet string) string {
+	if script == "" {
+		return "#!/bin/bash\nset -e\n" + snippet
+	}
+
+	if strings.HasPrefix(script, "#!") {
+		i := strings.Index(script, "\n")
+		if i < 0 {
+			return script + "\n" + snippet
+		}
+		return script[:i+1] + snippet + script[i+1:]
+	}
+
+	return snippet + script
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'"'"'`, -1) + "'"
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/compute/v1"
+)
+
+func writeTestFiles(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "files")
+	require.NoError(t, err)
+
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "systemd"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "app.conf"), []byte("version=${{VERSION}}\n"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "run.sh"), []byte("echo ${{VERSION}}\n"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "systemd", "app.service"), []byte("[Unit]\n"), 0644))
+	return dir
+}
+
+func readTestArchive(t *testing.T, archive string) map[string]string {
+	b, err := base64.StdEncoding.DecodeString(archive)
+	require.NoError(t, err)
+	zr, err := gzip.NewReader(bytes.NewReader(b))
+	require.NoError(t, err)
+
+	files := make(map[string]string)
+	tr := tar.NewReader(zr)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		c, err := ioutil.ReadAll(tr)
+		require.NoError(t, err)
+		files[h.Name] = string(c)
+	}
+	return files
+}
+
+func TestBundleFiles(t *testing.T) {
+	dir := writeTestFiles(t)
+	defer os.RemoveAll(dir)
+
+	identity := func(name string, b []byte) []byte { return b }
+
+	archive, err := bundleFiles(dir, identity)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{
+		"app.conf":            "version=${{VERSION}}\n",
+		"run.sh":              "echo ${{VERSION}}\n",
+		"systemd/":            "",
+		"systemd/app.service": "[Unit]\n",
+	}, readTestArchive(t, archive))
+
+	// archive is content addressed
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(t, os.Chtimes(filepath.Join(dir, "app.conf"), time.Now(), time.Now()))
+	archive2, err := bundleFiles(dir, identity)
+	require.NoError(t, err)
+	require.Equal(t, archive, archive2)
+
+	_, err = bundleFiles(filepath.Join(dir, "missing"), identity)
+	require.Error(t, err)
+}
+
+func TestIsTemplateFile(t *testing.T) {
+	require.True(t, isTemplateFile([]string{"*.conf"}, "app.conf"))
+	require.True(t, isTemplateFile([]string{"*.service"}, "systemd/app.service"))
+	require.True(t, isTemplateFile([]string{"systemd/*"}, "systemd/app.service"))
+	require.False(t, isTemplateFile([]string{"*.conf"}, "run.sh"))
+	require.False(t, isTemplateFile(nil, "app.conf"))
+}
+
+func TestPrependToScript(t *testing.T) {
+	require.Equal(t, "#!/bin/sh\nextract\necho hi\n", prependToScript("#!/bin/sh\necho hi\n", "extract\n"))
+	require.Equal(t, "extract\necho hi\n", prependToScript("echo hi\n", "extract\n"))
+	require.Equal(t, "#!/bin/bash\nset -e\nextract\n", prependToScript("", "extract\n"))
+}
+
+func TestParseConfigFiles(t *testing.T) {
+	dir := writeTestFiles(t)
+	defer os.RemoveAll(dir)
+
+	config := `
+deploys:
+  - name: test
+    region: w
+    instance_group: x
+    instance_template_base: y
+    instance_template: z
+    vars:
+      version: v1.2.3
+    files:
+      dir: ` + dir + `
+      dest: /etc/myapp
+      templates: ["*.conf"]
+  - name: test2
+    region: w
+    instance_group: x
+    instance_template_base: y
+    instance_template: z
+    upload_to: gs://my-bucket/deploy
+    files:
+      dir: ` + dir + `
+      dest: /etc/myapp
+`
+
+	c, err := ParseConfig(strings.NewReader(config))
+	require.NoError(t, err)
+
+	d := c.Deploys[0]
+	assert.True(t, hasStartupScript(&d))
+	assert.Equal(t, "", d.filesURL)
+	assert.Equal(t, "version=v1.2.3\n", readTestArchive(t, d.filesArchive)["app.conf"])
+	assert.Equal(t, "echo ${{VERSION}}\n", readTestArchive(t, d.filesArchive)["run.sh"])
+	assert.Equal(t, prependToScript("", extractFilesFromMetadataScript("/etc/myapp")), d.startupScript)
+
+	p := &compute.InstanceProperties{}
+	mergeInstanceProperties(p, d)
+	assert.Equal(t, "tags [], labels [], metadata keys [startup-script, gce-deploy-action-files]", describeInstanceProperties(p))
+
+	d = c.Deploys[1]
+	assert.True(t, strings.HasPrefix(d.filesURL, "gs://my-bucket/deploy/files-"))
+	assert.True(t, d.uploadScripts)
+	assert.Contains(t, d.startupScript, "https://storage.googleapis.com/storage/v1/b/my-bucket/o/deploy%2Ffiles-")
+
+	_, err = ParseConfig(strings.NewReader(`
+deploys:
+  - name: test
+    region: w
+    instance_group: x
+    instance_template_base: y
+    instance_template: z
+    files:
+      dir: ` + dir + `
+      dest: etc/myapp
+`))
+	require.Error(t, err)
+}
+
+func TestParseFilesVarErrors(t *testing.T) {
+	dir := writeTestFiles(t)
+	defer os.RemoveAll(dir)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "systemd", "app.service"), []byte("[Unit]\nDescription=${{NAME}}\n"), 0644))
+
+	d := &Deploy{
+		Vars:  Vars{"version": "v1"},
+		Files: &Files{Dir: dir, Dest: "/etc/myapp", Templates: []string{"*.conf", "*.service"}},
+	}
+	used := make(map[string]bool)
+	a, err := parseFiles(d, used, true)
+	require.NoError(t, err)
+	require.Equal(t, []Annotation{
+		{File: filepath.Join(dir, "systemd", "app.service"), Line: 2, Message: "undefined variable 'NAME'"},
+	}, a)
+	require.True(t, used["version"])
+}
+
+func TestUploadScriptsWithFiles(t *testing.T) {
+	f, done := withFakeStorage(t)
+	defer done()
+
+	d := Deploy{
+		UploadTo:      "gs://my-bucket/deploy",
+		Files:         &Files{Dir: "files", Dest: "/etc/myapp"},
+		filesArchive:  "H4sI",
+		filesURL:      "gs://my-bucket/" + scriptObjectName("deploy", "files", "H4sI"),
+		startupScript: "#!/bin/bash\n",
+	}
+	require.NoError(t, UploadScripts(http.DefaultClient, &d))
+	require.Equal(t, "H4sI", f.objects["my-bucket/"+scriptObjectName("deploy", "files", "H4sI")])
+	require.NotEqual(t, "", d.startupScriptURL)
+}
+
+func TestExtractFilesScript(t *testing.T) {
+	for _, x := range []string{"sh", "awk", "base64", "tar"} {
+		if _, err := exec.LookPath(x); err != nil {
+			t.Skipf("%v not found", x)
+		}
+	}
+
+	dir := writeTestFiles(t)
+	defer os.RemoveAll(dir)
+	archive, err := bundleFiles(dir, func(name string, b []byte) []byte { return b })
+	require.NoError(t, err)
+
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(tmpDir, "archive"), []byte(archive), 0644))
+
+	// fake curl serves the token and writes the archive to -o
+	require.NoError(t, os.Mkdir(filepath.Join(tmpDir, "bin"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(tmpDir, "bin", "curl"), []byte(`#!/bin/sh
+[ -n "$FAKE_CURL_FAIL" ] && exit 22
+out=""
+while [ $# -gt 0 ]; do
+  case "$1" in
+    -o) out=$2; shift ;;
+    -H) [ "$2" = "Authorization: Bearer t0k3n" ] && auth=1; shift ;;
+    *token\?alt=text) printf 'access_token t0k3n\nexpires_in 3599\ntoken_type Bearer\n'; exit 0 ;;
+    *storage.googleapis.com*) [ -n "$auth" ] || exit 22 ;;
+  esac
+  shift
+done
+cp "$FAKE_CURL_ARCHIVE" "$out"
+`), 0755))
+
+	run := func(script string, env ...string) (string, error) {
+		cmd := exec.Command("sh", "-c", script)
+		cmd.Env = append(os.Environ(),
+			"PATH="+filepath.Join(tmpDir, "bin")+string(os.PathListSeparator)+os.Getenv("PATH"),
+			"TMPDIR="+tmpDir,
+			"FAKE_CURL_ARCHIVE="+filepath.Join(tmpDir, "archive"))
+		cmd.Env = append(cmd.Env, env...)
+		out, err := cmd.CombinedOutput()
+		return string(out), err
+	}
+
+	for _, extract := range []func(dest string) string{
+		extractFilesFromMetadataScript,
+		func(dest string) string { return extractFilesFromStorageScript("my-bucket", "deploy/files-abc", dest) },
+	} {
+		dest := filepath.Join(tmpDir, "dest")
+		os.RemoveAll(dest)
+
+		// startup script without set -e
+		script := prependToScript("#!/bin/sh\necho started\n", extract(dest))
+		out, err := run(script)
+		require.NoError(t, err, out)
+		require.Equal(t, "started\n", out)
+		b, err := ioutil.ReadFile(filepath.Join(dest, "systemd", "app.service"))
+		require.NoError(t, err)
+		require.Equal(t, "[Unit]\n", string(b))
+
+		// failed download stops the startup script
+		out, err = run(script, "FAKE_CURL_FAIL=1")
+		require.Error(t, err)
+		require.NotContains(t, out, "started")
+		require.Contains(t, out, "failed to extract files")
+	}
+
+	// temp files are removed
+	files, err := ioutil.ReadDir(tmpDir)
+	require.NoError(t, err)
+	names := make([]string, 0)
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+	require.Equal(t, []string{"archive", "bin", "dest"}, names)
+}
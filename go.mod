@@ -4,12 +4,11 @@ go 1.13
 
 require (
 	cloud.google.com/go v0.68.0 // indirect
+	filippo.io/age v1.2.1
 	github.com/hashicorp/go-retryablehttp v0.6.7
 	github.com/stretchr/testify v1.4.0
 	go.opencensus.io v0.22.5 // indirect
-	golang.org/x/net v0.0.0-20201010224723-4f7140c49acb // indirect
 	golang.org/x/oauth2 v0.0.0-20200902213428-5d25da1a8d43
-	golang.org/x/sys v0.0.0-20201009025420-dfb3f7c4e634 // indirect
 	google.golang.org/api v0.32.0
 	google.golang.org/genproto v0.0.0-20201009135657-4d944d34d83c // indirect
 	google.golang.org/grpc v1.33.0 // indirect
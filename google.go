@@ -1,9 +1,14 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
+	"path"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -17,6 +22,17 @@ import (
 
 var (
 	instanceTemplateDescription = "created by gce-deploy-action"
+	instanceGroupDescription    = "created by gce-deploy-action"
+)
+
+const (
+	// previewLabel is set on instance templates of preview deploys
+	// and has the name of the preview instance group as value
+	previewLabel = "gce-deploy-action-preview"
+
+	// expiresLabel is set on instance templates of deploys with ttl
+	// and has the unix timestamp of the expiry as value
+	expiresLabel = "gce-deploy-action-expires"
 )
 
 type ServiceAccountFile struct {
@@ -33,8 +49,17 @@ type ServiceAccountFile struct {
 	RefreshToken string `json:"refresh_token"`
 }
 
-func NewClientFromJSON(data string) (*http.Client, *ServiceAccountFile, error) {
-	conf, err := google.JWTConfigFromJSON([]byte(data), compute.ComputeScope)
+func NewClientFromJSON(data string, scopes ...string) (*http.Client, *ServiceAccountFile, error) {
+	if len(scopes) == 0 {
+		scopes = []string{compute.ComputeScope}
+	}
+
+	// don't echo data, which is either a path or credentials
+	if !strings.HasPrefix(strings.TrimSpace(data), "{") {
+		return nil, nil, fmt.Errorf("not a readable file or JSON credentials")
+	}
+
+	conf, err := google.JWTConfigFromJSON([]byte(data), scopes...)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -47,17 +72,23 @@ func NewClientFromJSON(data string) (*http.Client, *ServiceAccountFile, error) {
 	return conf.Client(oauth2.NoContext), f, nil
 }
 
-func CloneInstanceTemplate(c *compute.Service, d Deploy) (string, error) {
+func CloneInstanceTemplate(hc *http.Client, c *compute.Service, d Deploy) (string, error) {
 	s := compute.NewInstanceTemplatesService(c)
 
-	// get base instance template
-	instanceTemplateBase, err := s.Get(d.Project, d.InstanceTemplateBase).Do()
-	if err != nil {
-		return "", fmt.Errorf("get instance template base '%v/%v': %v", d.Project, d.InstanceTemplateBase, err)
+	// get base instance template or create one from spec
+	var instanceTemplate *compute.InstanceTemplate
+	if d.InstanceTemplateSpec != nil {
+		instanceTemplate = newInstanceTemplateFromSpec(d.InstanceTemplateSpec, d.Project, d.Region)
+
+	} else {
+		instanceTemplateBase, err := s.Get(d.Project, d.InstanceTemplateBase).Do()
+		if err != nil {
+			return "", fmt.Errorf("get instance template base '%v/%v': %v", d.Project, d.InstanceTemplateBase, err)
+		}
+		instanceTemplate = instanceTemplateBase
 	}
 
 	// initialize new instance template
-	instanceTemplate := instanceTemplateBase
 	instanceTemplate.Name = d.InstanceTemplate
 	instanceTemplate.Description = instanceTemplateDescription
 
@@ -65,52 +96,35 @@ func CloneInstanceTemplate(c *compute.Service, d Deploy) (string, error) {
 		instanceTemplate.Properties = &compute.InstanceProperties{}
 	}
 
-	// add new tags
-	if instanceTemplate.Properties.Tags == nil {
-		instanceTemplate.Properties.Tags = &compute.Tags{}
-		instanceTemplate.Properties.Tags.Items = make([]string, 0)
-	}
-	for _, v := range d.Tags {
-		instanceTemplate.Properties.Tags.Items = append(instanceTemplate.Properties.Tags.Items, v)
+	// override machine type, boot disk and accelerators
+	if err := applyInstanceTemplateOverrides(instanceTemplate.Properties, d); err != nil {
+		return "", err
 	}
 
-	// add new labels
-	if instanceTemplate.Properties.Labels == nil {
-		instanceTemplate.Properties.Labels = make(map[string]string)
-	}
-	for k, v := range d.Labels {
-		instanceTemplate.Properties.Labels[k] = v
-	}
+	// merge tags, labels, metadata and scripts
+	mergeInstanceProperties(instanceTemplate.Properties, d)
 
-	// add new metadata keys
-	if instanceTemplate.Properties.Metadata == nil {
-		instanceTemplate.Properties.Metadata = &compute.Metadata{}
-		instanceTemplate.Properties.Metadata.Items = make([]*compute.MetadataItems, 0)
-	}
-	for k, v := range d.Metadata {
-		instanceTemplate.Properties.Metadata.Items = append(instanceTemplate.Properties.Metadata.Items,
-			newMetadataItem(k, v))
-	}
-
-	// startup script
-	if d.StartupScriptPath != "" {
-		instanceTemplate.Properties.Metadata.Items = append(instanceTemplate.Properties.Metadata.Items,
-			newMetadataItem("startup-script", d.startupScript))
+	// container declaration for Container-Optimized OS
+	if d.Container != nil {
+		containerDeclaration, err := newContainerDeclaration(d.InstanceTemplate, d.Container)
+		if err != nil {
+			return "", fmt.Errorf("container declaration: %v", err)
+		}
+		setMetadataItem(instanceTemplate.Properties.Metadata, containerDeclarationKey, containerDeclaration)
 	}
 
-	// shutdown script
-	if d.ShutdownScriptPath != "" {
-		instanceTemplate.Properties.Metadata.Items = append(instanceTemplate.Properties.Metadata.Items,
-			newMetadataItem("shutdown-script", d.shutdownScript))
+	if n := metadataSize(instanceTemplate.Properties.Metadata); n > metadataTotalLimit {
+		return "", fmt.Errorf("metadata of instance template is %v and exceeds the limit of %v in total, set upload_to", formatBytes(n), formatBytes(metadataTotalLimit))
 	}
+	Infof("%v: New instance template has %v", d.Name, describeInstanceProperties(instanceTemplate.Properties))
 
-	// cloud init
-	if d.CloudInitPath != "" {
-		instanceTemplate.Properties.Metadata.Items = append(instanceTemplate.Properties.Metadata.Items,
-			newMetadataItem("user-data", d.cloudInit))
+	var op *compute.Operation
+	var err error
+	if extra := newExtraInstanceProperties(d); len(extra) > 0 {
+		op, err = insertInstanceTemplate(hc, c.BasePath, d.Project, instanceTemplate, extra)
+	} else {
+		op, err = s.Insert(d.Project, instanceTemplate).Do()
 	}
-
-	op, err := s.Insert(d.Project, instanceTemplate).Do()
 	if err != nil {
 		return "", fmt.Errorf("save instance template: %v", err)
 	}
@@ -135,6 +149,641 @@ func CloneInstanceTemplate(c *compute.Service, d Deploy) (string, error) {
 	}
 }
 
+// mergeInstanceProperties merges tags, labels, metadata and scripts of
+// the deploy into the instance properties. Existing labels and metadata
+// keys are replaced and tags are deduped. Removals are applied first.
+func mergeInstanceProperties(p *compute.InstanceProperties, d Deploy) {
+	if p.Tags == nil {
+		p.Tags = &compute.Tags{}
+	}
+	tags := make([]string, 0, len(p.Tags.Items)+len(d.Tags))
+	for _, v := range append(p.Tags.Items, d.Tags...) {
+		if !containsString(d.RemoveTags, v) {
+			tags = append(tags, v)
+		}
+	}
+	p.Tags.Items = dedupe(tags)
+
+	if p.Labels == nil {
+		p.Labels = make(map[string]string)
+	}
+	for _, k := range d.RemoveLabels {
+		delete(p.Labels, k)
+	}
+	for k, v := range d.Labels {
+		p.Labels[k] = v
+	}
+
+	if p.Metadata == nil {
+		p.Metadata = &compute.Metadata{}
+	}
+	for _, k := range d.RemoveMetadata {
+		deleteMetadataItem(p.Metadata, k)
+	}
+
+	for _, k := range sortedKeys(d.Metadata) {
+		setMetadataItem(p.Metadata, k, d.Metadata[k])
+	}
+
+	// startup script, either inline or uploaded
+	if d.startupScriptURL != "" {
+		deleteMetadataItem(p.Metadata, scriptMetadataKey(&d, "startup"))
+		setMetadataItem(p.Metadata, scriptURLMetadataKey(&d, "startup"), d.startupScriptURL)
+	} else if hasStartupScript(&d) {
+		deleteMetadataItem(p.Metadata, scriptURLMetadataKey(&d, "startup"))
+		setMetadataItem(p.Metadata, scriptMetadataKey(&d, "startup"), d.startupScript)
+	}
+
+	// files bundle, either inline or uploaded
+	if d.Files != nil {
+		if d.filesURL != "" {
+			deleteMetadataItem(p.Metadata, filesMetadataKey)
+		} else {
+			setMetadataItem(p.Metadata, filesMetadataKey, d.filesArchive)
+		}
+	}
+
+	// shutdown script, either inline or uploaded
+	if d.shutdownScriptURL != "" {
+		deleteMetadataItem(p.Metadata, scriptMetadataKey(&d, "shutdown"))
+		setMetadataItem(p.Metadata, scriptURLMetadataKey(&d, "shutdown"), d.shutdownScriptURL)
+	} else if d.ShutdownScriptPath != "" {
+		deleteMetadataItem(p.Metadata, scriptURLMetadataKey(&d, "shutdown"))
+		setMetadataItem(p.Metadata, scriptMetadataKey(&d, "shutdown"), d.shutdownScript)
+	}
+
+	// sysprep specialize script, either inline or uploaded
+	if d.specializeScriptURL != "" {
+		deleteMetadataItem(p.Metadata, scriptMetadataKey(&d, "specialize"))
+		setMetadataItem(p.Metadata, scriptURLMetadataKey(&d, "specialize"), d.specializeScriptURL)
+	} else if d.SpecializeScriptPath != "" {
+		deleteMetadataItem(p.Metadata, scriptURLMetadataKey(&d, "specialize"))
+		setMetadataItem(p.Metadata, scriptMetadataKey(&d, "specialize"), d.specializeScript)
+	}
+
+	// cloud init
+	if hasCloudInit(&d) {
+		setMetadataItem(p.Metadata, "user-data", d.cloudInit)
+		if d.compress {
+			setMetadataItem(p.Metadata, "user-data-encoding", "base64")
+		} else {
+			deleteMetadataItem(p.Metadata, "user-data-encoding")
+		}
+	}
+}
+
+// setMetadataItem replaces the value of an existing key or adds a new item.
+func setMetadataItem(m *compute.Metadata, key, value string) {
+	for _, item := range m.Items {
+		if item.Key == key {
+			item.Value = stringPtr(value)
+			return
+		}
+	}
+	m.Items = append(m.Items, newMetadataItem(key, value))
+}
+
+func deleteMetadataItem(m *compute.Metadata, key string) {
+	items := make([]*compute.MetadataItems, 0, len(m.Items))
+	for _, item := range m.Items {
+		if item.Key != key {
+			items = append(items, item)
+		}
+	}
+	m.Items = items
+}
+
+// metadataSize returns the total size of all metadata keys and values.
+func metadataSize(m *compute.Metadata) int {
+	n := 0
+	for _, item := range m.Items {
+		n += len(item.Key)
+		if item.Value != nil {
+			n += len(*item.Value)
+		}
+	}
+	return n
+}
+
+// describeInstanceProperties returns the final tags, labels and metadata
+// keys for logging. Metadata values are omitted, they might contain secrets.
+func describeInstanceProperties(p *compute.InstanceProperties) string {
+	labels := make([]string, 0, len(p.Labels))
+	for _, k := range sortedKeys(p.Labels) {
+		labels = append(labels, k+"="+p.Labels[k])
+	}
+
+	metadata := make([]string, 0)
+	if p.Metadata != nil {
+		for _, item := range p.Metadata.Items {
+			metadata = append(metadata, item.Key)
+		}
+	}
+
+	tags := make([]string, 0)
+	if p.Tags != nil {
+		tags = p.Tags.Items
+	}
+
+	return redactSecrets(fmt.Sprintf("tags [%v], labels [%v], metadata keys [%v]",
+		strings.Join(tags, ", "), strings.Join(labels, ", "), strings.Join(metadata, ", ")))
+}
+
+func containsString(s []string, x string) bool {
+	for _, v := range s {
+		if v == x {
+			return true
+		}
+	}
+	return false
+}
+
+// newInstanceTemplateFromSpec creates a new instance template from spec.
+func newInstanceTemplateFromSpec(spec *InstanceTemplateSpec, project, region string) *compute.InstanceTemplate {
+	p := &compute.InstanceProperties{
+		MachineType: spec.MachineType,
+		Labels:      make(map[string]string),
+		Metadata:    &compute.Metadata{Items: make([]*compute.MetadataItems, 0)},
+	}
+
+	p.Disks = []*compute.AttachedDisk{
+		{
+			Boot:       true,
+			AutoDelete: true,
+			Type:       "PERSISTENT",
+			Mode:       "READ_WRITE",
+			InitializeParams: &compute.AttachedDiskInitializeParams{
+				DiskSizeGb: spec.BootDisk.sizeGb,
+				DiskType:   spec.BootDisk.Type,
+			},
+		},
+	}
+	if spec.BootDisk.Image != "" {
+		p.Disks[0].InitializeParams.SourceImage = imageURL(project, spec.BootDisk.Image)
+	}
+
+	for _, n := range spec.NetworkInterfaces {
+		p.NetworkInterfaces = append(p.NetworkInterfaces, newNetworkInterface(n, project, region))
+	}
+
+	if spec.ServiceAccount != nil {
+		p.ServiceAccounts = []*compute.ServiceAccount{
+			{Email: spec.ServiceAccount.Email, Scopes: spec.ServiceAccount.Scopes},
+		}
+	}
+
+	if spec.Scheduling != nil {
+		p.Scheduling = newScheduling(spec.Scheduling)
+	}
+
+	for k, v := range spec.Labels {
+		p.Labels[k] = v
+	}
+
+	for _, k := range sortedKeys(spec.Metadata) {
+		p.Metadata.Items = append(p.Metadata.Items, newMetadataItem(k, spec.Metadata[k]))
+	}
+
+	return &compute.InstanceTemplate{Properties: p}
+}
+
+// applyInstanceTemplateOverrides patches instance properties with the
+// machine type, boot disk and accelerators of the deploy.
+func applyInstanceTemplateOverrides(p *compute.InstanceProperties, d Deploy) error {
+	if d.MachineType != "" {
+		p.MachineType = d.MachineType
+	}
+
+	if d.MinCpuPlatform != "" {
+		p.MinCpuPlatform = d.MinCpuPlatform
+	}
+
+	if d.BootDisk != nil {
+		bootDisk := findOrCreateBootDisk(p)
+		if d.BootDisk.sizeGb > 0 {
+			bootDisk.InitializeParams.DiskSizeGb = d.BootDisk.sizeGb
+		}
+		if d.BootDisk.Type != "" {
+			bootDisk.InitializeParams.DiskType = d.BootDisk.Type
+		}
+	}
+
+	if d.sourceImage != "" {
+		bootDisk := findOrCreateBootDisk(p)
+		bootDisk.InitializeParams.SourceImage = d.sourceImage
+	}
+
+	if d.BootDisk != nil || d.sourceImage != "" {
+		bootDisk := findOrCreateBootDisk(p)
+		if bootDisk.Source == "" && bootDisk.InitializeParams.SourceImage == "" {
+			return fmt.Errorf("boot_disk: instance template base has no boot disk image, set deploys.*.image")
+		}
+	}
+
+	applyNetworkOverrides(p, d)
+
+	if d.ServiceAccount != nil {
+		p.ServiceAccounts = []*compute.ServiceAccount{
+			{Email: d.ServiceAccount.Email, Scopes: d.ServiceAccount.Scopes},
+		}
+	}
+
+	if d.ShieldedVM != nil {
+		if p.ShieldedInstanceConfig == nil {
+			// set defaults
+			p.ShieldedInstanceConfig = &compute.ShieldedInstanceConfig{EnableVtpm: true, EnableIntegrityMonitoring: true}
+		}
+		c := p.ShieldedInstanceConfig
+		if d.ShieldedVM.secureBoot != nil {
+			c.EnableSecureBoot = *d.ShieldedVM.secureBoot
+		}
+		if d.ShieldedVM.vtpm != nil {
+			c.EnableVtpm = *d.ShieldedVM.vtpm
+		}
+		if d.ShieldedVM.integrityMonitoring != nil {
+			c.EnableIntegrityMonitoring = *d.ShieldedVM.integrityMonitoring
+		}
+		c.ForceSendFields = []string{"EnableSecureBoot", "EnableVtpm", "EnableIntegrityMonitoring"}
+	}
+
+	if d.DiskEncryptionKey != "" {
+		for _, disk := range p.Disks {
+			// only disks created with the instance
+			if disk.InitializeParams != nil {
+				disk.DiskEncryptionKey = &compute.CustomerEncryptionKey{KmsKeyName: d.DiskEncryptionKey}
+			}
+		}
+	}
+
+	if d.Scheduling != nil {
+		scheduling := newScheduling(d.Scheduling)
+		if p.Scheduling != nil {
+			scheduling.NodeAffinities = p.Scheduling.NodeAffinities
+			scheduling.MinNodeCpus = p.Scheduling.MinNodeCpus
+		}
+		p.Scheduling = scheduling
+	}
+
+	if len(d.GuestAccelerators) > 0 {
+		p.GuestAccelerators = make([]*compute.AcceleratorConfig, 0, len(d.GuestAccelerators))
+		for _, g := range d.GuestAccelerators {
+			p.GuestAccelerators = append(p.GuestAccelerators, &compute.AcceleratorConfig{
+				AcceleratorType:  g.Type,
+				AcceleratorCount: g.count,
+			})
+		}
+
+		// instances with accelerators can't live migrate
+		if p.Scheduling == nil {
+			p.Scheduling = &compute.Scheduling{}
+		}
+		p.Scheduling.OnHostMaintenance = "TERMINATE"
+	}
+
+	// confidential instances can't live migrate either
+	if d.confidentialCompute {
+		if p.Scheduling == nil {
+			p.Scheduling = &compute.Scheduling{}
+		}
+		p.Scheduling.OnHostMaintenance = "TERMINATE"
+	}
+
+	return nil
+}
+
+// describeInstanceTemplateOverrides returns a summary of the overridden
+// instance properties for logging.
+func describeInstanceTemplateOverrides(d Deploy) string {
+	x := make([]string, 0)
+
+	if d.MachineType != "" {
+		x = append(x, "MachineType:"+d.MachineType)
+	}
+	if d.MinCpuPlatform != "" {
+		x = append(x, "MinCpuPlatform:"+d.MinCpuPlatform)
+	}
+	if d.BootDisk != nil && d.BootDisk.sizeGb > 0 {
+		x = append(x, fmt.Sprintf("BootDiskSize:%vGB", d.BootDisk.sizeGb))
+	}
+	if d.BootDisk != nil && d.BootDisk.Type != "" {
+		x = append(x, "BootDiskType:"+d.BootDisk.Type)
+	}
+	for _, g := range d.GuestAccelerators {
+		x = append(x, fmt.Sprintf("GuestAccelerator:%vx%v", g.count, g.Type))
+	}
+	if d.Network != "" {
+		x = append(x, "Network:"+d.Network)
+	}
+	if d.Subnetwork != "" {
+		x = append(x, "Subnetwork:"+d.Subnetwork)
+	}
+	if d.NetworkTier != "" {
+		x = append(x, "NetworkTier:"+d.NetworkTier)
+	}
+	if d.ExternalIP != "" {
+		x = append(x, fmt.Sprintf("ExternalIP:%v", d.externalIP))
+	}
+	for _, r := range d.AliasIPRanges {
+		x = append(x, "AliasIPRange:"+r.IPCidrRange)
+	}
+	if d.ServiceAccount != nil {
+		x = append(x, "ServiceAccount:"+d.ServiceAccount.Email)
+	}
+	if d.ShieldedVM != nil {
+		x = append(x, "ShieldedVM")
+	}
+	if d.ConfidentialCompute != "" {
+		x = append(x, fmt.Sprintf("ConfidentialCompute:%v", d.confidentialCompute))
+	}
+	if d.DiskEncryptionKey != "" {
+		x = append(x, "DiskEncryptionKey:"+d.DiskEncryptionKey)
+	}
+	if d.Scheduling != nil {
+		if d.Scheduling.ProvisioningModel != "" {
+			x = append(x, "ProvisioningModel:"+d.Scheduling.ProvisioningModel)
+		}
+		if d.Scheduling.preemptible {
+			x = append(x, "Preemptible:true")
+		}
+		x = append(x, fmt.Sprintf("AutomaticRestart:%v", d.Scheduling.automaticRestart))
+		x = append(x, "OnHostMaintenance:"+d.Scheduling.OnHostMaintenance)
+		if d.Scheduling.InstanceTerminationAction != "" {
+			x = append(x, "InstanceTerminationAction:"+d.Scheduling.InstanceTerminationAction)
+		}
+	}
+
+	return strings.Join(x, ", ")
+}
+
+// findOrCreateBootDisk returns the boot disk with initialize params.
+func findOrCreateBootDisk(p *compute.InstanceProperties) *compute.AttachedDisk {
+	var bootDisk *compute.AttachedDisk
+	for _, disk := range p.Disks {
+		if disk.Boot {
+			bootDisk = disk
+			break
+		}
+	}
+
+	if bootDisk == nil {
+		bootDisk = &compute.AttachedDisk{Boot: true, AutoDelete: true, Type: "PERSISTENT", Mode: "READ_WRITE"}
+		p.Disks = append([]*compute.AttachedDisk{bootDisk}, p.Disks...)
+	}
+
+	if bootDisk.InitializeParams == nil {
+		bootDisk.InitializeParams = &compute.AttachedDiskInitializeParams{}
+	}
+
+	return bootDisk
+}
+
+// ResolveImage returns the image url for the image of the deploy.
+// Image families are resolved to the latest image of the family.
+func ResolveImage(c *compute.Service, d Deploy) (string, error) {
+	if d.imageFamily != "" {
+		project := d.imageFamilyProject
+		if project == "" {
+			project = d.Project
+		}
+
+		image, err := compute.NewImagesService(c).GetFromFamily(project, d.imageFamily).Do()
+		if err != nil {
+			return "", fmt.Errorf("get image from family '%v/%v': %v", project, d.imageFamily, err)
+		}
+		return image.SelfLink, nil
+	}
+
+	if d.image != "" {
+		return imageURL(d.Project, d.image), nil
+	}
+
+	return "", nil
+}
+
+func newNetworkInterface(n NetworkInterface, project, region string) *compute.NetworkInterface {
+	ni := &compute.NetworkInterface{}
+
+	if n.Network != "" {
+		ni.Network = resourceURL(project, "global/networks", n.Network)
+	}
+	if n.Subnetwork != "" {
+		ni.Subnetwork = resourceURL(project, "regions/"+region+"/subnetworks", n.Subnetwork)
+	}
+
+	if n.externalIP {
+		ni.AccessConfigs = []*compute.AccessConfig{
+			{Name: "External NAT", Type: "ONE_TO_ONE_NAT", NetworkTier: n.NetworkTier},
+		}
+	}
+
+	ni.AliasIpRanges = newAliasIPRanges(n.AliasIPRanges)
+
+	return ni
+}
+
+// applyNetworkOverrides rewrites the first network interface with the
+// network config of the deploy.
+func applyNetworkOverrides(p *compute.InstanceProperties, d Deploy) {
+	if d.Network == "" && d.Subnetwork == "" && d.NetworkTier == "" && d.ExternalIP == "" && len(d.AliasIPRanges) == 0 {
+		return
+	}
+
+	if len(p.NetworkInterfaces) == 0 {
+		p.NetworkInterfaces = []*compute.NetworkInterface{{}}
+	}
+	ni := p.NetworkInterfaces[0]
+
+	// a subnetwork implies its network and vice versa, so the other one
+	// from the base instance template has to go
+	switch {
+	case d.Network != "" && d.Subnetwork != "":
+		ni.Network = resourceURL(d.Project, "global/networks", d.Network)
+		ni.Subnetwork = resourceURL(d.Project, "regions/"+d.Region+"/subnetworks", d.Subnetwork)
+	case d.Network != "":
+		ni.Network = resourceURL(d.Project, "global/networks", d.Network)
+		ni.Subnetwork = ""
+	case d.Subnetwork != "":
+		ni.Network = ""
+		ni.Subnetwork = resourceURL(d.Project, "regions/"+d.Region+"/subnetworks", d.Subnetwork)
+	}
+
+	if d.ExternalIP != "" {
+		if !d.externalIP {
+			ni.AccessConfigs = nil
+		} else if len(ni.AccessConfigs) == 0 {
+			ni.AccessConfigs = []*compute.AccessConfig{
+				{Name: "External NAT", Type: "ONE_TO_ONE_NAT"},
+			}
+		}
+	}
+
+	if d.NetworkTier != "" {
+		for _, ac := range ni.AccessConfigs {
+			ac.NetworkTier = d.NetworkTier
+		}
+	}
+
+	if len(d.AliasIPRanges) > 0 {
+		ni.AliasIpRanges = newAliasIPRanges(d.AliasIPRanges)
+	}
+}
+
+func newAliasIPRanges(ranges []AliasIPRange) []*compute.AliasIpRange {
+	if len(ranges) == 0 {
+		return nil
+	}
+
+	r := make([]*compute.AliasIpRange, 0, len(ranges))
+	for _, x := range ranges {
+		r = append(r, &compute.AliasIpRange{
+			IpCidrRange:         x.IPCidrRange,
+			SubnetworkRangeName: x.SubnetworkRangeName,
+		})
+	}
+	return r
+}
+
+func newScheduling(s *Scheduling) *compute.Scheduling {
+	automaticRestart := s.automaticRestart
+	return &compute.Scheduling{
+		Preemptible:       s.preemptible,
+		AutomaticRestart:  &automaticRestart,
+		OnHostMaintenance: s.OnHostMaintenance,
+	}
+}
+
+// newExtraInstanceProperties returns the instance properties which the
+// compute client doesn't know about yet, keyed by their JSON name.
+func newExtraInstanceProperties(d Deploy) map[string]interface{} {
+	extra := make(map[string]interface{})
+
+	scheduling := d.Scheduling
+	if scheduling == nil && d.InstanceTemplateSpec != nil {
+		scheduling = d.InstanceTemplateSpec.Scheduling
+	}
+	if scheduling != nil {
+		fields := make(map[string]interface{})
+		if scheduling.ProvisioningModel != "" {
+			fields["provisioningModel"] = scheduling.ProvisioningModel
+		}
+		if scheduling.InstanceTerminationAction != "" {
+			fields["instanceTerminationAction"] = scheduling.InstanceTerminationAction
+		}
+		if len(fields) > 0 {
+			extra["scheduling"] = fields
+		}
+	}
+
+	if d.ConfidentialCompute != "" {
+		extra["confidentialInstanceConfig"] = map[string]interface{}{
+			"enableConfidentialCompute": d.confidentialCompute,
+		}
+	}
+
+	return extra
+}
+
+// insertInstanceTemplate inserts an instance template like
+// InstanceTemplatesService.Insert, but merges extra into the instance
+// properties of the request.
+func insertInstanceTemplate(hc *http.Client, basePath, project string, it *compute.InstanceTemplate, extra map[string]interface{}) (*compute.Operation, error) {
+	b, err := json.Marshal(it)
+	if err != nil {
+		return nil, err
+	}
+
+	body := make(map[string]interface{})
+	if err := json.Unmarshal(b, &body); err != nil {
+		return nil, err
+	}
+
+	properties, ok := body["properties"].(map[string]interface{})
+	if !ok {
+		properties = make(map[string]interface{})
+		body["properties"] = properties
+	}
+	mergeJSON(properties, extra)
+
+	b, err = json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	u := basePath + "projects/" + url.PathEscape(project) + "/global/instanceTemplates"
+	req, err := http.NewRequest("POST", u, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if err := googleapi.CheckResponse(res); err != nil {
+		return nil, err
+	}
+
+	op := &compute.Operation{}
+	if err := json.NewDecoder(res.Body).Decode(op); err != nil {
+		return nil, err
+	}
+	return op, nil
+}
+
+// mergeJSON merges src into dst, merging nested objects.
+func mergeJSON(dst, src map[string]interface{}) {
+	for k, v := range src {
+		srcObj, ok := v.(map[string]interface{})
+		if !ok {
+			dst[k] = v
+			continue
+		}
+		dstObj, ok := dst[k].(map[string]interface{})
+		if !ok {
+			dstObj = make(map[string]interface{})
+			dst[k] = dstObj
+		}
+		mergeJSON(dstObj, srcObj)
+	}
+}
+
+// imageURL returns the partial URL for an image, i.e. `my-image`,
+// `family/my-family`, `debian-cloud/debian-10-buster-v20201014` or
+// `debian-cloud/family/debian-10`. Images without project are looked up
+// in the deploy project. URLs are returned as is.
+func imageURL(project, image string) string {
+	if strings.HasPrefix(image, "projects/") || strings.HasPrefix(image, "https://") || strings.HasPrefix(image, "global/") {
+		return image
+	}
+
+	x := strings.Split(image, "/")
+	if len(x) == 1 || x[0] == "family" {
+		return fmt.Sprintf("projects/%v/global/images/%v", project, image)
+	}
+	return fmt.Sprintf("projects/%v/global/images/%v", x[0], strings.Join(x[1:], "/"))
+}
+
+// resourceURL returns the partial URL for a resource name.
+// URLs are returned as is.
+func resourceURL(project, collection, name string) string {
+	if strings.Contains(name, "/") {
+		return name
+	}
+	return fmt.Sprintf("projects/%v/%v/%v", project, collection, name)
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
 func newMetadataItem(key string, value string) *compute.MetadataItems {
 	return &compute.MetadataItems{
 		Key:   key,
@@ -147,10 +796,23 @@ func StartRollingUpdate(c *computeBeta.Service, d Deploy, instanceTemplateURL st
 	s := computeBeta.NewRegionInstanceGroupManagersService(c)
 
 	ig, err := s.Get(d.Project, d.Region, d.InstanceGroup).Do()
-	if err != nil {
+	if err != nil && isNotFoundErr(err) && (d.Preview.enabled || d.InstanceGroupSpec != nil) {
+		if err := CreateInstanceGroup(c, d, instanceTemplateURL); err != nil {
+			return err
+		}
+		Infof("%v: Created instance group '%v/%v'", d.Name, d.Project, d.InstanceGroup)
+		return nil
+	} else if err != nil {
 		return fmt.Errorf("get instance group '%v/%v': %v", d.Project, d.InstanceGroup, err)
 	}
 
+	// report drift from instance group spec, but don't change anything
+	if d.InstanceGroupSpec != nil {
+		for _, drift := range instanceGroupDrift(ig, d.InstanceGroupSpec, d.Project) {
+			LogWarning(fmt.Sprintf("instance group '%v/%v' drifted from instance_group_spec: %v", d.Project, d.InstanceGroup, drift), map[string]string{"name": d.Name})
+		}
+	}
+
 	// TODO consider making the following check a configuration flag
 	latestVersion := findLatestInstanceGroupManagerVersion(ig.Versions)
 	if latestVersion != "" && !VersionLessThan(latestVersion, d.InstanceTemplate) {
@@ -166,90 +828,441 @@ func StartRollingUpdate(c *computeBeta.Service, d Deploy, instanceTemplateURL st
 		},
 	}
 
-	if ig.UpdatePolicy == nil {
-		ig.UpdatePolicy = &computeBeta.InstanceGroupManagerUpdatePolicy{}
+	ig.UpdatePolicy = newUpdatePolicy(ig.UpdatePolicy, d)
+
+	// wait until ready
+	retry := 0
+	for {
+		_, err = s.Patch(d.Project, d.Region, d.InstanceGroup, ig).Do()
+		if err != nil && isNotReadyErr(err) {
+			time.Sleep(2 * time.Second)
+			retry++
+			if retry > 10 {
+				return fmt.Errorf("update instance group: too many retries")
+			}
+			continue
+
+		} else if err != nil {
+			return fmt.Errorf("update instance group: %v", err)
+		} else if err == nil {
+			return nil
+		}
+	}
+}
+
+// CleanupOptions select which instance templates created by this action
+// are deleted by CleanupInstanceTemplates.
+type CleanupOptions struct {
+	OlderThan time.Duration  // only delete instance templates older than this
+	KeepLast  int            // always keep the n most recently created instance templates
+	Labels    LabelSelectors // only delete instance templates matching all selectors
+	DryRun    bool           // report but don't delete
+}
+
+const (
+	CleanupDeleted         = "deleted"
+	CleanupWouldDelete     = "would delete"
+	CleanupSkippedInUse    = "skipped (in use)"
+	CleanupSkippedNotReady = "skipped (not ready)"
+	CleanupFailed          = "failed"
+)
+
+// CleanupResult reports what happened to a single instance template.
+type CleanupResult struct {
+	Project          string
+	InstanceTemplate string
+	Created          time.Time
+	Action           string
+	Err              error
+}
+
+// newUpdatePolicy sets the update policy fields from the deploy config
+// on top of an existing update policy.
+func newUpdatePolicy(p *computeBeta.InstanceGroupManagerUpdatePolicy, d Deploy) *computeBeta.InstanceGroupManagerUpdatePolicy {
+	if p == nil {
+		p = &computeBeta.InstanceGroupManagerUpdatePolicy{}
 	}
 
 	// force the following fields
-	ig.UpdatePolicy.Type = d.UpdatePolicy.Type
-	ig.UpdatePolicy.MinimalAction = d.UpdatePolicy.MinimalAction
-	ig.UpdatePolicy.ReplacementMethod = d.UpdatePolicy.ReplacementMethod
+	p.Type = d.UpdatePolicy.Type
+	p.MinimalAction = d.UpdatePolicy.MinimalAction
+	p.ReplacementMethod = d.UpdatePolicy.ReplacementMethod
 
-	ig.UpdatePolicy.MinReadySec = int64(d.UpdatePolicy.minReadySec)
-	ig.UpdatePolicy.ForceSendFields = []string{"MinReadySec"}
+	p.MinReadySec = int64(d.UpdatePolicy.minReadySec)
+	p.ForceSendFields = []string{"MinReadySec"}
 
 	if d.UpdatePolicy.maxSurgeInPercent {
-		ig.UpdatePolicy.MaxSurge = &computeBeta.FixedOrPercent{Percent: int64(d.UpdatePolicy.maxSurge), ForceSendFields: []string{"Percent"}}
+		p.MaxSurge = &computeBeta.FixedOrPercent{Percent: int64(d.UpdatePolicy.maxSurge), ForceSendFields: []string{"Percent"}}
 	} else {
-		ig.UpdatePolicy.MaxSurge = &computeBeta.FixedOrPercent{Fixed: int64(d.UpdatePolicy.maxSurge), ForceSendFields: []string{"Fixed"}}
+		p.MaxSurge = &computeBeta.FixedOrPercent{Fixed: int64(d.UpdatePolicy.maxSurge), ForceSendFields: []string{"Fixed"}}
 	}
 
 	if d.UpdatePolicy.maxUnavailableInPercent {
-		ig.UpdatePolicy.MaxUnavailable = &computeBeta.FixedOrPercent{Percent: int64(d.UpdatePolicy.maxUnavailable), ForceSendFields: []string{"Percent"}}
+		p.MaxUnavailable = &computeBeta.FixedOrPercent{Percent: int64(d.UpdatePolicy.maxUnavailable), ForceSendFields: []string{"Percent"}}
 	} else {
-		ig.UpdatePolicy.MaxUnavailable = &computeBeta.FixedOrPercent{Fixed: int64(d.UpdatePolicy.maxUnavailable), ForceSendFields: []string{"Fixed"}}
+		p.MaxUnavailable = &computeBeta.FixedOrPercent{Fixed: int64(d.UpdatePolicy.maxUnavailable), ForceSendFields: []string{"Fixed"}}
+	}
+
+	return p
+}
+
+// CreateInstanceGroup creates a new regional instance group for the deploy
+// with the given instance template. The instance group is configured from
+// the instance group spec, or the preview config if there is no spec.
+func CreateInstanceGroup(c *computeBeta.Service, d Deploy, instanceTemplateURL string) error {
+	s := computeBeta.NewRegionInstanceGroupManagersService(c)
+
+	ig := &computeBeta.InstanceGroupManager{
+		Name:             d.InstanceGroup,
+		Description:      instanceGroupDescription,
+		BaseInstanceName: d.InstanceGroup,
+		InstanceTemplate: instanceTemplateURL,
+		TargetSize:       int64(d.Preview.targetSize),
+		ForceSendFields:  []string{"TargetSize"},
+		Versions: []*computeBeta.InstanceGroupManagerVersion{
+			{
+				InstanceTemplate: instanceTemplateURL,
+				Name:             d.InstanceTemplate,
+			},
+		},
+		UpdatePolicy: newUpdatePolicy(nil, d),
+	}
+
+	if spec := d.InstanceGroupSpec; spec != nil {
+		ig.TargetSize = int64(spec.targetSize)
+
+		if len(spec.Zones) > 0 {
+			ig.DistributionPolicy = &computeBeta.DistributionPolicy{}
+			for _, zone := range spec.Zones {
+				ig.DistributionPolicy.Zones = append(ig.DistributionPolicy.Zones,
+					&computeBeta.DistributionPolicyZoneConfiguration{Zone: fmt.Sprintf("projects/%v/zones/%v", d.Project, zone)})
+			}
+		}
+
+		ig.NamedPorts = newNamedPorts(spec.namedPorts)
+
+		if spec.Autohealing.HealthCheck != "" {
+			ig.AutoHealingPolicies = []*computeBeta.InstanceGroupManagerAutoHealingPolicy{
+				{
+					HealthCheck:     healthCheckURL(d.Project, spec.Autohealing.HealthCheck),
+					InitialDelaySec: int64(spec.Autohealing.initialDelaySec),
+				},
+			}
+		}
 	}
 
 	// wait until ready
 	retry := 0
 	for {
-		_, err = s.Patch(d.Project, d.Region, d.InstanceGroup, ig).Do()
+		_, err := s.Insert(d.Project, d.Region, ig).Do()
 		if err != nil && isNotReadyErr(err) {
 			time.Sleep(2 * time.Second)
 			retry++
 			if retry > 10 {
-				return fmt.Errorf("update instance group: too many retries")
+				return fmt.Errorf("create instance group: too many retries")
 			}
 			continue
 
 		} else if err != nil {
-			return fmt.Errorf("update instance group: %v", err)
+			return fmt.Errorf("create instance group '%v/%v': %v", d.Project, d.InstanceGroup, err)
 		} else if err == nil {
 			return nil
 		}
 	}
 }
 
-func CleanupInstanceTemplates(c *compute.Service, project string, after time.Duration) error {
+// instanceGroupDrift returns the differences between an existing instance
+// group and the instance group spec.
+func instanceGroupDrift(ig *computeBeta.InstanceGroupManager, spec *InstanceGroupSpec, project string) []string {
+	drift := make([]string, 0)
+
+	// the autoscaler manages the size
+	autoscaled := ig.Status != nil && ig.Status.Autoscaler != ""
+	if !autoscaled && ig.TargetSize != int64(spec.targetSize) {
+		drift = append(drift, fmt.Sprintf("target_size is %v, expected %v", ig.TargetSize, spec.targetSize))
+	}
+
+	if len(spec.Zones) > 0 {
+		zones := make([]string, 0)
+		if ig.DistributionPolicy != nil {
+			for _, z := range ig.DistributionPolicy.Zones {
+				zones = append(zones, path.Base(z.Zone))
+			}
+		}
+		expectZones := append([]string{}, spec.Zones...)
+		sort.Strings(zones)
+		sort.Strings(expectZones)
+		if strings.Join(zones, ",") != strings.Join(expectZones, ",") {
+			drift = append(drift, fmt.Sprintf("zones are [%v], expected [%v]", strings.Join(zones, ","), strings.Join(expectZones, ",")))
+		}
+	}
+
+	if len(spec.namedPorts) > 0 {
+		ports := make(map[string]int64)
+		for _, p := range ig.NamedPorts {
+			ports[p.Name] = p.Port
+		}
+		for _, p := range newNamedPorts(spec.namedPorts) {
+			if port, ok := ports[p.Name]; !ok {
+				drift = append(drift, fmt.Sprintf("named port '%v' is missing", p.Name))
+			} else if port != p.Port {
+				drift = append(drift, fmt.Sprintf("named port '%v' is %v, expected %v", p.Name, port, p.Port))
+			}
+		}
+	}
+
+	if spec.Autohealing.HealthCheck != "" {
+		if len(ig.AutoHealingPolicies) == 0 {
+			drift = append(drift, "autohealing is disabled")
+		} else {
+			policy := ig.AutoHealingPolicies[0]
+			if path.Base(policy.HealthCheck) != path.Base(healthCheckURL(project, spec.Autohealing.HealthCheck)) {
+				drift = append(drift, fmt.Sprintf("autohealing.health_check is '%v', expected '%v'", path.Base(policy.HealthCheck), path.Base(spec.Autohealing.HealthCheck)))
+			}
+			if policy.InitialDelaySec != int64(spec.Autohealing.initialDelaySec) {
+				drift = append(drift, fmt.Sprintf("autohealing.initial_delay_sec is %v, expected %v", policy.InitialDelaySec, spec.Autohealing.initialDelaySec))
+			}
+		}
+	}
+
+	return drift
+}
+
+func newNamedPorts(ports map[string]int64) []*computeBeta.NamedPort {
+	names := make([]string, 0, len(ports))
+	for name := range ports {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	namedPorts := make([]*computeBeta.NamedPort, 0, len(names))
+	for _, name := range names {
+		namedPorts = append(namedPorts, &computeBeta.NamedPort{Name: name, Port: ports[name]})
+	}
+	return namedPorts
+}
+
+// healthCheckURL returns the partial URL for a health check name.
+// URLs are returned as is.
+func healthCheckURL(project, healthCheck string) string {
+	return resourceURL(project, "global/healthChecks", healthCheck)
+}
+
+// DeleteInstanceGroup deletes a regional instance group and waits until
+// the instance group is gone. It returns false if the instance group
+// didn't exist.
+func DeleteInstanceGroup(c *computeBeta.Service, project, region, instanceGroup string) (bool, error) {
+	s := computeBeta.NewRegionInstanceGroupManagersService(c)
+
+	op, err := s.Delete(project, region, instanceGroup).Do()
+	if err != nil && isNotFoundErr(err) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("delete instance group '%v/%v': %v", project, instanceGroup, err)
+	}
+
+	if err := waitForRegionOperation(c, project, region, op); err != nil {
+		return false, fmt.Errorf("delete instance group '%v/%v': %v", project, instanceGroup, err)
+	}
+	return true, nil
+}
+
+// DeletePreviewInstanceTemplates deletes all instance templates created by
+// us for the given preview instance group.
+func DeletePreviewInstanceTemplates(c *compute.Service, project, instanceGroup string) ([]string, error) {
 	s := compute.NewInstanceTemplatesService(c)
 
-	l, err := s.List(project).Do()
+	items, err := ListInstanceTemplates(c, project)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	var wg sync.WaitGroup
+	names := make([]string, 0)
+	for _, item := range items {
+		if item.Properties != nil && item.Properties.Labels[previewLabel] == instanceGroup {
+			names = append(names, item.Name)
+		}
+	}
+
+	deleted := make([]string, 0)
+	for _, name := range names {
+		if _, err := s.Delete(project, name).Do(); err != nil && !isNotFoundErr(err) {
+			return deleted, fmt.Errorf("delete instance template '%v/%v': %v", project, name, err)
+		}
+		deleted = append(deleted, name)
+	}
+	return deleted, nil
+}
 
-	for _, item := range l.Items {
+// ListInstanceGroups returns all regional instance groups created by us.
+func ListInstanceGroups(c *computeBeta.Service, project string) ([]*computeBeta.InstanceGroupManager, error) {
+	s := computeBeta.NewInstanceGroupManagersService(c)
 
-		// skip if this instance template was not created by us
-		if !strings.Contains(item.Description, instanceTemplateDescription) {
-			continue
+	items := make([]*computeBeta.InstanceGroupManager, 0)
+	err := s.AggregatedList(project).Pages(context.Background(), func(l *computeBeta.InstanceGroupManagerAggregatedList) error {
+		for _, scope := range l.Items {
+			for _, ig := range scope.InstanceGroupManagers {
+				if ig.Region == "" || !strings.Contains(ig.Description, instanceGroupDescription) {
+					continue
+				}
+				items = append(items, ig)
+			}
 		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return items, nil
+}
 
-		// parse time and skip if the instance template is not old enough
-		t, err := time.Parse(time.RFC3339, item.CreationTimestamp)
+// ListInstanceTemplates returns all instance templates created by us.
+func ListInstanceTemplates(c *compute.Service, project string) ([]*compute.InstanceTemplate, error) {
+	s := compute.NewInstanceTemplatesService(c)
+
+	items := make([]*compute.InstanceTemplate, 0)
+	err := s.List(project).Pages(context.Background(), func(l *compute.InstanceTemplateList) error {
+		for _, item := range l.Items {
+			if !strings.Contains(item.Description, instanceTemplateDescription) {
+				continue
+			}
+			items = append(items, item)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+func waitForRegionOperation(c *computeBeta.Service, project, region string, op *computeBeta.Operation) error {
+	s := computeBeta.NewRegionOperationsService(c)
+
+	for op.Status != "DONE" {
+		time.Sleep(2 * time.Second)
+
+		var err error
+		op, err = s.Get(project, region, op.Name).Do()
 		if err != nil {
 			return err
 		}
+	}
 
-		if !time.Now().UTC().After(t.UTC().Add(after)) {
+	if op.Error != nil && len(op.Error.Errors) > 0 {
+		return fmt.Errorf("%v", op.Error.Errors[0].Message)
+	}
+	return nil
+}
+
+func CleanupInstanceTemplates(c *compute.Service, project string, opts CleanupOptions) ([]CleanupResult, error) {
+	items, err := ListInstanceTemplates(c, project)
+	if err != nil {
+		return nil, err
+	}
+
+	results, err := selectInstanceTemplatesForCleanup(items, opts, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	var wg sync.WaitGroup
+
+	for i := range results {
+		results[i].Project = project
+
+		if opts.DryRun {
+			results[i].Action = CleanupWouldDelete
 			continue
 		}
 
 		// actually delete the instance template
 		wg.Add(1)
-		go func(instanceTemplate string) {
+		go func(r *CleanupResult) {
 			defer wg.Done()
-			if _, err := s.Delete(project, instanceTemplate).Do(); err != nil && !isInUseByAnotherResource(err) && !isNotReadyErr(err) {
-				LogWarning(err.Error(), nil)
-			}
-			Infof("Deleted old instance template '%v/%v'", project, instanceTemplate)
-		}(item.Name)
+			r.Action, r.Err = DeleteInstanceTemplate(c, project, r.InstanceTemplate)
+		}(&results[i])
 	}
 
 	wg.Wait()
-	return nil
+	return results, nil
+}
+
+// DeleteInstanceTemplate deletes an instance template and returns the action
+// taken. Instance templates which are in use or not ready are skipped.
+func DeleteInstanceTemplate(c *compute.Service, project, instanceTemplate string) (string, error) {
+	s := compute.NewInstanceTemplatesService(c)
+
+	_, err := s.Delete(project, instanceTemplate).Do()
+	switch {
+	case err == nil:
+		return CleanupDeleted, nil
+	case isInUseByAnotherResource(err):
+		return CleanupSkippedInUse, nil
+	case isNotReadyErr(err):
+		return CleanupSkippedNotReady, nil
+	default:
+		return CleanupFailed, fmt.Errorf("delete instance template '%v/%v': %v", project, instanceTemplate, err)
+	}
+}
+
+// selectInstanceTemplatesForCleanup returns the instance templates that were
+// created by us and are eligible for deletion, oldest first.
+func selectInstanceTemplatesForCleanup(items []*compute.InstanceTemplate, opts CleanupOptions, now time.Time) ([]CleanupResult, error) {
+	candidates := make([]CleanupResult, 0)
+
+	for _, item := range items {
+
+		// skip if this instance template was not created by us
+		if !strings.Contains(item.Description, instanceTemplateDescription) {
+			continue
+		}
+
+		// skip if labels don't match
+		var labels map[string]string
+		if item.Properties != nil {
+			labels = item.Properties.Labels
+		}
+		if !opts.Labels.Match(labels) {
+			continue
+		}
+
+		t, err := time.Parse(time.RFC3339, item.CreationTimestamp)
+		if err != nil {
+			return nil, err
+		}
+
+		candidates = append(candidates, CleanupResult{
+			InstanceTemplate: item.Name,
+			Created:          t.UTC(),
+		})
+	}
+
+	// newest first, so we can keep the last n instance templates
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].Created.After(candidates[j].Created)
+	})
+
+	results := make([]CleanupResult, 0)
+	for i, r := range candidates {
+		if i < opts.KeepLast {
+			continue
+		}
+
+		// skip if the instance template is not old enough
+		if !now.UTC().After(r.Created.Add(opts.OlderThan)) {
+			continue
+		}
+
+		results = append(results, r)
+	}
+
+	// oldest first
+	for i, j := 0, len(results)-1; i < j; i, j = i+1, j-1 {
+		results[i], results[j] = results[j], results[i]
+	}
+
+	return results, nil
 }
 
 func isReasonErr(err error, reason string) bool {
@@ -263,6 +1276,13 @@ func isReasonErr(err error, reason string) bool {
 	return false
 }
 
+func isNotFoundErr(err error) bool {
+	if e, ok := err.(*googleapi.Error); ok && e.Code == http.StatusNotFound {
+		return true
+	}
+	return isReasonErr(err, "notFound")
+}
+
 func isAlreadyExistErr(err error) bool {
 	return isReasonErr(err, "alreadyExists")
 }
@@ -1,10 +1,16 @@
 package main
 
 import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 	computeBeta "google.golang.org/api/compute/v0.beta"
+	"google.golang.org/api/compute/v1"
 )
 
 func TestFindLatestInstanceGroupManagerVersion(t *testing.T) {
@@ -22,3 +28,407 @@ func TestFindLatestInstanceGroupManagerVersion(t *testing.T) {
 		},
 	))
 }
+
+func TestSelectInstanceTemplatesForCleanup(t *testing.T) {
+	now := time.Date(2020, 10, 10, 12, 0, 0, 0, time.UTC)
+
+	newTemplate := func(name string, age time.Duration, labels map[string]string) *compute.InstanceTemplate {
+		return &compute.InstanceTemplate{
+			Name:              name,
+			Description:       instanceTemplateDescription,
+			CreationTimestamp: now.Add(-age).Format(time.RFC3339),
+			Properties:        &compute.InstanceProperties{Labels: labels},
+		}
+	}
+
+	items := []*compute.InstanceTemplate{
+		newTemplate("a-1", 5*time.Hour, map[string]string{"env": "prod"}),
+		newTemplate("a-3", 3*time.Hour, map[string]string{"env": "staging"}),
+		newTemplate("a-2", 4*time.Hour, map[string]string{"env": "staging"}),
+		newTemplate("a-4", 1*time.Hour, nil),
+		{Name: "manual", Description: "", CreationTimestamp: now.Add(-10 * time.Hour).Format(time.RFC3339)},
+	}
+
+	names := func(results []CleanupResult) []string {
+		n := make([]string, 0)
+		for _, r := range results {
+			n = append(n, r.InstanceTemplate)
+		}
+		return n
+	}
+
+	r, err := selectInstanceTemplatesForCleanup(items, CleanupOptions{OlderThan: 2 * time.Hour}, now)
+	require.NoError(t, err)
+	require.Equal(t, []string{"a-1", "a-2", "a-3"}, names(r))
+
+	r, err = selectInstanceTemplatesForCleanup(items, CleanupOptions{OlderThan: 2 * time.Hour, KeepLast: 2}, now)
+	require.NoError(t, err)
+	require.Equal(t, []string{"a-1", "a-2"}, names(r))
+
+	r, err = selectInstanceTemplatesForCleanup(items, CleanupOptions{KeepLast: 1}, now)
+	require.NoError(t, err)
+	require.Equal(t, []string{"a-1", "a-2", "a-3"}, names(r))
+
+	r, err = selectInstanceTemplatesForCleanup(items, CleanupOptions{Labels: LabelSelectors{{Key: "env", Operator: "=", Value: "staging"}}}, now)
+	require.NoError(t, err)
+	require.Equal(t, []string{"a-2", "a-3"}, names(r))
+}
+
+func TestInstanceGroupDrift(t *testing.T) {
+	spec := &InstanceGroupSpec{
+		targetSize: 2,
+		Zones:      []string{"us-central1-b", "us-central1-a"},
+		namedPorts: map[string]int64{"http": 8080, "https": 8443},
+		Autohealing: Autohealing{
+			HealthCheck:     "hc",
+			initialDelaySec: 300,
+		},
+	}
+
+	ig := &computeBeta.InstanceGroupManager{
+		TargetSize: 2,
+		DistributionPolicy: &computeBeta.DistributionPolicy{
+			Zones: []*computeBeta.DistributionPolicyZoneConfiguration{
+				{Zone: "https://www.googleapis.com/compute/beta/projects/p/zones/us-central1-a"},
+				{Zone: "https://www.googleapis.com/compute/beta/projects/p/zones/us-central1-b"},
+			},
+		},
+		NamedPorts: []*computeBeta.NamedPort{{Name: "http", Port: 8080}, {Name: "https", Port: 8443}},
+		AutoHealingPolicies: []*computeBeta.InstanceGroupManagerAutoHealingPolicy{
+			{HealthCheck: "https://www.googleapis.com/compute/beta/projects/p/global/healthChecks/hc", InitialDelaySec: 300},
+		},
+	}
+	require.Empty(t, instanceGroupDrift(ig, spec, "p"))
+
+	ig.TargetSize = 5
+	ig.NamedPorts = []*computeBeta.NamedPort{{Name: "http", Port: 80}}
+	ig.AutoHealingPolicies = nil
+	require.Equal(t, []string{
+		"target_size is 5, expected 2",
+		"named port 'http' is 80, expected 8080",
+		"named port 'https' is missing",
+		"autohealing is disabled",
+	}, instanceGroupDrift(ig, spec, "p"))
+
+	// target size is ignored for autoscaled groups
+	ig.Status = &computeBeta.InstanceGroupManagerStatus{Autoscaler: "https://www.googleapis.com/compute/beta/projects/p/regions/r/autoscalers/a"}
+	require.Equal(t, []string{
+		"named port 'http' is 80, expected 8080",
+		"named port 'https' is missing",
+		"autohealing is disabled",
+	}, instanceGroupDrift(ig, spec, "p"))
+}
+
+func TestImageURL(t *testing.T) {
+	require.Equal(t, "projects/p/global/images/my-image", imageURL("p", "my-image"))
+	require.Equal(t, "projects/p/global/images/family/my-family", imageURL("p", "family/my-family"))
+	require.Equal(t, "projects/debian-cloud/global/images/debian-10-buster-v20201014", imageURL("p", "debian-cloud/debian-10-buster-v20201014"))
+	require.Equal(t, "projects/debian-cloud/global/images/family/debian-10", imageURL("p", "debian-cloud/family/debian-10"))
+	require.Equal(t, "projects/x/global/images/y", imageURL("p", "projects/x/global/images/y"))
+}
+
+func TestNewInstanceTemplateFromSpec(t *testing.T) {
+	spec := &InstanceTemplateSpec{
+		MachineType: "e2-small",
+		BootDisk:    BootDisk{Image: "debian-cloud/family/debian-10", sizeGb: 20, Type: "pd-ssd"},
+		NetworkInterfaces: []NetworkInterface{
+			{Network: "default", externalIP: true},
+			{Subnetwork: "my-subnet"},
+		},
+		ServiceAccount: &ServiceAccount{Email: "sa@p.iam.gserviceaccount.com", Scopes: []string{"https://www.googleapis.com/auth/cloud-platform"}},
+		Scheduling:     &Scheduling{preemptible: true, OnHostMaintenance: "TERMINATE"},
+		Labels:         map[string]string{"foo": "bar"},
+		Metadata:       map[string]string{"b": "2", "a": "1"},
+	}
+
+	it := newInstanceTemplateFromSpec(spec, "p", "us-central1")
+	p := it.Properties
+
+	require.Equal(t, "e2-small", p.MachineType)
+	require.Len(t, p.Disks, 1)
+	require.True(t, p.Disks[0].Boot)
+	require.Equal(t, "projects/debian-cloud/global/images/family/debian-10", p.Disks[0].InitializeParams.SourceImage)
+	require.Equal(t, int64(20), p.Disks[0].InitializeParams.DiskSizeGb)
+	require.Equal(t, "pd-ssd", p.Disks[0].InitializeParams.DiskType)
+
+	require.Len(t, p.NetworkInterfaces, 2)
+	require.Equal(t, "projects/p/global/networks/default", p.NetworkInterfaces[0].Network)
+	require.Len(t, p.NetworkInterfaces[0].AccessConfigs, 1)
+	require.Equal(t, "projects/p/regions/us-central1/subnetworks/my-subnet", p.NetworkInterfaces[1].Subnetwork)
+	require.Len(t, p.NetworkInterfaces[1].AccessConfigs, 0)
+
+	require.Equal(t, "sa@p.iam.gserviceaccount.com", p.ServiceAccounts[0].Email)
+	require.True(t, p.Scheduling.Preemptible)
+	require.False(t, *p.Scheduling.AutomaticRestart)
+
+	require.Equal(t, "bar", p.Labels["foo"])
+	require.Equal(t, "a", p.Metadata.Items[0].Key)
+	require.Equal(t, "b", p.Metadata.Items[1].Key)
+}
+
+func TestApplyInstanceTemplateOverrides(t *testing.T) {
+	p := &compute.InstanceProperties{
+		MachineType: "e2-small",
+		Disks: []*compute.AttachedDisk{
+			{Boot: false, InitializeParams: &compute.AttachedDiskInitializeParams{DiskSizeGb: 100}},
+			{Boot: true, InitializeParams: &compute.AttachedDiskInitializeParams{DiskSizeGb: 10, DiskType: "pd-standard"}},
+		},
+		Scheduling: &compute.Scheduling{OnHostMaintenance: "MIGRATE"},
+	}
+
+	d := Deploy{
+		MachineType:       "n1-standard-4",
+		BootDisk:          &BootDisk{sizeGb: 50},
+		sourceImage:       "projects/p/global/images/my-image",
+		GuestAccelerators: []GuestAccelerator{{Type: "nvidia-tesla-t4", count: 2}},
+	}
+
+	require.NoError(t, applyInstanceTemplateOverrides(p, d))
+
+	require.Equal(t, "n1-standard-4", p.MachineType)
+	require.Equal(t, int64(100), p.Disks[0].InitializeParams.DiskSizeGb)
+	require.Equal(t, int64(50), p.Disks[1].InitializeParams.DiskSizeGb)
+	require.Equal(t, "pd-standard", p.Disks[1].InitializeParams.DiskType)
+	require.Equal(t, "projects/p/global/images/my-image", p.Disks[1].InitializeParams.SourceImage)
+	require.Len(t, p.GuestAccelerators, 1)
+	require.Equal(t, int64(2), p.GuestAccelerators[0].AcceleratorCount)
+	require.Equal(t, "TERMINATE", p.Scheduling.OnHostMaintenance)
+
+	require.Equal(t, "MachineType:n1-standard-4, BootDiskSize:50GB, GuestAccelerator:2xnvidia-tesla-t4", describeInstanceTemplateOverrides(d))
+	require.Equal(t, "", describeInstanceTemplateOverrides(Deploy{}))
+
+	// boot disk without image
+	err := applyInstanceTemplateOverrides(&compute.InstanceProperties{}, Deploy{BootDisk: &BootDisk{sizeGb: 50}})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "no boot disk image")
+
+	// existing disk
+	p = &compute.InstanceProperties{Disks: []*compute.AttachedDisk{{Boot: true, Source: "projects/p/zones/z/disks/d"}}}
+	require.NoError(t, applyInstanceTemplateOverrides(p, Deploy{BootDisk: &BootDisk{Type: "pd-ssd"}}))
+}
+
+func TestApplyNetworkOverrides(t *testing.T) {
+	base := func() *compute.InstanceProperties {
+		return &compute.InstanceProperties{
+			NetworkInterfaces: []*compute.NetworkInterface{{
+				Network:       "https://www.googleapis.com/compute/v1/projects/p/global/networks/default",
+				Subnetwork:    "https://www.googleapis.com/compute/v1/projects/p/regions/r/subnetworks/default",
+				AccessConfigs: []*compute.AccessConfig{{Name: "External NAT", Type: "ONE_TO_ONE_NAT"}},
+			}},
+		}
+	}
+
+	p := base()
+	applyNetworkOverrides(p, Deploy{})
+	require.Equal(t, base(), p)
+
+	p = base()
+	applyNetworkOverrides(p, Deploy{Project: "p", Region: "r", Network: "vpc"})
+	require.Equal(t, "projects/p/global/networks/vpc", p.NetworkInterfaces[0].Network)
+	require.Equal(t, "", p.NetworkInterfaces[0].Subnetwork)
+	require.Len(t, p.NetworkInterfaces[0].AccessConfigs, 1)
+
+	p = base()
+	applyNetworkOverrides(p, Deploy{Project: "p", Region: "r", Subnetwork: "projects/host/regions/r/subnetworks/shared", ExternalIP: "false"})
+	require.Equal(t, "", p.NetworkInterfaces[0].Network)
+	require.Equal(t, "projects/host/regions/r/subnetworks/shared", p.NetworkInterfaces[0].Subnetwork)
+	require.Len(t, p.NetworkInterfaces[0].AccessConfigs, 0)
+
+	p = &compute.InstanceProperties{}
+	applyNetworkOverrides(p, Deploy{Project: "p", Region: "r", Network: "default", ExternalIP: "true", externalIP: true, NetworkTier: "STANDARD",
+		AliasIPRanges: []AliasIPRange{{IPCidrRange: "/24", SubnetworkRangeName: "pods"}}})
+	require.Len(t, p.NetworkInterfaces, 1)
+	require.Equal(t, "STANDARD", p.NetworkInterfaces[0].AccessConfigs[0].NetworkTier)
+	require.Equal(t, "/24", p.NetworkInterfaces[0].AliasIpRanges[0].IpCidrRange)
+	require.Equal(t, "pods", p.NetworkInterfaces[0].AliasIpRanges[0].SubnetworkRangeName)
+
+	require.Equal(t, "Network:vpc, ExternalIP:false", describeInstanceTemplateOverrides(Deploy{Network: "vpc", ExternalIP: "false"}))
+}
+
+func TestApplySchedulingOverrides(t *testing.T) {
+	p := &compute.InstanceProperties{
+		Scheduling: &compute.Scheduling{OnHostMaintenance: "MIGRATE", MinNodeCpus: 2},
+	}
+
+	d := Deploy{Scheduling: &Scheduling{ProvisioningModel: "SPOT", OnHostMaintenance: "TERMINATE", InstanceTerminationAction: "DELETE"}}
+	require.NoError(t, applyInstanceTemplateOverrides(p, d))
+
+	require.Equal(t, "TERMINATE", p.Scheduling.OnHostMaintenance)
+	require.False(t, *p.Scheduling.AutomaticRestart)
+	require.Equal(t, int64(2), p.Scheduling.MinNodeCpus)
+	require.Equal(t, map[string]interface{}{
+		"scheduling": map[string]interface{}{"provisioningModel": "SPOT", "instanceTerminationAction": "DELETE"},
+	}, newExtraInstanceProperties(d))
+	require.Len(t, newExtraInstanceProperties(Deploy{}), 0)
+
+	require.Equal(t, "ProvisioningModel:SPOT, AutomaticRestart:false, OnHostMaintenance:TERMINATE, InstanceTerminationAction:DELETE", describeInstanceTemplateOverrides(d))
+}
+
+func TestInsertInstanceTemplate(t *testing.T) {
+	var body map[string]interface{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "POST", r.Method)
+		require.Equal(t, "/projects/p/global/instanceTemplates", r.URL.Path)
+
+		b, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		require.NoError(t, json.Unmarshal(b, &body))
+
+		w.Write([]byte(`{"targetLink": "projects/p/global/instanceTemplates/t"}`))
+	}))
+	defer ts.Close()
+
+	automaticRestart := false
+	it := &compute.InstanceTemplate{
+		Name: "t",
+		Properties: &compute.InstanceProperties{
+			MachineType: "e2-small",
+			Scheduling:  &compute.Scheduling{AutomaticRestart: &automaticRestart, OnHostMaintenance: "TERMINATE"},
+		},
+	}
+
+	op, err := insertInstanceTemplate(ts.Client(), ts.URL+"/", "p", it, map[string]interface{}{"scheduling": map[string]interface{}{"provisioningModel": "SPOT"}})
+	require.NoError(t, err)
+	require.Equal(t, "projects/p/global/instanceTemplates/t", op.TargetLink)
+
+	properties := body["properties"].(map[string]interface{})
+	require.Equal(t, "e2-small", properties["machineType"])
+	require.Equal(t, map[string]interface{}{
+		"automaticRestart":  false,
+		"onHostMaintenance": "TERMINATE",
+		"provisioningModel": "SPOT",
+	}, properties["scheduling"])
+
+	ts.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(`{"error": {"code": 409, "message": "already exists", "errors": [{"reason": "alreadyExists"}]}}`))
+	})
+	_, err = insertInstanceTemplate(ts.Client(), ts.URL+"/", "p", it, map[string]interface{}{"scheduling": map[string]interface{}{"provisioningModel": "SPOT"}})
+	require.Error(t, err)
+	require.True(t, isAlreadyExistErr(err))
+}
+
+func TestApplySecurityOverrides(t *testing.T) {
+	p := &compute.InstanceProperties{
+		Disks: []*compute.AttachedDisk{
+			{Boot: true, InitializeParams: &compute.AttachedDiskInitializeParams{DiskSizeGb: 10}},
+			{Source: "projects/p/zones/z/disks/existing"},
+		},
+		ServiceAccounts: []*compute.ServiceAccount{{Email: "default"}},
+	}
+
+	secureBoot := true
+	d := Deploy{
+		ServiceAccount:      &ServiceAccount{Email: "prod@p.iam.gserviceaccount.com", Scopes: []string{"https://www.googleapis.com/auth/cloud-platform"}},
+		ShieldedVM:          &ShieldedVM{secureBoot: &secureBoot},
+		ConfidentialCompute: "true",
+		confidentialCompute: true,
+		DiskEncryptionKey:   "projects/p/locations/global/keyRings/r/cryptoKeys/k",
+	}
+	require.NoError(t, applyInstanceTemplateOverrides(p, d))
+
+	require.Len(t, p.ServiceAccounts, 1)
+	require.Equal(t, "prod@p.iam.gserviceaccount.com", p.ServiceAccounts[0].Email)
+	require.Equal(t, &compute.ShieldedInstanceConfig{
+		EnableSecureBoot:          true,
+		EnableVtpm:                true,
+		EnableIntegrityMonitoring: true,
+		ForceSendFields:           []string{"EnableSecureBoot", "EnableVtpm", "EnableIntegrityMonitoring"},
+	}, p.ShieldedInstanceConfig)
+	require.Equal(t, "projects/p/locations/global/keyRings/r/cryptoKeys/k", p.Disks[0].DiskEncryptionKey.KmsKeyName)
+	require.Nil(t, p.Disks[1].DiskEncryptionKey)
+	require.Equal(t, "TERMINATE", p.Scheduling.OnHostMaintenance)
+
+	require.Equal(t, map[string]interface{}{
+		"confidentialInstanceConfig": map[string]interface{}{"enableConfidentialCompute": true},
+	}, newExtraInstanceProperties(d))
+}
+
+func TestMergeJSON(t *testing.T) {
+	dst := map[string]interface{}{
+		"scheduling": map[string]interface{}{"preemptible": true},
+		"tags":       []string{"a"},
+	}
+	mergeJSON(dst, map[string]interface{}{
+		"scheduling": map[string]interface{}{"provisioningModel": "SPOT"},
+		"tags":       []string{"b"},
+	})
+	require.Equal(t, map[string]interface{}{
+		"scheduling": map[string]interface{}{"preemptible": true, "provisioningModel": "SPOT"},
+		"tags":       []string{"b"},
+	}, dst)
+}
+
+func TestMergeInstanceProperties(t *testing.T) {
+	p := &compute.InstanceProperties{
+		Tags:   &compute.Tags{Items: []string{"http", "legacy", "ssh"}},
+		Labels: map[string]string{"env": "base", "team": "infra", "old": "x"},
+		Metadata: &compute.Metadata{Items: []*compute.MetadataItems{
+			newMetadataItem("startup-script", "echo base"),
+			newMetadataItem("enable-oslogin", "true"),
+			newMetadataItem("debug", "true"),
+		}},
+	}
+
+	d := Deploy{
+		Tags:              []string{"http", "https"},
+		RemoveTags:        []string{"legacy"},
+		Labels:            map[string]string{"env": "prod"},
+		RemoveLabels:      []string{"old"},
+		Metadata:          map[string]string{"enable-oslogin": "false"},
+		RemoveMetadata:    []string{"debug"},
+		StartupScriptPath: "startup.sh",
+		startupScript:     "echo deploy",
+	}
+	mergeInstanceProperties(p, d)
+
+	require.Equal(t, []string{"http", "ssh", "https"}, p.Tags.Items)
+	require.Equal(t, map[string]string{"env": "prod", "team": "infra"}, p.Labels)
+	require.Len(t, p.Metadata.Items, 2)
+	require.Equal(t, "startup-script", p.Metadata.Items[0].Key)
+	require.Equal(t, "echo deploy", *p.Metadata.Items[0].Value)
+	require.Equal(t, "enable-oslogin", p.Metadata.Items[1].Key)
+	require.Equal(t, "false", *p.Metadata.Items[1].Value)
+
+	require.Equal(t, "tags [http, ssh, https], labels [env=prod, team=infra], metadata keys [startup-script, enable-oslogin]",
+		describeInstanceProperties(p))
+
+	p = &compute.InstanceProperties{}
+	mergeInstanceProperties(p, Deploy{Tags: []string{"a"}, CloudInitPath: "cloud-init.yml", cloudInit: "#cloud-config"})
+	require.Equal(t, []string{"a"}, p.Tags.Items)
+	require.Equal(t, "user-data", p.Metadata.Items[0].Key)
+}
+
+func TestMergeInstancePropertiesScriptURL(t *testing.T) {
+	p := &compute.InstanceProperties{
+		Metadata: &compute.Metadata{Items: []*compute.MetadataItems{
+			newMetadataItem("startup-script", "echo base"),
+			newMetadataItem("shutdown-script-url", "gs://bucket/old"),
+		}},
+	}
+
+	mergeInstanceProperties(p, Deploy{
+		StartupScriptPath:  "startup.sh",
+		startupScriptURL:   "gs://bucket/startup-script-abc",
+		ShutdownScriptPath: "shutdown.sh",
+		shutdownScript:     "echo shutdown",
+	})
+
+	require.Equal(t, "tags [], labels [], metadata keys [startup-script-url, shutdown-script]", describeInstanceProperties(p))
+	require.Equal(t, 18+len("gs://bucket/startup-script-abc")+15+len("echo shutdown"), metadataSize(p.Metadata))
+}
+
+func TestMergeInstancePropertiesCompressedCloudInit(t *testing.T) {
+	p := &compute.InstanceProperties{}
+	mergeInstanceProperties(p, Deploy{CloudInitPath: "cloud-init.yml", cloudInit: "H4sI", compress: true})
+	require.Equal(t, "tags [], labels [], metadata keys [user-data, user-data-encoding]", describeInstanceProperties(p))
+
+	mergeInstanceProperties(p, Deploy{CloudInitPath: "cloud-init.yml", cloudInit: "#cloud-config"})
+	require.Equal(t, "tags [], labels [], metadata keys [user-data]", describeInstanceProperties(p))
+}
+
+func TestNewClientFromJSONPath(t *testing.T) {
+	_, _, err := NewClientFromJSON("/path/to/missing-creds.json")
+	require.Error(t, err)
+	require.NotContains(t, err.Error(), "missing-creds")
+}
@@ -22,7 +22,21 @@ func formatLog(command string, params map[string]string, value string) string {
 }
 
 func Log(command string, params map[string]string, value string) {
-	fmt.Fprint(os.Stdout, formatLog(command, params, value))
+	fmt.Fprint(os.Stdout, redact(formatLog(command, params, value)))
+}
+
+// isGithubActions returns true if running in Github Actions.
+func isGithubActions() bool {
+	return os.Getenv("GITHUB_ACTIONS") == "true"
+}
+
+// redact removes secrets from logs of local runs. Github Actions masks
+// secrets itself, see LogAddMask.
+func redact(s string) string {
+	if isGithubActions() {
+		return s
+	}
+	return redactSecrets(s)
 }
 
 func LogSetEnv(name, value string) {
@@ -51,7 +65,12 @@ func LogError(message string, params map[string]string) {
 	Log("error", params, message)
 }
 
+// LogAddMask masks value in the logs of Github Actions. Use addSecretMask,
+// which also redacts value in local runs.
 func LogAddMask(value string) {
+	if !isGithubActions() {
+		return // would print the secret
+	}
 	Log("add-mask", nil, value)
 }
 
@@ -60,7 +79,7 @@ func Infof(format string, a ...interface{}) {
 
 	fmt.Fprintf(os.Stdout, "%02d:%02d:%02d] %v\n",
 		int(elapsed.Hours()), int(elapsed.Minutes()), int(elapsed.Seconds()),
-		fmt.Sprintf(format, a...))
+		redact(fmt.Sprintf(format, a...)))
 }
 
 func Fatalf(format string, a ...interface{}) {
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"os"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -12,3 +13,15 @@ func TestFormatLog(t *testing.T) {
 	assert.Equal(t, "::command foo=bar::value\n", formatLog("command", map[string]string{"foo": "bar"}, "value"))
 	assert.Equal(t, "::command abc=def,foo=bar::value\n", formatLog("command", map[string]string{"foo": "bar", "abc": "def"}, "value"))
 }
+
+func TestRedact(t *testing.T) {
+	defer func() { secretValues = make([]string, 0) }()
+	addSecretMask("s3cr3t")
+
+	os.Setenv("GITHUB_ACTIONS", "")
+	assert.Equal(t, "password=***", redact("password=s3cr3t"))
+
+	os.Setenv("GITHUB_ACTIONS", "true")
+	defer os.Unsetenv("GITHUB_ACTIONS")
+	assert.Equal(t, "password=s3cr3t", redact("password=s3cr3t"))
+}
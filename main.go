@@ -2,6 +2,7 @@ package main
 
 import (
 	"os"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -23,16 +24,59 @@ func main() {
 	}
 	defer f.Close()
 
-	c, err := ParseConfig(f)
+	// parse command, defaults to deploy
+	command, args := "deploy", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+
+	// cleanup, teardown and reap don't deploy and only need a light parse
+	parse := ParseConfig
+	switch command {
+	case "cleanup", "teardown", "reap":
+		parse = ParseMaintenanceConfig
+	}
+
+	c, err := parse(f)
 	if err != nil {
 		Fatalf("%v", err)
 	}
 
-	// Start deploy
+	switch command {
+	case "deploy":
+		deployAll(gc, c)
+
+	case "cleanup":
+		if err := RunCleanup(gc, c, args); err != nil {
+			Fatalf("%v", err)
+		}
+
+	case "teardown":
+		if err := RunTeardown(gc, c, args); err != nil {
+			Fatalf("%v", err)
+		}
+
+	case "reap":
+		if err := RunReap(gc, c, args); err != nil {
+			Fatalf("%v", err)
+		}
+
+	default:
+		Fatalf("unknown command '%v'", command)
+	}
+}
+
+func deployAll(gc *GithubActionConfig, c *Config) {
 	var hasErrors uint64
 	var wg sync.WaitGroup
-	wg.Add(len(c.Deploys))
 	for _, deploy := range c.Deploys {
+		// preview deploys only run for pull requests
+		if deploy.Preview.enabled && deploy.Preview.pullRequest == 0 {
+			Infof("%v: Skipped preview deploy, no pull request found", deploy.Name)
+			continue
+		}
+
+		wg.Add(1)
 		go func(deploy Deploy) {
 			defer wg.Done()
 
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	computeBeta "google.golang.org/api/compute/v0.beta"
+	"google.golang.org/api/compute/v1"
+)
+
+const (
+	ReapInstanceGroup    = "instance group"
+	ReapInstanceTemplate = "instance template"
+)
+
+// ReapResult reports what happened to a single expired resource.
+type ReapResult struct {
+	Project string
+	Kind    string
+	Name    string
+	Region  string
+	Expires time.Time
+	Action  string
+	Err     error
+}
+
+func formatExpiresLabel(t time.Time) string {
+	return strconv.FormatInt(t.Unix(), 10)
+}
+
+// parseExpiresLabel returns the expiry from labels or false if the labels
+// have no (valid) expiry label.
+func parseExpiresLabel(labels map[string]string) (time.Time, bool) {
+	v, ok := labels[expiresLabel]
+	if !ok {
+		return time.Time{}, false
+	}
+
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(n, 0).UTC(), true
+}
+
+// selectExpiredResources returns expired instance groups and instance templates.
+// Instance groups have no labels, so an instance group expires with the
+// latest expiry of the instance templates it runs.
+func selectExpiredResources(groups []*computeBeta.InstanceGroupManager, templates []*compute.InstanceTemplate, now time.Time) []ReapResult {
+	expires := make(map[string]time.Time)
+	templateResults := make([]ReapResult, 0)
+
+	for _, it := range templates {
+		if it.Properties == nil {
+			continue
+		}
+		t, ok := parseExpiresLabel(it.Properties.Labels)
+		if !ok {
+			continue
+		}
+		expires[it.Name] = t
+
+		if now.After(t) {
+			templateResults = append(templateResults, ReapResult{Kind: ReapInstanceTemplate, Name: it.Name, Expires: t})
+		}
+	}
+
+	results := make([]ReapResult, 0)
+	for _, ig := range groups {
+		var latest time.Time
+		expired := len(ig.Versions) > 0
+		for _, v := range ig.Versions {
+			t, ok := expires[path.Base(v.InstanceTemplate)]
+			if !ok {
+				expired = false
+				break
+			}
+			if t.After(latest) {
+				latest = t
+			}
+		}
+
+		if expired && now.After(latest) {
+			results = append(results, ReapResult{Kind: ReapInstanceGroup, Name: ig.Name, Region: path.Base(ig.Region), Expires: latest})
+		}
+	}
+
+	// instance groups must be deleted before their instance templates
+	return append(results, templateResults...)
+}
+
+// RunReap deletes expired instance groups and instance templates in all
+// projects referenced by the deploys in config.
+func RunReap(githubActionConfig *GithubActionConfig, config *Config, args []string) error {
+	fs := flag.NewFlagSet("reap", flag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "Print what would be deleted, but don't delete anything.")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	projects, clients, err := NewGoogleClientsByProject(githubActionConfig, config)
+	if err != nil {
+		return err
+	}
+
+	results := make([]ReapResult, 0)
+	hasErrors := false
+	for _, project := range projects {
+		computeService, err := compute.New(clients[project])
+		if err != nil {
+			return err
+		}
+
+		computeBetaService, err := computeBeta.New(clients[project])
+		if err != nil {
+			return err
+		}
+
+		r, err := reapProject(computeService, computeBetaService, project, *dryRun)
+		if err != nil {
+			hasErrors = true
+			LogError(err.Error(), map[string]string{"project": project})
+		}
+		results = append(results, r...)
+	}
+
+	printReapResults(os.Stdout, results)
+
+	for _, r := range results {
+		if r.Err != nil {
+			hasErrors = true
+			LogError(r.Err.Error(), map[string]string{"project": r.Project})
+		}
+	}
+
+	if hasErrors {
+		return fmt.Errorf("reap: failed to delete some expired resources")
+	}
+	return nil
+}
+
+func reapProject(c *compute.Service, cb *computeBeta.Service, project string, dryRun bool) ([]ReapResult, error) {
+	groups, err := ListInstanceGroups(cb, project)
+	if err != nil {
+		return nil, err
+	}
+
+	templates, err := ListInstanceTemplates(c, project)
+	if err != nil {
+		return nil, err
+	}
+
+	results := selectExpiredResources(groups, templates, time.Now())
+	for i := range results {
+		r := &results[i]
+		r.Project = project
+
+		if dryRun {
+			r.Action = CleanupWouldDelete
+			continue
+		}
+
+		switch r.Kind {
+		case ReapInstanceGroup:
+			if _, err := DeleteInstanceGroup(cb, project, r.Region, r.Name); err != nil {
+				r.Action, r.Err = CleanupFailed, err
+			} else {
+				r.Action = CleanupDeleted
+			}
+
+		case ReapInstanceTemplate:
+			r.Action, r.Err = DeleteInstanceTemplate(c, project, r.Name)
+		}
+	}
+
+	return results, nil
+}
+
+func printReapResults(w io.Writer, results []ReapResult) {
+	if len(results) == 0 {
+		fmt.Fprintln(w, "No expired resources to delete.")
+		return
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "PROJECT\tKIND\tNAME\tREGION\tEXPIRED\tACTION")
+	for _, r := range results {
+		region := r.Region
+		if region == "" {
+			region = "-"
+		}
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\t%v\n",
+			r.Project, r.Kind, r.Name, region, r.Expires.Format(time.RFC3339), r.Action)
+	}
+	tw.Flush()
+}
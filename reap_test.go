@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	computeBeta "google.golang.org/api/compute/v0.beta"
+	"google.golang.org/api/compute/v1"
+)
+
+func TestParseExpiresLabel(t *testing.T) {
+	now := time.Date(2020, 10, 10, 12, 0, 0, 0, time.UTC)
+
+	out, ok := parseExpiresLabel(map[string]string{expiresLabel: formatExpiresLabel(now)})
+	require.True(t, ok)
+	assert.Equal(t, now, out)
+
+	_, ok = parseExpiresLabel(map[string]string{expiresLabel: "foo"})
+	assert.False(t, ok)
+
+	_, ok = parseExpiresLabel(nil)
+	assert.False(t, ok)
+}
+
+func TestSelectExpiredResources(t *testing.T) {
+	now := time.Date(2020, 10, 10, 12, 0, 0, 0, time.UTC)
+
+	newTemplate := func(name string, expires *time.Time) *compute.InstanceTemplate {
+		labels := map[string]string{}
+		if expires != nil {
+			labels[expiresLabel] = formatExpiresLabel(*expires)
+		}
+		return &compute.InstanceTemplate{Name: name, Properties: &compute.InstanceProperties{Labels: labels}}
+	}
+	newGroup := func(name string, templates ...string) *computeBeta.InstanceGroupManager {
+		ig := &computeBeta.InstanceGroupManager{Name: name, Region: "https://www.googleapis.com/compute/beta/projects/p/regions/us-central1"}
+		for _, it := range templates {
+			ig.Versions = append(ig.Versions, &computeBeta.InstanceGroupManagerVersion{
+				InstanceTemplate: "https://www.googleapis.com/compute/beta/projects/p/global/instanceTemplates/" + it,
+			})
+		}
+		return ig
+	}
+
+	past := now.Add(-time.Hour)
+	future := now.Add(time.Hour)
+
+	templates := []*compute.InstanceTemplate{
+		newTemplate("expired-1", &past),
+		newTemplate("expired-2", &past),
+		newTemplate("alive", &future),
+		newTemplate("forever", nil),
+	}
+	groups := []*computeBeta.InstanceGroupManager{
+		newGroup("group-expired", "expired-1"),
+		newGroup("group-alive", "expired-2", "alive"),
+		newGroup("group-forever", "forever"),
+		newGroup("group-empty"),
+	}
+
+	out := selectExpiredResources(groups, templates, now)
+	require.Equal(t, []ReapResult{
+		{Kind: ReapInstanceGroup, Name: "group-expired", Region: "us-central1", Expires: past},
+		{Kind: ReapInstanceTemplate, Name: "expired-1", Expires: past},
+		{Kind: ReapInstanceTemplate, Name: "expired-2", Expires: past},
+	}, out)
+}
+
+func TestPrintReapResults(t *testing.T) {
+	expires := time.Date(2020, 10, 10, 12, 0, 0, 0, time.UTC)
+
+	b := &bytes.Buffer{}
+	printReapResults(b, nil)
+	assert.Equal(t, "No expired resources to delete.\n", b.String())
+
+	b.Reset()
+	printReapResults(b, []ReapResult{
+		{Project: "p", Kind: ReapInstanceGroup, Name: "ig-pr-1", Region: "w", Expires: expires, Action: CleanupWouldDelete},
+		{Project: "p", Kind: ReapInstanceTemplate, Name: "t-1", Expires: expires, Action: CleanupWouldDelete},
+	})
+	assert.Equal(t, `PROJECT  KIND               NAME     REGION  EXPIRED               ACTION
+p        instance group     ig-pr-1  w       2020-10-10T12:00:00Z  would delete
+p        instance template  t-1      -       2020-10-10T12:00:00Z  would delete
+`, b.String())
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"google.golang.org/api/googleapi"
+	"gopkg.in/yaml.v2"
+)
+
+const cloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+
+var (
+	// ${{secret:projects/p/secrets/name[/versions/v]}}
+	secretExprRe = regexp.MustCompile(`^secret:(projects/[^/\s]+/secrets/[^/\s]+)(/versions/[^/\s]+)?$`)
+)
+
+// secretValues are all resolved secrets, see redactSecrets.
+var secretValues = make([]string, 0)
+
+type secretResult struct {
+	Value string
+	Err   error
+}
+
+// secretManagerBaseURL returns the Secret Manager API endpoint. Set
+// SECRET_MANAGER_EMULATOR_HOST to use a local stand-in.
+func secretManagerBaseURL() string {
+	host := os.Getenv("SECRET_MANAGER_EMULATOR_HOST")
+	if host == "" {
+		return "https://secretmanager.googleapis.com"
+	}
+	if !strings.HasPrefix(host, "http://") && !strings.HasPrefix(host, "https://") {
+		host = "http://" + host
+	}
+	return strings.TrimSuffix(host, "/")
+}
+
+// AccessSecretVersion returns the payload of a secret version, i.e.
+// projects/p/secrets/db-password/versions/latest.
+func AccessSecretVersion(hc *http.Client, name string) (string, error) {
+	res, err := hc.Get(secretManagerBaseURL() + "/v1/" + name + ":access")
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if err := googleapi.CheckResponse(res); err != nil {
+		return "", err
+	}
+
+	v := struct {
+		Payload struct {
+			Data string `json:"data"`
+		} `json:"payload"`
+	}{}
+	if err := json.NewDecoder(res.Body).Decode(&v); err != nil {
+		return "", err
+	}
+
+	b, err := base64.StdEncoding.DecodeString(v.Payload.Data)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// secretResolver accesses secrets with the creds of deploys or the github
+// action creds. Clients are created on first use. Results are cached by creds
+// and version name, and secrets are masked in logs.
+type secretResolver struct {
+	clients map[string]*http.Client
+	cache   map[secretKey]secretResult
+}
+
+type secretKey struct {
+	Creds string
+	Name  string
+}
+
+func newSecretResolver() *secretResolver {
+	return &secretResolver{
+		clients: make(map[string]*http.Client),
+		cache:   make(map[secretKey]secretResult),
+	}
+}
+
+// Resolve returns the value of the secret version name, accessed with creds
+// or the github action creds, if creds is empty.
+func (r *secretResolver) Resolve(creds, name string) (string, error) {
+	key := secretKey{creds, name}
+	if x, ok := r.cache[key]; ok {
+		return x.Value, x.Err
+	}
+
+	v, err := r.access(creds, name)
+	if err != nil {
+		err = fmt.Errorf("secret '%v': %v", name, err)
+	} else {
+		addSecretMask(v)
+	}
+	r.cache[key] = secretResult{v, err}
+	return v, err
+}
+
+func (r *secretResolver) access(creds, name string) (string, error) {
+	hc, ok := r.clients[creds]
+	if !ok {
+		if creds == "" {
+			client, err := newGithubActionClient(cloudPlatformScope)
+			if err != nil {
+				return "", err
+			}
+			hc = client
+		} else {
+			client, _, err := NewClientFromJSON(creds, cloudPlatformScope)
+			if err != nil {
+				return "", fmt.Errorf("invalid creds: %v", err)
+			}
+			hc = client
+		}
+		r.clients[creds] = hc
+	}
+	return AccessSecretVersion(hc, name)
+}
+
+// newGithubActionClient creates a google client with the github action creds.
+func newGithubActionClient(scopes ...string) (*http.Client, error) {
+	gc, err := ReadGithubActionConfig()
+	if err != nil {
+		return nil, err
+	}
+	hc, _, err := NewClientFromJSON(gc.googleApplicationCredentialsData, scopes...)
+	if err != nil {
+		return nil, fmt.Errorf("invalid github_action.creds: %v", err)
+	}
+	return hc, nil
+}
+
+// minSecretMaskLength is the minimum length of the lines of multi-line
+// secrets, which are masked on their own. Shorter lines like } would mask
+// unrelated output.
+const minSecretMaskLength = 6
+
+// addSecretMask masks the value and each of its lines in logs.
+func addSecretMask(v string) {
+	if strings.TrimSpace(v) == "" {
+		return
+	}
+
+	LogAddMask(v)
+	if strings.Contains(v, "\n") {
+		skipped := 0
+		for _, line := range strings.Split(v, "\n") {
+			switch l := len(strings.TrimSpace(line)); {
+			case l == 0:
+			case l < minSecretMaskLength:
+				skipped++
+			default:
+				LogAddMask(line)
+			}
+		}
+		if skipped > 0 {
+			LogWarning(fmt.Sprintf("%v lines of a multi-line secret are shorter than %v characters and aren't masked on their own", skipped, minSecretMaskLength), nil)
+		}
+	}
+
+	secretValues = append(secretValues, v)
+}
+
+// Vars are variables, either name: value or name: {value: ..., secret: true}.
+// Values of secret vars are masked in logs, see secretVarNames.
+type Vars map[string]string
+
+// UnmarshalYAML allows vars to be a map with value and secret.
+func (v *Vars) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	raw := make(map[string]interface{})
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+
+	if *v == nil {
+		*v = make(Vars)
+	}
+
+	for k, x := range raw {
+		switch x.(type) {
+		case map[interface{}]interface{}:
+			var sv struct {
+				Value  string `yaml:"value"`
+				Secret bool   `yaml:"secret"`
+			}
+			b, err := yaml.Marshal(x)
+			if err != nil {
+				return err
+			}
+			if err := yaml.UnmarshalStrict(b, &sv); err != nil {
+				return fmt.Errorf("vars.%v: %v", k, err)
+			}
+			(*v)[k] = sv.Value
+		case nil:
+			(*v)[k] = ""
+		default:
+			(*v)[k] = fmt.Sprintf("%v", x)
+		}
+	}
+	return nil
+}
+
+// secretVarNames returns the names of vars marked with secret: true.
+func secretVarNames(vars interface{}) map[string]bool {
+	names := make(map[string]bool)
+	m, _ := vars.(map[interface{}]interface{})
+	for k, v := range m {
+		if x, ok := v.(map[interface{}]interface{}); ok && x["secret"] == true {
+			names[fmt.Sprintf("%v", k)] = true
+		}
+	}
+	return names
+}
+
+// UnmarshalYAML records the secret vars of common.
+func (c *Common) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type common Common // avoid recursion
+	if err := unmarshal((*common)(c)); err != nil {
+		return err
+	}
+
+	var raw map[string]interface{}
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+	c.secretVars = secretVarNames(raw["vars"])
+	return nil
+}
+
+// UnmarshalYAML records the secret vars of the deploy.
+func (d *Deploy) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type deploy Deploy // avoid recursion
+	if err := unmarshal((*deploy)(d)); err != nil {
+		return err
+	}
+
+	var raw map[string]interface{}
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+	d.secretVars = secretVarNames(raw["vars"])
+	return nil
+}
+
+// maskCredentials masks the private key, client secret and refresh token of
+// service account or authorized user JSON credentials.
+func maskCredentials(data string) {
+	creds := struct {
+		PrivateKeyID string `json:"private_key_id"`
+		PrivateKey   string `json:"private_key"`
+		ClientSecret string `json:"client_secret"`
+		RefreshToken string `json:"refresh_token"`
+	}{}
+	if err := json.Unmarshal([]byte(data), &creds); err != nil {
+		return
+	}
+
+	for _, v := range []string{creds.PrivateKeyID, creds.PrivateKey, creds.ClientSecret, creds.RefreshToken} {
+		addSecretMask(v)
+	}
+}
+
+// redactSecrets replaces all secret values in s with ***.
+func redactSecrets(s string) string {
+	if len(secretValues) == 0 {
+		return s
+	}
+
+	// replace longer secrets first, in case they contain shorter ones
+	values := append([]string{}, secretValues...)
+	sort.Slice(values, func(i, j int) bool { return len(values[i]) > len(values[j]) })
+	for _, v := range values {
+		s = strings.Replace(s, v, "***", -1)
+	}
+	return s
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"google.golang.org/api/googleapi"
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	// ENC[AES256_GCM,data:...,iv:...,tag:...,type:str]
+	sopsValueRe = regexp.MustCompile(`^ENC\[AES256_GCM,data:([^,]*),iv:([^,]+),tag:([^,]+),type:([a-z]+)\]$`)
+)
+
+// sopsMetadata is the sops key of encrypted files. Only Cloud KMS and age
+// keys are supported.
+type sopsMetadata struct {
+	GCPKMS []struct {
+		ResourceID string `yaml:"resource_id" json:"resource_id"`
+		Enc        string `yaml:"enc" json:"enc"`
+	} `yaml:"gcp_kms" json:"gcp_kms"`
+	Age []struct {
+		Recipient string `yaml:"recipient" json:"recipient"`
+		Enc       string `yaml:"enc" json:"enc"`
+	} `yaml:"age" json:"age"`
+	LastModified     string `yaml:"lastmodified" json:"lastmodified"`
+	MAC              string `yaml:"mac" json:"mac"`
+	MACOnlyEncrypted bool   `yaml:"mac_only_encrypted" json:"mac_only_encrypted"`
+}
+
+// isSopsFile returns true if the YAML or JSON document has a sops key.
+func isSopsFile(v interface{}) bool {
+	switch x := v.(type) {
+	case map[string]interface{}:
+		_, ok := x["sops"]
+		return ok
+	case map[interface{}]interface{}:
+		_, ok := x["sops"]
+		return ok
+	}
+	return false
+}
+
+// decryptSopsFile decrypts a sops YAML or JSON file and returns the
+// flattened variables. The file is refused if the MAC doesn't match, i.e.
+// if values were removed or rolled back. Decrypted values are masked in logs.
+func decryptSopsFile(name string, b []byte, identity string) (map[string]string, error) {
+	var v interface{}
+	var meta struct {
+		Sops *sopsMetadata `yaml:"sops" json:"sops"`
+	}
+
+	// the MAC depends on the order of keys, so decode into yaml.MapSlice
+	if strings.HasSuffix(strings.ToLower(name), ".json") {
+		d := json.NewDecoder(bytes.NewReader(b))
+		d.UseNumber()
+		var err error
+		if v, err = decodeOrderedJSON(d); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(b, &meta); err != nil {
+			return nil, err
+		}
+	} else {
+		var m yaml.MapSlice
+		if err := yaml.Unmarshal(b, &m); err != nil {
+			return nil, err
+		}
+		v = m
+		if err := yaml.Unmarshal(b, &meta); err != nil {
+			return nil, err
+		}
+	}
+
+	if meta.Sops == nil {
+		return nil, fmt.Errorf("missing sops metadata")
+	}
+
+	key, err := sopsDataKey(meta.Sops, identity)
+	if err != nil {
+		return nil, err
+	}
+
+	// remove metadata and decrypt values
+	tree, ok := v.(yaml.MapSlice)
+	if !ok {
+		return nil, fmt.Errorf("expected a map of variables")
+	}
+	values := make(yaml.MapSlice, 0, len(tree))
+	for _, item := range tree {
+		if item.Key != "sops" {
+			values = append(values, item)
+		}
+	}
+
+	hash := sha512.New()
+	v, err = sopsDecryptTree(values, key, nil, func(plaintext string, encrypted bool) {
+		if encrypted || !meta.Sops.MACOnlyEncrypted {
+			hash.Write([]byte(plaintext))
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if meta.Sops.MAC == "" {
+		return nil, fmt.Errorf("missing sops mac")
+	}
+	mac, err := sopsDecryptValue(meta.Sops.MAC, key, meta.Sops.LastModified)
+	if err != nil {
+		return nil, fmt.Errorf("sops mac: %v", err)
+	}
+	if mac != fmt.Sprintf("%X", hash.Sum(nil)) {
+		return nil, fmt.Errorf("sops mac mismatch, the file was modified")
+	}
+
+	return flattenVars(v, "_")
+}
+
+// decodeOrderedJSON decodes the next JSON value. Objects are decoded into
+// yaml.MapSlice to keep the order of keys.
+func decodeOrderedJSON(d *json.Decoder) (interface{}, error) {
+	t, err := d.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	switch t {
+	case json.Delim('{'):
+		m := make(yaml.MapSlice, 0)
+		for d.More() {
+			k, err := d.Token()
+			if err != nil {
+				return nil, err
+			}
+			v, err := decodeOrderedJSON(d)
+			if err != nil {
+				return nil, err
+			}
+			m = append(m, yaml.MapItem{Key: k, Value: v})
+		}
+		_, err := d.Token() // }
+		return m, err
+
+	case json.Delim('['):
+		l := make([]interface{}, 0)
+		for d.More() {
+			v, err := decodeOrderedJSON(d)
+			if err != nil {
+				return nil, err
+			}
+			l = append(l, v)
+		}
+		_, err := d.Token() // ]
+		return l, err
+	}
+
+	if n, ok := t.(json.Number); ok {
+		if i, err := n.Int64(); err == nil {
+			return int(i), nil
+		}
+		return n.Float64()
+	}
+	return t, nil
+}
+
+// sopsDecryptTree decrypts all values in order. The path of map keys is the
+// additional data of the AES-GCM encryption. Every plaintext value is passed
+// to mac, the way sops computes its MAC.
+func sopsDecryptTree(v interface{}, key []byte, path []string, mac func(plaintext string, encrypted bool)) (interface{}, error) {
+	switch x := v.(type) {
+	case yaml.MapSlice:
+		for i, item := range x {
+			d, err := sopsDecryptTree(item.Value, key, append(append([]string{}, path...), fmt.Sprintf("%v", item.Key)), mac)
+			if err != nil {
+				return nil, err
+			}
+			x[i].Value = d
+		}
+		return x, nil
+
+	case []interface{}:
+		for i, v := range x {
+			d, err := sopsDecryptTree(v, key, path, mac)
+			if err != nil {
+				return nil, err
+			}
+			x[i] = d
+		}
+		return x, nil
+
+	case string:
+		if !strings.HasPrefix(x, "ENC[") {
+			mac(x, false) // unencrypted value
+			return x, nil
+		}
+		d, err := sopsDecryptValue(x, key, strings.Join(path, ":")+":")
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", strings.Join(path, "."), err)
+		}
+		addSecretMask(d)
+		mac(d, true)
+		return d, nil
+
+	case bool:
+		if x {
+			mac("True", false)
+		} else {
+			mac("False", false)
+		}
+	case int:
+		mac(strconv.Itoa(x), false)
+	case float64:
+		mac(strconv.FormatFloat(x, 'f', -1, 64), false)
+	}
+
+	return v, nil
+}
+
+// sopsDecryptValue decrypts ENC[AES256_GCM,...] with the data key.
+func sopsDecryptValue(v string, key []byte, aad string) (string, error) {
+	m := sopsValueRe.FindStringSubmatch(v)
+	if m == nil {
+		return "", fmt.Errorf("invalid encrypted value")
+	}
+
+	data, err := base64.StdEncoding.DecodeString(m[1])
+	if err != nil {
+		return "", err
+	}
+	iv, err := base64.StdEncoding.DecodeString(m[2])
+	if err != nil {
+		return "", err
+	}
+	tag, err := base64.StdEncoding.DecodeString(m[3])
+	if err != nil {
+		return "", err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCMWithNonceSize(block, len(iv))
+	if err != nil {
+		return "", err
+	}
+
+	plaintext, err := gcm.Open(nil, iv, append(data, tag...), []byte(aad))
+	if err != nil {
+		return "", fmt.Errorf("decrypt: %v", err)
+	}
+	return string(plaintext), nil
+}
+
+// sopsDataKey decrypts the data key with Cloud KMS or age.
+func sopsDataKey(meta *sopsMetadata, identity string) ([]byte, error) {
+	errs := make([]string, 0)
+
+	for _, k := range meta.GCPKMS {
+		hc, err := newGithubActionClient(cloudPlatformScope)
+		if err != nil {
+			errs = append(errs, err.Error())
+			break
+		}
+		key, err := DecryptKMS(hc, k.ResourceID, k.Enc)
+		if err == nil {
+			return key, nil
+		}
+		errs = append(errs, fmt.Sprintf("gcp_kms '%v': %v", k.ResourceID, err))
+	}
+
+	for _, k := range meta.Age {
+		key, err := decryptAge([]byte(k.Enc), identity)
+		if err == nil {
+			return key, nil
+		}
+		errs = append(errs, fmt.Sprintf("age '%v': %v", k.Recipient, err))
+	}
+
+	if len(errs) == 0 {
+		return nil, fmt.Errorf("no gcp_kms or age key, pgp keys aren't supported")
+	}
+	return nil, fmt.Errorf("can't decrypt data key: %v", strings.Join(errs, ", "))
+}
+
+// cloudKMSBaseURL returns the Cloud KMS API endpoint. Set
+// CLOUDKMS_EMULATOR_HOST to use a local stand-in.
+func cloudKMSBaseURL() string {
+	host := os.Getenv("CLOUDKMS_EMULATOR_HOST")
+	if host == "" {
+		return "https://cloudkms.googleapis.com"
+	}
+	if !strings.HasPrefix(host, "http://") && !strings.HasPrefix(host, "https://") {
+		host = "http://" + host
+	}
+	return strings.TrimSuffix(host, "/")
+}
+
+// DecryptKMS decrypts base64 encoded ciphertext with a Cloud KMS key, i.e.
+// projects/p/locations/global/keyRings/r/cryptoKeys/k.
+func DecryptKMS(hc *http.Client, resourceID, ciphertext string) ([]byte, error) {
+	body, err := json.Marshal(map[string]string{"ciphertext": ciphertext})
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := hc.Post(cloudKMSBaseURL()+"/v1/"+resourceID+":decrypt", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if err := googleapi.CheckResponse(res); err != nil {
+		return nil, err
+	}
+
+	v := struct {
+		Plaintext string `json:"plaintext"`
+	}{}
+	if err := json.NewDecoder(res.Body).Decode(&v); err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(v.Plaintext)
+}
+
+// decryptAge decrypts binary or armored age encrypted data. identity can hold
+// multiple identities, one per line.
+// https://age-encryption.org
+func decryptAge(b []byte, identity string) ([]byte, error) {
+	if strings.TrimSpace(identity) == "" {
+		return nil, fmt.Errorf("missing identity, set identity or SOPS_AGE_KEY")
+	}
+	ids, err := age.ParseIdentities(strings.NewReader(identity))
+	if err != nil {
+		return nil, err
+	}
+
+	var r io.Reader = bytes.NewReader(b)
+	if bytes.HasPrefix(bytes.TrimSpace(b), []byte(armor.Header)) {
+		r = armor.NewReader(bytes.NewReader(bytes.TrimSpace(b)))
+	}
+
+	d, err := age.Decrypt(r, ids...)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(d)
+}
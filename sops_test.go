@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"github.com/stretchr/testify/require"
+)
+
+// sopsEncrypt encrypts a value like sops does.
+func sopsEncrypt(t *testing.T, key []byte, value, aad, typ string) string {
+	block, err := aes.NewCipher(key)
+	require.NoError(t, err)
+	gcm, err := cipher.NewGCMWithNonceSize(block, 32)
+	require.NoError(t, err)
+	iv := make([]byte, 32)
+	_, err = rand.Read(iv)
+	require.NoError(t, err)
+
+	out := gcm.Seal(nil, iv, []byte(value), []byte(aad))
+	data, tag := out[:len(out)-16], out[len(out)-16:]
+	return fmt.Sprintf("ENC[AES256_GCM,data:%v,iv:%v,tag:%v,type:%v]",
+		base64.StdEncoding.EncodeToString(data), base64.StdEncoding.EncodeToString(iv), base64.StdEncoding.EncodeToString(tag), typ)
+}
+
+// sopsMAC returns the encrypted MAC of the plaintext values in order.
+func sopsMAC(t *testing.T, key []byte, lastmodified string, values ...string) string {
+	hash := sha512.New()
+	for _, v := range values {
+		hash.Write([]byte(v))
+	}
+	return sopsEncrypt(t, key, fmt.Sprintf("%X", hash.Sum(nil)), lastmodified, "str")
+}
+
+// ageEncrypt encrypts b for the recipient, optionally armored.
+func ageEncrypt(t *testing.T, recipient age.Recipient, b []byte, armored bool) []byte {
+	var buf bytes.Buffer
+	var dst io.Writer = &buf
+	var a io.WriteCloser
+	if armored {
+		a = armor.NewWriter(&buf)
+		dst = a
+	}
+	w, err := age.Encrypt(dst, recipient)
+	require.NoError(t, err)
+	_, err = w.Write(b)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	if a != nil {
+		require.NoError(t, a.Close())
+	}
+	return buf.Bytes()
+}
+
+func TestDecryptAge(t *testing.T) {
+	id, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	other, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+
+	for _, armored := range []bool{false, true} {
+		b := ageEncrypt(t, id.Recipient(), []byte("DB_PASSWORD=s3cret\n"), armored)
+
+		out, err := decryptAge(b, id.String())
+		require.NoError(t, err)
+		require.Equal(t, "DB_PASSWORD=s3cret\n", string(out))
+
+		// one identity per line, comments are ignored
+		out, err = decryptAge(b, "# created: 2020-10-10\n"+other.String()+"\n"+id.String()+"\n")
+		require.NoError(t, err)
+		require.Equal(t, "DB_PASSWORD=s3cret\n", string(out))
+
+		_, err = decryptAge(b, other.String())
+		require.Error(t, err)
+	}
+
+	_, err = decryptAge([]byte("x"), "")
+	require.EqualError(t, err, "missing identity, set identity or SOPS_AGE_KEY")
+
+	_, err = decryptAge([]byte("x"), "AGE-SECRET-KEY-INVALID")
+	require.Error(t, err)
+}
+
+func TestDecryptSopsFileKMS(t *testing.T) {
+	f, creds, cleanup := withFakeSecretManager(t)
+	defer cleanup()
+
+	os.Setenv("INPUT_CREDS", creds)
+	defer os.Unsetenv("INPUT_CREDS")
+
+	resourceID := "projects/p/locations/global/keyRings/r/cryptoKeys/k"
+	key := make([]byte, 32)
+	rand.Read(key)
+	f.keys[resourceID] = key
+	wrapped := base64.StdEncoding.EncodeToString([]byte("wrapped:" + resourceID))
+
+	lastmodified := "2020-10-10T00:00:00Z"
+	yml := `db:
+  password: ` + sopsEncrypt(t, key, "pa$$word", "db:password:", "str") + `
+  port: ` + sopsEncrypt(t, key, "5432", "db:port:", "int") + `
+  hosts:
+    - ` + sopsEncrypt(t, key, "10.0.0.1", "db:hosts:", "str") + `
+version_unencrypted: 1.2.3
+replicas_unencrypted: 3
+debug_unencrypted: true
+sops:
+  gcp_kms:
+    - resource_id: ` + resourceID + `
+      enc: ` + wrapped + `
+  lastmodified: "` + lastmodified + `"
+  mac: ` + sopsMAC(t, key, lastmodified, "pa$$word", "5432", "10.0.0.1", "1.2.3", "3", "True") + `
+  version: 3.6.1
+`
+
+	m, err := decryptSopsFile("secrets.yml", []byte(yml), "")
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{
+		"db_password":          "pa$$word",
+		"db_port":              "5432",
+		"db_hosts_0":           "10.0.0.1",
+		"version_unencrypted":  "1.2.3",
+		"replicas_unencrypted": "3",
+		"debug_unencrypted":    "true",
+	}, m)
+	require.Contains(t, secretValues, "pa$$word")
+	require.NotContains(t, secretValues, "1.2.3")
+
+	json := "{\n\t\"api\": {\n\t\t\"key\": \"" + sopsEncrypt(t, key, "key-123", "api:key:", "str") + "\",\n\t\t\"port\": 8080\n\t},\n" +
+		"\t\"sops\": {\"gcp_kms\": [{\"resource_id\": \"" + resourceID + "\", \"enc\": \"" + wrapped + "\"}], " +
+		"\"lastmodified\": \"" + lastmodified + "\", \"mac\": \"" + sopsMAC(t, key, lastmodified, "key-123", "8080") + "\"}\n}"
+	m, err = decryptSopsFile("secrets.json", []byte(json), "")
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"api_key": "key-123", "api_port": "8080"}, m)
+
+	// values are bound to their path
+	_, err = decryptSopsFile("secrets.yml", []byte(strings.Replace(yml, "password:", "passwd:", 1)), "")
+	require.Error(t, err)
+
+	// wrong key
+	_, err = decryptSopsFile("secrets.yml", []byte(strings.Replace(yml, "cryptoKeys/k", "cryptoKeys/x", -1)), "")
+	require.Error(t, err)
+
+	// removed and changed values don't match the MAC
+	lines := strings.Split(yml, "\n")
+	_, err = decryptSopsFile("secrets.yml", []byte(strings.Join(append(lines[:3:3], lines[5:]...), "\n")), "")
+	require.EqualError(t, err, "sops mac mismatch, the file was modified")
+	_, err = decryptSopsFile("secrets.yml", []byte(strings.Replace(yml, "replicas_unencrypted: 3", "replicas_unencrypted: 4", 1)), "")
+	require.EqualError(t, err, "sops mac mismatch, the file was modified")
+
+	// MAC is bound to lastmodified
+	_, err = decryptSopsFile("secrets.yml", []byte(strings.Replace(yml, lastmodified, "2020-10-11T00:00:00Z", 1)), "")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "sops mac: decrypt")
+
+	_, err = decryptSopsFile("secrets.yml", []byte(strings.Replace(yml, "  mac: ", "  x: ", 1)), "")
+	require.EqualError(t, err, "missing sops mac")
+
+	_, err = decryptSopsFile("secrets.yml", []byte("a: b\n"), "")
+	require.EqualError(t, err, "missing sops metadata")
+}
+
+func TestDecryptSopsFileAge(t *testing.T) {
+	defer func() { secretValues = make([]string, 0) }()
+
+	id, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+
+	key := make([]byte, 32)
+	rand.Read(key)
+	enc := ageEncrypt(t, id.Recipient(), key, true)
+
+	yml := `api_key: ` + sopsEncrypt(t, key, "key-123", "api_key:", "str") + `
+sops:
+  age:
+    - recipient: ` + id.Recipient().String() + `
+      enc: |
+        ` + strings.Replace(strings.TrimSpace(string(enc)), "\n", "\n        ", -1) + `
+  lastmodified: "2020-10-10T00:00:00Z"
+  mac: ` + sopsMAC(t, key, "2020-10-10T00:00:00Z", "key-123") + `
+`
+
+	m, err := decryptSopsFile("secrets.yml", []byte(yml), id.String())
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"api_key": "key-123"}, m)
+	require.Contains(t, secretValues, "key-123")
+
+	_, err = decryptSopsFile("secrets.yml", []byte(yml), "")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "age '"+id.Recipient().String()+"': missing identity")
+
+	_, err = decryptSopsFile("secrets.yml", []byte("a: b\nsops:\n  pgp: []\n"), "")
+	require.EqualError(t, err, "no gcp_kms or age key, pgp keys aren't supported")
+}
+
+func TestParseConfigEncryptedVarFiles(t *testing.T) {
+	defer func() { secretValues = make([]string, 0) }()
+
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	id, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+
+	// age encrypted .env file
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "prod.env.age"), ageEncrypt(t, id.Recipient(), []byte("DB_PASSWORD=s3cret\nDB_PIN=1234\n"), false), 0644))
+
+	// sops file with age key
+	key := make([]byte, 32)
+	rand.Read(key)
+	yml := `api_key: ` + sopsEncrypt(t, key, "key-123", "api_key:", "str") + `
+sops:
+  age:
+    - recipient: ` + id.Recipient().String() + `
+      enc: ` + strconv.Quote(string(ageEncrypt(t, id.Recipient(), key, true))) + `
+  lastmodified: "2020-10-10T00:00:00Z"
+  mac: ` + sopsMAC(t, key, "2020-10-10T00:00:00Z", "key-123") + `
+`
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "prod.sops.yml"), []byte(yml), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "prod.enc"), []byte(yml), 0644))
+
+	environ = append(environ, "TEST_AGE_IDENTITY="+id.String())
+	defer func() { environ = environ[:len(environ)-1] }()
+
+	config := `
+var_files:
+  - path: ` + filepath.Join(dir, "prod.env.age") + `
+    encrypted: age
+    identity: ${{TEST_AGE_IDENTITY}}
+  - path: ` + filepath.Join(dir, "prod.sops.yml") + `
+    identity: ${{TEST_AGE_IDENTITY}}
+`
+	c, err := ParseConfig(strings.NewReader(config))
+	require.NoError(t, err)
+	require.Equal(t, "s3cret", c.env.Get("db_password"))
+	require.Equal(t, "1234", c.env.Get("db_pin"))
+	require.Equal(t, "key-123", c.env.Get("api_key"))
+	require.Equal(t, "DB=*** PIN=*** API=***", redactSecrets("DB=s3cret PIN=1234 API=key-123"))
+
+	// identity defaults to SOPS_AGE_KEY, file extension isn't YAML, but encrypted is set
+	environ = append(environ, "SOPS_AGE_KEY="+id.String())
+	defer func() { environ = environ[:len(environ)-1] }()
+	c, err = ParseConfig(strings.NewReader("var_files:\n  - path: " + filepath.Join(dir, "prod.enc") + "\n    encrypted: sops\n"))
+	require.NoError(t, err)
+	require.Equal(t, "key-123", c.env.Get("api_key"))
+
+	other, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	_, err = ParseConfig(strings.NewReader(strings.Replace(config, "${{TEST_AGE_IDENTITY}}", other.String(), 1)))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "age: no identity matched any of the recipients")
+
+	_, err = ParseConfig(strings.NewReader("var_files:\n  - path: " + filepath.Join(dir, "prod.enc") + "\n    encrypted: gpg\n"))
+	require.EqualError(t, err, "var_files: "+filepath.Join(dir, "prod.enc")+": encrypted: must be age or sops")
+}
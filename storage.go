@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"google.golang.org/api/googleapi"
+)
+
+// storageScope allows to read and write objects.
+const storageScope = "https://www.googleapis.com/auth/devstorage.read_write"
+
+// storageBaseURL returns the Cloud Storage JSON API endpoint. Set
+// STORAGE_EMULATOR_HOST to use a local stand-in, i.e. fake-gcs-server.
+func storageBaseURL() string {
+	host := os.Getenv("STORAGE_EMULATOR_HOST")
+	if host == "" {
+		return "https://storage.googleapis.com"
+	}
+	if !strings.HasPrefix(host, "http://") && !strings.HasPrefix(host, "https://") {
+		host = "http://" + host
+	}
+	return strings.TrimSuffix(host, "/")
+}
+
+// parseGCSURL parses gs://bucket/prefix.
+func parseGCSURL(u string) (bucket, prefix string, err error) {
+	if !strings.HasPrefix(u, "gs://") {
+		return "", "", fmt.Errorf("must be gs://<bucket>/<prefix>")
+	}
+
+	x := strings.SplitN(strings.TrimPrefix(u, "gs://"), "/", 2)
+	bucket = x[0]
+	if bucket == "" {
+		return "", "", fmt.Errorf("must be gs://<bucket>/<prefix>")
+	}
+	if len(x) == 2 {
+		prefix = strings.Trim(x[1], "/")
+	}
+	return bucket, prefix, nil
+}
+
+// scriptObjectName returns a content addressed object name, so that
+// instances created from older instance templates keep their scripts.
+func scriptObjectName(prefix, key, content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return path.Join(prefix, key+"-"+hex.EncodeToString(sum[:])[:16])
+}
+
+// UploadObject uploads content to bucket, unless the object exists already.
+func UploadObject(hc *http.Client, bucket, name, content string) error {
+	base := storageBaseURL()
+
+	res, err := hc.Get(base + "/storage/v1/b/" + url.PathEscape(bucket) + "/o/" + url.PathEscape(name))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode == http.StatusOK {
+		return nil
+	}
+	if res.StatusCode != http.StatusNotFound {
+		return googleapi.CheckResponse(res)
+	}
+
+	u := base + "/upload/storage/v1/b/" + url.PathEscape(bucket) + "/o?uploadType=media&name=" + url.QueryEscape(name)
+	res, err = hc.Post(u, "text/plain; charset=utf-8", bytes.NewReader([]byte(content)))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	return googleapi.CheckResponse(res)
+}
+
+// UploadScripts uploads startup and shutdown scripts and files to upload_to and sets
+// their gs:// URLs in deploy.
+func UploadScripts(hc *http.Client, deploy *Deploy) error {
+	bucket, prefix, err := parseGCSURL(deploy.UploadTo)
+	if err != nil {
+		return err
+	}
+
+	upload := func(key, content string) (string, error) {
+		name := scriptObjectName(prefix, key, content)
+		if isWindows(deploy) {
+			name += "." + deploy.scriptType // runs the script by its extension
+		}
+		if err := UploadObject(hc, bucket, name, content); err != nil {
+			return "", fmt.Errorf("upload %v to 'gs://%v/%v': %v", key, bucket, name, err)
+		}
+		return "gs://" + bucket + "/" + name, nil
+	}
+
+	// files bundle url is set on parse, because it's part of the startup script
+	if deploy.filesURL != "" {
+		name := strings.TrimPrefix(deploy.filesURL, "gs://"+bucket+"/")
+		if err := UploadObject(hc, bucket, name, deploy.filesArchive); err != nil {
+			return fmt.Errorf("upload files to '%v': %v", deploy.filesURL, err)
+		}
+	}
+
+	if hasStartupScript(deploy) {
+		deploy.startupScriptURL, err = upload(scriptMetadataKey(deploy, "startup"), deploy.startupScript)
+		if err != nil {
+			return err
+		}
+	}
+
+	if deploy.ShutdownScriptPath != "" {
+		deploy.shutdownScriptURL, err = upload(scriptMetadataKey(deploy, "shutdown"), deploy.shutdownScript)
+		if err != nil {
+			return err
+		}
+	}
+
+	if deploy.SpecializeScriptPath != "" {
+		deploy.specializeScriptURL, err = upload(scriptMetadataKey(deploy, "specialize"), deploy.specializeScript)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeStorage is a local stand-in for a Cloud Storage bucket.
+type fakeStorage struct {
+	mu      sync.Mutex
+	objects map[string]string
+	uploads int
+}
+
+func (f *fakeStorage) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch {
+	case r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/storage/v1/b/"):
+		x := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/storage/v1/b/"), "/o/", 2)
+		if _, ok := f.objects[x[0]+"/"+x[1]]; !ok {
+			http.Error(w, `{"error": {"code": 404, "message": "not found"}}`, http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{}`))
+
+	case r.Method == "POST" && strings.HasPrefix(r.URL.Path, "/upload/storage/v1/b/"):
+		bucket := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/upload/storage/v1/b/"), "/o")
+		b, _ := ioutil.ReadAll(r.Body)
+		f.objects[bucket+"/"+r.URL.Query().Get("name")] = string(b)
+		f.uploads++
+		w.Write([]byte(`{}`))
+
+	default:
+		http.Error(w, "unexpected request", http.StatusBadRequest)
+	}
+}
+
+func withFakeStorage(t *testing.T) (*fakeStorage, func()) {
+	f := &fakeStorage{objects: make(map[string]string)}
+	ts := httptest.NewServer(f)
+	os.Setenv("STORAGE_EMULATOR_HOST", ts.URL)
+	return f, func() {
+		os.Unsetenv("STORAGE_EMULATOR_HOST")
+		ts.Close()
+	}
+}
+
+func TestParseGCSURL(t *testing.T) {
+	bucket, prefix, err := parseGCSURL("gs://my-bucket/scripts/")
+	require.NoError(t, err)
+	require.Equal(t, "my-bucket", bucket)
+	require.Equal(t, "scripts", prefix)
+
+	bucket, prefix, err = parseGCSURL("gs://my-bucket")
+	require.NoError(t, err)
+	require.Equal(t, "my-bucket", bucket)
+	require.Equal(t, "", prefix)
+
+	_, _, err = parseGCSURL("s3://my-bucket")
+	require.Error(t, err)
+
+	_, _, err = parseGCSURL("gs:///scripts")
+	require.Error(t, err)
+}
+
+func TestStorageBaseURL(t *testing.T) {
+	require.Equal(t, "https://storage.googleapis.com", storageBaseURL())
+
+	os.Setenv("STORAGE_EMULATOR_HOST", "localhost:4443")
+	defer os.Unsetenv("STORAGE_EMULATOR_HOST")
+	require.Equal(t, "http://localhost:4443", storageBaseURL())
+}
+
+func TestUploadScripts(t *testing.T) {
+	f, done := withFakeStorage(t)
+	defer done()
+
+	d := Deploy{
+		UploadTo:          "gs://my-bucket/scripts",
+		StartupScriptPath: "startup.sh",
+		startupScript:     "echo startup",
+	}
+
+	require.NoError(t, UploadScripts(http.DefaultClient, &d))
+	name := scriptObjectName("scripts", "startup-script", "echo startup")
+	require.Equal(t, "gs://my-bucket/"+name, d.startupScriptURL)
+	require.Equal(t, "", d.shutdownScriptURL)
+	require.Equal(t, "echo startup", f.objects["my-bucket/"+name])
+	require.Equal(t, 1, f.uploads)
+
+	// same content isn't uploaded again
+	require.NoError(t, UploadScripts(http.DefaultClient, &d))
+	require.Equal(t, 1, f.uploads)
+
+	d.startupScript = "echo changed"
+	require.NoError(t, UploadScripts(http.DefaultClient, &d))
+	require.Equal(t, 2, f.uploads)
+	require.NotEqual(t, "gs://my-bucket/"+name, d.startupScriptURL)
+}
+
+func TestUploadScriptsWindows(t *testing.T) {
+	f, done := withFakeStorage(t)
+	defer done()
+
+	d := Deploy{
+		UploadTo:             "gs://my-bucket/scripts",
+		OS:                   "windows",
+		scriptType:           "ps1",
+		StartupScriptPath:    "startup.ps1",
+		startupScript:        "Write-Host startup",
+		SpecializeScriptPath: "specialize.ps1",
+		specializeScript:     "Write-Host specialize",
+	}
+
+	require.NoError(t, UploadScripts(http.DefaultClient, &d))
+	require.True(t, strings.HasSuffix(d.startupScriptURL, ".ps1"), d.startupScriptURL)
+	require.True(t, strings.HasSuffix(d.specializeScriptURL, ".ps1"), d.specializeScriptURL)
+	require.Equal(t, "Write-Host startup", f.objects[strings.TrimPrefix(d.startupScriptURL, "gs://")])
+
+	d.scriptType = "cmd"
+	require.NoError(t, UploadScripts(http.DefaultClient, &d))
+	require.True(t, strings.HasSuffix(d.startupScriptURL, ".cmd"), d.startupScriptURL)
+}
+
+func TestNewGoogleClientStorageScope(t *testing.T) {
+	f, creds, cleanup := withFakeSecretManager(t)
+	defer cleanup()
+
+	deploy := &Deploy{googleApplicationCredentialsData: creds}
+	for _, scopes := range [][]string{nil, {storageScope}} {
+		hc, err := NewGoogleClient(&GithubActionConfig{}, deploy, scopes...)
+		require.NoError(t, err)
+		res, err := hc.Get(os.Getenv("SECRET_MANAGER_EMULATOR_HOST") + "/v1/x:access")
+		require.NoError(t, err)
+		res.Body.Close()
+	}
+
+	require.Equal(t, []string{"https://www.googleapis.com/auth/compute", storageScope}, f.scopes)
+	require.Equal(t, "p", deploy.Project)
+}
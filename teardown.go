@@ -0,0 +1,81 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	computeBeta "google.golang.org/api/compute/v0.beta"
+	"google.golang.org/api/compute/v1"
+)
+
+// RunTeardown deletes the instance groups and instance templates of all
+// preview deploys for a pull request.
+func RunTeardown(githubActionConfig *GithubActionConfig, config *Config, args []string) error {
+	fs := flag.NewFlagSet("teardown", flag.ContinueOnError)
+	pullRequest := fs.Int("pr", 0, "Pull request number. Defaults to preview.pull_request or the pull request from GITHUB_REF.")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	hasErrors := false
+	for _, deploy := range config.Deploys {
+		if !deploy.Preview.enabled {
+			continue
+		}
+
+		if *pullRequest > 0 {
+			deploy.Preview.pullRequest = *pullRequest
+			deploy.InstanceGroup = previewInstanceGroupName(deploy.Preview.instanceGroupBase, *pullRequest)
+		}
+
+		if deploy.Preview.pullRequest == 0 {
+			hasErrors = true
+			LogError("no pull request, set --pr", map[string]string{"name": deploy.Name})
+			continue
+		}
+
+		if err := teardownPreview(githubActionConfig, deploy); err != nil {
+			hasErrors = true
+			LogError(err.Error(), map[string]string{"name": deploy.Name})
+		}
+	}
+
+	if hasErrors {
+		return fmt.Errorf("teardown: failed to delete some preview deploys")
+	}
+	return nil
+}
+
+func teardownPreview(githubActionConfig *GithubActionConfig, deploy Deploy) error {
+	googleClient, err := NewGoogleClient(githubActionConfig, &deploy)
+	if err != nil {
+		return err
+	}
+
+	computeService, err := compute.New(googleClient)
+	if err != nil {
+		return err
+	}
+
+	computeBetaService, err := computeBeta.New(googleClient)
+	if err != nil {
+		return err
+	}
+
+	deleted, err := DeleteInstanceGroup(computeBetaService, deploy.Project, deploy.Region, deploy.InstanceGroup)
+	if err != nil {
+		return err
+	}
+	if deleted {
+		Infof("%v: Deleted preview instance group '%v/%v'", deploy.Name, deploy.Project, deploy.InstanceGroup)
+	} else {
+		Infof("%v: Preview instance group '%v/%v' doesn't exist", deploy.Name, deploy.Project, deploy.InstanceGroup)
+	}
+
+	names, err := DeletePreviewInstanceTemplates(computeService, deploy.Project, deploy.InstanceGroup)
+	for _, name := range names {
+		Infof("%v: Deleted preview instance template '%v/%v'", deploy.Name, deploy.Project, name)
+	}
+	return err
+}
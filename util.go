@@ -1,8 +1,11 @@
 package main
 
 import (
+	"fmt"
 	"regexp"
 	"strconv"
+
+	"gopkg.in/yaml.v2"
 )
 
 // VersionLessThan returns true if a < b
@@ -50,3 +53,37 @@ func extractInts(v string) ([]int, error) {
 
 	return r, nil
 }
+
+// deepCopy copies the exported yaml fields from in to out.
+func deepCopy(in, out interface{}) error {
+	b, err := yaml.Marshal(in)
+	if err != nil {
+		return err
+	}
+	return yaml.Unmarshal(b, out)
+}
+
+// dedupe removes duplicate strings, keeping the first occurrence.
+func dedupe(s []string) []string {
+	seen := make(map[string]bool, len(s))
+	r := make([]string, 0, len(s))
+	for _, x := range s {
+		if seen[x] {
+			continue
+		}
+		seen[x] = true
+		r = append(r, x)
+	}
+	return r
+}
+
+// formatBytes formats n bytes in KB, i.e. 256KB or 1.5KB.
+func formatBytes(n int) string {
+	if n < 1024 {
+		return fmt.Sprintf("%vB", n)
+	}
+	if n%1024 == 0 {
+		return fmt.Sprintf("%vKB", n/1024)
+	}
+	return fmt.Sprintf("%.1fKB", float64(n)/1024)
+}
@@ -71,3 +71,14 @@ func TestExtractInts(t *testing.T) {
 		require.Equal(t, test.expect, out, test.in)
 	}
 }
+
+func TestDedupe(t *testing.T) {
+	require.Equal(t, []string{"a", "b", "c"}, dedupe([]string{"a", "b", "a", "c", "b"}))
+	require.Equal(t, []string{}, dedupe(nil))
+}
+
+func TestFormatBytes(t *testing.T) {
+	require.Equal(t, "512B", formatBytes(512))
+	require.Equal(t, "256KB", formatBytes(256*1024))
+	require.Equal(t, "1.5KB", formatBytes(1536))
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Annotation is a problem found in a script, reported as GitHub annotation.
+type Annotation struct {
+	File    string
+	Line    int
+	Message string
+	Warning bool
+}
+
+func (a Annotation) Error() string {
+	if a.Line > 0 {
+		return fmt.Sprintf("%v:%v: %v", a.File, a.Line, a.Message)
+	}
+	return fmt.Sprintf("%v: %v", a.File, a.Message)
+}
+
+// Log writes the annotation as GitHub workflow command.
+func (a Annotation) Log() {
+	params := map[string]string{"file": a.File}
+	if a.Line > 0 {
+		params["line"] = strconv.Itoa(a.Line)
+	}
+
+	if a.Warning {
+		LogWarning(a.Message, params)
+	} else {
+		LogError(a.Message, params)
+	}
+}
+
+// logAnnotations logs all annotations and returns the first error.
+func logAnnotations(annotations []Annotation) error {
+	var err error
+	for _, a := range annotations {
+		a.Log()
+		if !a.Warning && err == nil {
+			err = a
+		}
+	}
+	return err
+}
+
+// https://cloudinit.readthedocs.io/en/latest/reference/modules.html
+var cloudConfigKeys = map[string]bool{
+	"allow_public_ssh_keys": true, "ansible": true, "apk_repos": true, "apt": true,
+	"apt_pipelining": true, "apt_sources": true, "apt_update": true, "apt_upgrade": true,
+	"autoinstall": true, "bootcmd": true, "byobu_by_default": true,
+	"ca_certs": true, "ca-certs": true, "chef": true, "chpasswd": true,
+	"cloud_config_modules": true, "cloud_final_modules": true, "cloud_init_modules": true,
+	"create_hostname_file": true, "datasource": true, "datasource_list": true, "debug": true,
+	"device_aliases": true, "disable_ec2_metadata": true, "disable_root": true,
+	"disable_root_opts": true, "disk_setup": true, "drivers": true, "final_message": true,
+	"fqdn": true, "fs_setup": true, "groups": true, "growpart": true, "hostname": true,
+	"keyboard": true, "landscape": true, "locale": true, "locale_configfile": true,
+	"lxd": true, "manage_etc_hosts": true, "manage_resolv_conf": true, "mcollective": true,
+	"merge_how": true, "merge_type": true, "mount_default_fields": true, "mounts": true,
+	"no_ssh_fingerprints": true, "ntp": true, "output": true, "package_reboot_if_required": true,
+	"package_update": true, "package_upgrade": true, "packages": true, "password": true,
+	"phone_home": true, "power_state": true, "prefer_fqdn_over_hostname": true,
+	"preserve_hostname": true, "puppet": true, "random_seed": true, "reporting": true,
+	"resize_rootfs": true, "resolv_conf": true, "rh_subscription": true, "rsyslog": true,
+	"runcmd": true, "salt_minion": true, "snap": true, "spacewalk": true, "ssh": true,
+	"ssh_authorized_keys": true, "ssh_deletekeys": true, "ssh_fp_console_blacklist": true,
+	"ssh_genkeytypes": true, "ssh_import_id": true, "ssh_key_console_blacklist": true,
+	"ssh_keys": true, "ssh_publish_hostkeys": true, "ssh_pwauth": true, "ssh_quiet_keygen": true,
+	"swap": true, "system_info": true, "timezone": true, "ubuntu_advantage": true,
+	"ubuntu_pro": true, "updates": true, "user": true, "users": true, "vendor_data": true,
+	"wireguard": true, "write_files": true, "yum_repo_dir": true, "yum_repos": true,
+	"zypper": true,
+}
+
+var yamlErrorLineRe = regexp.MustCompile(`line (\d+): (.*)`)
+
+// validateCloudInit checks that #cloud-config parses as YAML. Unknown
+// top-level keys are warnings, because cloud-init versions support different
+// and deprecated keys. Other cloud-init formats aren't validated.
+func validateCloudInit(file, content string) []Annotation {
+	annotations := make([]Annotation, 0)
+
+	if !strings.HasPrefix(content, "#cloud-config") {
+		return annotations
+	}
+
+	var doc yaml.MapSlice
+	if err := yaml.Unmarshal([]byte(content), &doc); err != nil {
+		a := Annotation{File: file, Message: "invalid cloud-config: " + err.Error()}
+		for _, m := range yamlErrorLineRe.FindAllStringSubmatch(err.Error(), -1) {
+			a.Line, _ = strconv.Atoi(m[1])
+			a.Message = "invalid cloud-config: " + m[2]
+			break
+		}
+		return append(annotations, a)
+	}
+
+	for _, item := range doc {
+		key, ok := item.Key.(string)
+		if !ok || !cloudConfigKeys[key] {
+			k := fmt.Sprintf("%v", item.Key)
+			annotations = append(annotations, Annotation{
+				File:    file,
+				Line:    findLine(content, regexp.MustCompile(`^`+regexp.QuoteMeta(k)+`\s*:`)),
+				Message: fmt.Sprintf("unknown cloud-config key '%v'", k),
+				Warning: true,
+			})
+		}
+	}
+
+	return annotations
+}
+
+// validateDeployScript validates a startup, shutdown or specialize script
+// of the deploy. Variables in the raw file are replaced with a placeholder,
+// so that line numbers match the file and values don't show up in errors.
+func validateDeployScript(dy *Deploy, file, raw string) []Annotation {
+	if isWindows(dy) {
+		return nil // no checks for windows scripts yet
+	}
+
+	content := variableRe.ReplaceAllStringFunc(raw, func(x string) string {
+		if strings.HasPrefix(x, `\$`) {
+			return x
+		}
+		return "x"
+	})
+	return validateScript(file, content)
+}
+
+var shebangRe = regexp.MustCompile(`^#!\s*(\S+)(\s+(\S+))?`)
+
+var shellSyntaxErrorRe = regexp.MustCompile(`line (\d+): (.*)`)
+
+// validateScript checks the shebang of a shell script and runs the shell
+// with -n to check the syntax, if the shell is installed.
+func validateScript(file, content string) []Annotation {
+	annotations := make([]Annotation, 0)
+
+	m := shebangRe.FindStringSubmatch(content)
+	if m == nil {
+		return append(annotations, Annotation{File: file, Line: 1, Message: "missing shebang, i.e. #!/bin/bash, running with bash", Warning: true})
+	}
+
+	shell := path.Base(m[1])
+	if shell == "env" && m[3] != "" {
+		shell = path.Base(m[3])
+	}
+	switch shell {
+	case "sh", "bash", "dash", "zsh", "ksh":
+	default:
+		return annotations // not a shell script
+	}
+
+	shellPath, err := exec.LookPath(shell)
+	if err != nil {
+		return annotations
+	}
+
+	f, err := ioutil.TempFile("", "gce-deploy-action-script")
+	if err != nil {
+		return annotations
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(content)
+	f.Close()
+
+	out, err := exec.Command(shellPath, "-n", f.Name()).CombinedOutput()
+	if err == nil {
+		return annotations
+	}
+
+	found := false
+	for _, line := range strings.Split(string(out), "\n") {
+		if m := shellSyntaxErrorRe.FindStringSubmatch(line); m != nil {
+			n, _ := strconv.Atoi(m[1])
+			annotations = append(annotations, Annotation{File: file, Line: n, Message: shell + ": " + m[2]})
+			found = true
+		}
+	}
+	if !found {
+		annotations = append(annotations, Annotation{File: file, Message: shell + ": " + strings.TrimSpace(string(out))})
+	}
+
+	return annotations
+}
+
+// findLine returns the first line matching re or 0.
+func findLine(content string, re *regexp.Regexp) int {
+	for i, line := range strings.Split(content, "\n") {
+		if re.MatchString(line) {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// findRecordedVarErrors returns the errors recorded in r, while deploy.yml
+// was expanded, prefixed with prefix. Lines are found by the expression.
+// Undefined variables are only reported if strict is true.
+func findRecordedVarErrors(file, content, prefix string, r *varRecorder, strict bool) []Annotation {
+	annotations := make([]Annotation, 0)
+	if r == nil {
+		return annotations
+	}
+
+	seen := make(map[Annotation]bool)
+	for _, e := range r.errs {
+		if _, ok := e.Err.(undefinedVarError); ok && !strict {
+			continue
+		}
+		a := Annotation{
+			File:    file,
+			Line:    findLine(content, regexp.MustCompile(regexp.QuoteMeta(e.Expr))),
+			Message: prefix + e.Err.Error(),
+		}
+		if !seen[a] {
+			seen[a] = true
+			annotations = append(annotations, a)
+		}
+	}
+	return annotations
+}
+
+// findVarErrors finds invalid variable expressions and expressions which
+// fail, i.e. ${{VAR:?message}}, and marks all referenced variables as used.
+// Undefined variables are only reported if strict is true.
+func findVarErrors(file, content string, re *regexp.Regexp, env *Env, used map[string]bool, strict bool) []Annotation {
+	annotations := make([]Annotation, 0)
+	for i, line := range strings.Split(content, "\n") {
+		for _, m := range re.FindAllStringSubmatch(line, -1) {
+			if !strings.HasPrefix(m[0], "$") {
+				continue // escaped
+			}
+
+			e, err := parseVarExpr(m[1])
+			if err != nil {
+				annotations = append(annotations, Annotation{
+					File:    file,
+					Line:    i + 1,
+					Message: fmt.Sprintf("invalid variable '%v': %v", m[0], err),
+				})
+				continue
+			}
+
+			if e.Name != "" {
+				used[strings.ToLower(e.Name)] = true
+			}
+
+			if _, err := e.eval(env); err != nil {
+				if _, ok := err.(undefinedVarError); ok && !strict {
+					continue
+				}
+				annotations = append(annotations, Annotation{File: file, Line: i + 1, Message: err.Error()})
+			}
+		}
+	}
+	return annotations
+}
+
+// findUnusedVars warns about common.vars and deploys.*.vars which are
+// never referenced.
+func findUnusedVars(file, content string, c *Config, used map[string]bool) []Annotation {
+	names := make([]string, 0)
+	for k := range c.Common.Vars {
+		names = append(names, k)
+	}
+	for _, dy := range c.Deploys {
+		for k := range dy.Vars {
+			names = append(names, k)
+		}
+	}
+
+	names = dedupe(names)
+	sort.Strings(names)
+
+	annotations := make([]Annotation, 0)
+	for _, name := range names {
+		if used[strings.ToLower(name)] {
+			continue
+		}
+		annotations = append(annotations, Annotation{
+			File:    file,
+			Line:    findLine(content, regexp.MustCompile(`^\s*`+regexp.QuoteMeta(name)+`\s*:`)),
+			Message: fmt.Sprintf("unused variable '%v'", name),
+			Warning: true,
+		})
+	}
+	return annotations
+}
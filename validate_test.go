@@ -0,0 +1,111 @@
+package main
+
+import (
+	"os/exec"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateCloudInit(t *testing.T) {
+	require.Empty(t, validateCloudInit("c.yml", "#cloud-config\npackages: [curl]\nruncmd:\n  - echo hi\n"))
+
+	// other formats are not validated
+	require.Empty(t, validateCloudInit("c.sh", "#!/bin/bash\n: {\n"))
+
+	a := validateCloudInit("c.yml", "#cloud-config\npackages: [curl]\nfoo: bar\n")
+	require.Len(t, a, 1)
+	require.Equal(t, Annotation{File: "c.yml", Line: 3, Message: "unknown cloud-config key 'foo'", Warning: true}, a[0])
+	require.NoError(t, logAnnotations(a))
+	require.Empty(t, validateCloudInit("c.yml", "#cloud-config\napt_update: true\napt_upgrade: true\n"))
+
+	a = validateCloudInit("c.yml", "#cloud-config\npackages: [curl\nruncmd: []\n")
+	require.Len(t, a, 1)
+	require.Equal(t, "c.yml", a[0].File)
+	require.NotZero(t, a[0].Line)
+	require.Contains(t, a[0].Message, "invalid cloud-config")
+}
+
+func TestValidateScript(t *testing.T) {
+	a := validateScript("s.sh", "echo hi\n")
+	require.Len(t, a, 1)
+	require.True(t, a[0].Warning)
+	require.Equal(t, 1, a[0].Line)
+
+	require.Empty(t, validateScript("s.py", "#!/usr/bin/env python3\nif:\n"))
+
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash not installed")
+	}
+
+	require.Empty(t, validateScript("s.sh", "#!/bin/bash\nif true; then\n  echo hi\nfi\n"))
+
+	a = validateScript("s.sh", "#!/usr/bin/env bash\necho hi\nif true; then\n  echo hi\n")
+	require.NotEmpty(t, a)
+	require.False(t, a[0].Warning)
+	require.Equal(t, "s.sh", a[0].File)
+	require.NotZero(t, a[0].Line)
+}
+
+func TestValidateDeployScript(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash not installed")
+	}
+
+	// line numbers of the raw file, without values
+	a := validateDeployScript(&Deploy{}, "s.sh", "#!/bin/bash\necho \"${{SECRET}}\" \\${{ESCAPED}}\nfi\n")
+	require.NotEmpty(t, a)
+	for _, x := range a {
+		require.Equal(t, 3, x.Line)
+	}
+	require.Contains(t, a[0].Message, "fi")
+
+	require.Empty(t, validateDeployScript(&Deploy{}, "s.sh", "#!/bin/bash\nif ${{CHECK}}; then\n  echo '${{X}}'\nfi\n"))
+	require.Nil(t, validateDeployScript(&Deploy{OS: "windows"}, "s.ps1", "fi\n"))
+}
+
+func TestLogAnnotations(t *testing.T) {
+	require.NoError(t, logAnnotations([]Annotation{{File: "s.sh", Line: 1, Message: "warn", Warning: true}}))
+
+	err := logAnnotations([]Annotation{
+		{File: "s.sh", Line: 1, Message: "warn", Warning: true},
+		{File: "s.sh", Line: 3, Message: "bad"},
+	})
+	require.EqualError(t, err, "s.sh:3: bad")
+}
+
+func TestFindVarErrors(t *testing.T) {
+	vars := map[string]string{"foo": "1"}
+	content := "echo ${{FOO}}\necho ${{BAR:0:1}} \\${{BAZ}} ${{foo}}\necho ${{FOO BAR}} ${{QUX:?is required}} ${{QUX:-ok}}\n"
+
+	used := make(map[string]bool)
+	a := findVarErrors("s.sh", content, variableRe, newEnv(vars), used, false)
+	require.Equal(t, []Annotation{
+		{File: "s.sh", Line: 3, Message: "invalid variable '${{FOO BAR}}': invalid expression 'FOO BAR'"},
+		{File: "s.sh", Line: 3, Message: "QUX: is required"},
+	}, a)
+	require.Equal(t, map[string]bool{"foo": true, "bar": true, "qux": true}, used)
+
+	a = findVarErrors("s.sh", content, variableRe, newEnv(vars), used, true)
+	require.Len(t, a, 3)
+	require.Equal(t, Annotation{File: "s.sh", Line: 2, Message: "undefined variable 'BAR'"}, a[0])
+
+	// windows scripts
+	require.Empty(t, findVarErrors("s.ps1", "Write-Host `${{FOO BAR}} ${env:BAR} C:\\${{FOO}}\n", windowsVariableRe["ps1"], newEnv(vars), used, true))
+	require.Len(t, findVarErrors("s.ps1", "Write-Host\nC:\\${{FOO BAR}}\n", windowsVariableRe["ps1"], newEnv(vars), used, true), 1)
+	require.Empty(t, findVarErrors("s.cmd", "echo ^${{BAR}}\n", windowsVariableRe["cmd"], newEnv(vars), used, true))
+}
+
+func TestFindUnusedVars(t *testing.T) {
+	c := &Config{
+		Common:  Common{Vars: map[string]string{"used": "", "unused_common": ""}},
+		Deploys: []Deploy{{Vars: map[string]string{"Unused": ""}}},
+	}
+	content := "common:\n  vars:\n    used: a\n    unused_common: b\ndeploys:\n  - vars:\n      Unused: c\n"
+
+	a := findUnusedVars("deploy.yml", content, c, map[string]bool{"used": true})
+	require.Equal(t, []Annotation{
+		{File: "deploy.yml", Line: 7, Message: "unused variable 'Unused'", Warning: true},
+		{File: "deploy.yml", Line: 4, Message: "unused variable 'unused_common'", Warning: true},
+	}, a)
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// VarFile is an entry of var_files, either a path or a map.
+type VarFile struct {
+	Path      string `yaml:"path"`
+	Encrypted string `yaml:"encrypted"`
+	Identity  string `yaml:"identity"`
+}
+
+// UnmarshalYAML allows var_files entries to be a path.
+func (f *VarFile) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var path string
+	if err := unmarshal(&path); err == nil {
+		f.Path = path
+		return nil
+	}
+
+	type varFile VarFile // avoid recursion
+	return unmarshal((*varFile)(f))
+}
+
+// parseVarFiles reads var_files and runs var_commands into config vars and
+// adds them to the env of the config. Later files override earlier files,
+// var_commands override var_files. Config vars override ENV and event vars
+// and are overridden by common.vars and deploys.*.vars.
+func parseVarFiles(c *Config) error {
+	c.configVars = make(map[string]string)
+	env := c.env
+
+	vars := make(map[string]string)
+	for i := range c.VarFiles {
+		f := &c.VarFiles[i]
+		f.Path = strings.TrimSpace(expandVars(f.Path, c.env))
+		f.Encrypted = strings.ToLower(strings.TrimSpace(expandVars(f.Encrypted, c.env)))
+		f.Identity = strings.TrimSpace(expandVars(f.Identity, c.env))
+		if f.Identity == "" {
+			f.Identity = c.env.Get("sops_age_key") // set default
+		}
+
+		b, err := downloadOrReadFile(f.Path)
+		if err != nil {
+			return fmt.Errorf("var_files: %v", err)
+		}
+
+		m, err := parseEncryptedVarFile(f, b)
+		if err != nil {
+			return fmt.Errorf("var_files: %v: %v", f.Path, err)
+		}
+		for k, v := range m {
+			vars[strings.ToLower(k)] = v
+		}
+	}
+	c.env = env.Add(vars)
+
+	names := make([]string, 0, len(c.VarCommands))
+	for k := range c.VarCommands {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		cmd := expandVars(c.VarCommands[name], c.env)
+		out, err := runVarCommand(cmd)
+		if err != nil {
+			return fmt.Errorf("var_commands.%v: %v", name, err)
+		}
+		vars[strings.ToLower(name)] = out
+	}
+	c.configVars = vars
+	c.env = env.Add(c.configVars)
+
+	return nil
+}
+
+// parseEncryptedVarFile decrypts age encrypted files and sops files before
+// parsing them. All decrypted values are masked in logs.
+func parseEncryptedVarFile(f *VarFile, b []byte) (map[string]string, error) {
+	switch f.Encrypted {
+	case "":
+	case "age":
+		plaintext, err := decryptAge(b, f.Identity)
+		if err != nil {
+			return nil, fmt.Errorf("age: %v", err)
+		}
+		m, err := parseVarFile(strings.TrimSuffix(f.Path, ".age"), plaintext)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range m {
+			addSecretMask(v)
+		}
+		return m, nil
+	case "sops":
+		return decryptSopsFile(f.Path, b, f.Identity)
+	default:
+		return nil, fmt.Errorf("encrypted: must be age or sops")
+	}
+
+	// detect sops files
+	switch strings.ToLower(path.Ext(f.Path)) {
+	case ".json", ".yml", ".yaml":
+		var v interface{}
+		if yaml.Unmarshal(b, &v) == nil && isSopsFile(v) {
+			return decryptSopsFile(f.Path, b, f.Identity)
+		}
+	}
+
+	return parseVarFile(f.Path, b)
+}
+
+// parseVarFile parses .env, JSON or YAML files, depending on the extension.
+// Nested keys are flattened to A_B_C.
+func parseVarFile(name string, b []byte) (map[string]string, error) {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".json":
+		var v interface{}
+		if err := json.Unmarshal(b, &v); err != nil {
+			return nil, err
+		}
+		return flattenVars(v, "_")
+
+	case ".yml", ".yaml":
+		var v interface{}
+		if err := yaml.Unmarshal(b, &v); err != nil {
+			return nil, err
+		}
+		return flattenVars(v, "_")
+
+	default:
+		return parseDotEnv(b)
+	}
+}
+
+// flattenVars flattens nested maps and lists, i.e. {a: {b: [c]}} to A_B_0=c
+// with sep _.
+func flattenVars(v interface{}, sep string) (map[string]string, error) {
+	m := make(map[string]string)
+	if v == nil {
+		return m, nil
+	}
+
+	var flatten func(prefix string, v interface{})
+	flatten = func(prefix string, v interface{}) {
+		key := func(k string) string {
+			if prefix == "" {
+				return k
+			}
+			return prefix + sep + k
+		}
+
+		switch x := v.(type) {
+		case map[string]interface{}:
+			for k, v := range x {
+				flatten(key(k), v)
+			}
+		case map[interface{}]interface{}:
+			for k, v := range x {
+				flatten(key(fmt.Sprintf("%v", k)), v)
+			}
+		case yaml.MapSlice:
+			for _, item := range x {
+				flatten(key(fmt.Sprintf("%v", item.Key)), item.Value)
+			}
+		case []interface{}:
+			for i, v := range x {
+				flatten(key(strconv.Itoa(i)), v)
+			}
+		case nil:
+			m[prefix] = ""
+		case float64:
+			m[prefix] = strconv.FormatFloat(x, 'f', -1, 64)
+		default:
+			m[prefix] = fmt.Sprintf("%v", x)
+		}
+	}
+
+	switch v.(type) {
+	case map[string]interface{}, map[interface{}]interface{}, yaml.MapSlice:
+		flatten("", v)
+	default:
+		return nil, fmt.Errorf("expected a map of variables")
+	}
+
+	return m, nil
+}
+
+// parseDotEnv parses KEY=VALUE lines. Empty lines, comments and export
+// prefixes are ignored. Values can be quoted.
+func parseDotEnv(b []byte) (map[string]string, error) {
+	m := make(map[string]string)
+	for i, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+
+		x := strings.SplitN(line, "=", 2)
+		if len(x) != 2 || strings.TrimSpace(x[0]) == "" {
+			return nil, fmt.Errorf("line %v: expected KEY=VALUE", i+1)
+		}
+
+		k, v := strings.TrimSpace(x[0]), strings.TrimSpace(x[1])
+		switch {
+		case strings.HasPrefix(v, `"`):
+			u, err := strconv.Unquote(v)
+			if err != nil {
+				return nil, fmt.Errorf("line %v: invalid quoted value", i+1)
+			}
+			v = u
+		case strings.HasPrefix(v, `'`):
+			if len(v) < 2 || !strings.HasSuffix(v, `'`) {
+				return nil, fmt.Errorf("line %v: invalid quoted value", i+1)
+			}
+			v = v[1 : len(v)-1]
+		default:
+			// strip inline comments
+			if j := strings.Index(v, " #"); j >= 0 {
+				v = strings.TrimSpace(v[:j])
+			}
+		}
+		m[k] = v
+	}
+	return m, nil
+}
+
+// runVarCommand runs cmd with sh and returns stdout without trailing newlines.
+func runVarCommand(cmd string) (string, error) {
+	var stderr strings.Builder
+	c := exec.Command("sh", "-c", cmd)
+	c.Stderr = &stderr
+	out, err := c.Output()
+	if err != nil {
+		if s := strings.TrimSpace(stderr.String()); s != "" {
+			return "", fmt.Errorf("%v: %v", err, s)
+		}
+		return "", err
+	}
+	return strings.TrimRight(string(out), "\r\n"), nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseVarFile(t *testing.T) {
+	m, err := parseVarFile("versions.env", []byte(`
+# comment
+APP_VERSION=1.2.3
+export FEATURE_X=true # inline comment
+QUOTED="a b\nc"
+SINGLE='x # y'
+EMPTY=
+`))
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{
+		"APP_VERSION": "1.2.3",
+		"FEATURE_X":   "true",
+		"QUOTED":      "a b\nc",
+		"SINGLE":      "x # y",
+		"EMPTY":       "",
+	}, m)
+
+	m, err = parseVarFile("versions.json", []byte(`{"app": {"version": "1.2.3", "replicas": 3, "ratio": 0.5}, "flags": [true, null]}`))
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{
+		"app_version":  "1.2.3",
+		"app_replicas": "3",
+		"app_ratio":    "0.5",
+		"flags_0":      "true",
+		"flags_1":      "",
+	}, m)
+
+	m, err = parseVarFile("versions.yml", []byte("app:\n  version: 1.2.3\n  replicas: 3\nflags:\n  x: true\n"))
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{
+		"app_version":  "1.2.3",
+		"app_replicas": "3",
+		"flags_x":      "true",
+	}, m)
+
+	m, err = parseVarFile("empty.yaml", []byte(""))
+	require.NoError(t, err)
+	require.Empty(t, m)
+
+	for name, content := range map[string]string{
+		"a.env":  "NOPE",
+		"b.env":  `A="unterminated`,
+		"c.json": `{`,
+		"d.json": `[1, 2]`,
+		"e.yml":  "- a\n- b\n",
+	} {
+		_, err := parseVarFile(name, []byte(content))
+		require.Error(t, err, name)
+	}
+}
+
+func TestRunVarCommand(t *testing.T) {
+	out, err := runVarCommand("echo hello; echo world")
+	require.NoError(t, err)
+	require.Equal(t, "hello\nworld", out)
+
+	_, err = runVarCommand("echo oops >&2; exit 3")
+	require.EqualError(t, err, "exit status 3: oops")
+}
+
+func TestParseConfigVarFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "a.env"), []byte("VF_ENV=file\nVF_FILE=a\nVF_COMMON=file\nVF_DEPLOY=file\n"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "b.json"), []byte(`{"vf": {"file": "b"}}`), 0644))
+
+	environ = append(environ, "VF_ENV=env", "VF_ONLY_ENV=env")
+
+	config := `
+var_files:
+  - ` + filepath.Join(dir, "a.env") + `
+  - ` + filepath.Join(dir, "b.json") + `
+var_commands:
+  vf_command: echo ${{VF_FILE}}-cmd
+
+common:
+  vars:
+    vf_common: common
+    vf_deploy: common
+
+deploys:
+  - name: test
+    region: w
+    instance_group: x
+    instance_template_base: y
+    instance_template: z-${{VF_FILE}}
+    labels:
+      env: ${{VF_ENV}}-${{VF_ONLY_ENV}}
+      cmd: ${{VF_COMMAND}}
+    vars:
+      vf_deploy: deploy
+`
+
+	c, err := ParseConfig(strings.NewReader(config))
+	require.NoError(t, err)
+
+	d := c.Deploys[0]
+	require.Equal(t, "z-b", d.InstanceTemplate)
+	require.Equal(t, "file-env", d.Labels["env"])
+	require.Equal(t, "b-cmd", d.Labels["cmd"])
+
+	env := d.env.With(d.Vars)
+	require.Equal(t, "file", env.Get("vf_env"))
+	require.Equal(t, "common", env.Get("vf_common"))
+	require.Equal(t, "deploy", env.Get("vf_deploy"))
+
+	_, err = ParseConfig(strings.NewReader("var_files: [{path: " + filepath.Join(dir, "missing.env") + "}]\n"))
+	require.Error(t, err)
+
+	_, err = ParseConfig(strings.NewReader("var_commands:\n  x: exit 1\n"))
+	require.EqualError(t, err, "var_commands.x: exit status 1")
+}
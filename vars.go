@@ -0,0 +1,306 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// variable expressions look like:
+//
+//	${{VAR}}
+//	${{VAR:position[:length]}}
+//	${{VAR:-default}}
+//	${{VAR:?error message}}
+//	${{VAR | lower | replace "/" "-" | trunc 20}}
+//	${{now "2006-01-02"}}
+//	${{event.release.tag_name}}
+//	${{secret:projects/p/secrets/name/versions/latest}}
+var (
+	varNameRe = regexp.MustCompile(`^([a-zA-Z]([a-zA-Z0-9-_]+[a-zA-Z0-9]|[a-zA-Z0-9]*)(\.[a-zA-Z0-9-_]+)*)(:(\d+)(:(\d+))?|:-(.*)|:\?(.*))?$`)
+)
+
+// varExpr is a parsed variable expression.
+type varExpr struct {
+	Name     string
+	Substr   bool
+	From     int
+	Length   int // -1 for the rest of the string
+	Default  *string
+	Required *string
+	Head     *varCall // function without input, i.e. now
+	Secret   string   // secret version name
+	Funcs    []varCall
+}
+
+type varCall struct {
+	Name string
+	Args []string
+}
+
+// undefinedVarError is returned if a variable isn't defined and has no default.
+type undefinedVarError struct {
+	Name string
+}
+
+func (e undefinedVarError) Error() string {
+	return fmt.Sprintf("undefined variable '%v'", e.Name)
+}
+
+// varFuncs are the functions available in variable expressions. The first
+// argument is the input from the pipe.
+var varFuncs = map[string]struct {
+	Args int
+	Func func(in string, args []string) (string, error)
+}{
+	"lower": {0, func(in string, args []string) (string, error) {
+		return strings.ToLower(in), nil
+	}},
+	"upper": {0, func(in string, args []string) (string, error) {
+		return strings.ToUpper(in), nil
+	}},
+	"replace": {2, func(in string, args []string) (string, error) {
+		return strings.Replace(in, args[0], args[1], -1), nil
+	}},
+	"trunc": {1, func(in string, args []string) (string, error) {
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n < 0 {
+			return "", fmt.Errorf("invalid length '%v'", args[0])
+		}
+		return truncate(in, n), nil
+	}},
+	"sha256": {0, func(in string, args []string) (string, error) {
+		h := sha256.Sum256([]byte(in))
+		return hex.EncodeToString(h[:]), nil
+	}},
+	"base64": {0, func(in string, args []string) (string, error) {
+		return base64.StdEncoding.EncodeToString([]byte(in)), nil
+	}},
+	"gce_name": {0, func(in string, args []string) (string, error) {
+		return gceName(in)
+	}},
+}
+
+// parseVarExpr parses the expression between ${{ and }}.
+func parseVarExpr(expr string) (*varExpr, error) {
+	parts, err := splitVarExpr(expr, '|')
+	if err != nil {
+		return nil, err
+	}
+
+	e := &varExpr{}
+
+	head := strings.TrimSpace(parts[0])
+	if m := secretExprRe.FindStringSubmatch(head); m != nil {
+		e.Secret = m[1] + m[2]
+		if m[2] == "" {
+			e.Secret += "/versions/latest"
+		}
+	} else if m := varNameRe.FindStringSubmatch(head); m != nil {
+		e.Name = m[1]
+		switch {
+		case m[5] != "":
+			e.Substr = true
+			e.From, _ = strconv.Atoi(m[5])
+			e.Length = -1
+			if m[7] != "" {
+				e.Length, _ = strconv.Atoi(m[7])
+			}
+		case strings.HasPrefix(m[4], ":-"):
+			e.Default = &m[8]
+		case strings.HasPrefix(m[4], ":?"):
+			e.Required = &m[9]
+		}
+	} else {
+		call, err := parseVarCall(head)
+		if err != nil {
+			return nil, err
+		}
+		if call.Name != "now" {
+			if _, ok := varFuncs[call.Name]; ok {
+				return nil, fmt.Errorf("function '%v' needs an input, i.e. ${{VAR | %v}}", call.Name, call.Name)
+			}
+			return nil, fmt.Errorf("invalid expression '%v'", head)
+		}
+		if len(call.Args) != 1 {
+			return nil, fmt.Errorf("function 'now' needs a layout, i.e. now \"2006-01-02\"")
+		}
+		e.Head = call
+	}
+
+	for _, p := range parts[1:] {
+		call, err := parseVarCall(p)
+		if err != nil {
+			return nil, err
+		}
+		f, ok := varFuncs[call.Name]
+		if !ok {
+			return nil, fmt.Errorf("unknown function '%v'", call.Name)
+		}
+		if len(call.Args) != f.Args {
+			return nil, fmt.Errorf("function '%v' needs %v arguments, got %v", call.Name, f.Args, len(call.Args))
+		}
+		e.Funcs = append(e.Funcs, *call)
+	}
+
+	return e, nil
+}
+
+// parseVarCall parses a function call, i.e. replace "/" "-".
+func parseVarCall(s string) (*varCall, error) {
+	fields, err := splitVarExpr(s, ' ')
+	if err != nil {
+		return nil, err
+	}
+
+	args := make([]string, 0)
+	for _, f := range fields {
+		if f == "" {
+			continue
+		}
+		if strings.HasPrefix(f, `"`) {
+			u, err := strconv.Unquote(f)
+			if err != nil {
+				return nil, fmt.Errorf("invalid string %v", f)
+			}
+			f = u
+		}
+		args = append(args, f)
+	}
+
+	if len(args) == 0 {
+		return nil, fmt.Errorf("empty expression")
+	}
+	return &varCall{Name: args[0], Args: args[1:]}, nil
+}
+
+// splitVarExpr splits s at sep, unless sep is quoted.
+func splitVarExpr(s string, sep rune) ([]string, error) {
+	parts := make([]string, 0)
+	start, quoted, escaped := 0, false, false
+	for i, r := range s {
+		switch {
+		case escaped:
+			escaped = false
+		case r == '\\' && quoted:
+			escaped = true
+		case r == '"':
+			quoted = !quoted
+		case r == sep && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + utf8.RuneLen(r)
+		}
+	}
+	if quoted {
+		return nil, fmt.Errorf("unterminated string in '%v'", strings.TrimSpace(s))
+	}
+	return append(parts, s[start:]), nil
+}
+
+// eval evaluates the expression with the variables of env.
+func (e *varExpr) eval(env *Env) (string, error) {
+	var v string
+
+	if e.Secret != "" {
+		x, err := env.resolveSecret(e.Secret)
+		if err != nil {
+			return "", err
+		}
+		v = x
+	} else if e.Head != nil {
+		v = startTime.UTC().Format(e.Head.Args[0])
+	} else {
+		x, ok := env.Lookup(e.Name)
+		switch {
+		case e.Default != nil:
+			if x == "" {
+				x = *e.Default
+			}
+		case e.Required != nil:
+			if x == "" {
+				msg := *e.Required
+				if msg == "" {
+					msg = "required"
+				}
+				return "", fmt.Errorf("%v: %v", e.Name, msg)
+			}
+		case !ok:
+			return "", undefinedVarError{e.Name}
+		}
+
+		if e.Substr {
+			x = substr(x, e.From, e.Length)
+		}
+		v = x
+	}
+
+	for _, call := range e.Funcs {
+		out, err := varFuncs[call.Name].Func(v, call.Args)
+		if err != nil {
+			return "", fmt.Errorf("%v: %v", call.Name, err)
+		}
+		v = out
+	}
+
+	return v, nil
+}
+
+// evalVar parses and evaluates the expression between ${{ and }}.
+func evalVar(expr string, env *Env) (string, error) {
+	e, err := parseVarExpr(expr)
+	if err != nil {
+		return "", err
+	}
+	return e.eval(env)
+}
+
+// substr returns length characters of s starting at from. Out of range
+// positions return an empty or shorter string.
+func substr(s string, from, length int) string {
+	r := []rune(s)
+	if from >= len(r) {
+		return ""
+	}
+	r = r[from:]
+	if length >= 0 && length < len(r) {
+		r = r[:length]
+	}
+	return string(r)
+}
+
+// truncate returns the first n characters of s.
+func truncate(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:n])
+}
+
+var (
+	gceNameInvalidRe = regexp.MustCompile(`[^a-z0-9-]+`)
+	gceNameDashesRe  = regexp.MustCompile(`-+`)
+)
+
+// gceName converts s into a valid GCE resource name, which is lowercase,
+// starts with a letter, doesn't end with a dash and has at most 63 characters.
+// https://cloud.google.com/compute/docs/naming-resources
+func gceName(s string) (string, error) {
+	n := strings.ToLower(s)
+	n = gceNameInvalidRe.ReplaceAllString(n, "-")
+	n = gceNameDashesRe.ReplaceAllString(n, "-")
+	n = strings.TrimLeft(n, "-0123456789")
+	if len(n) > 63 {
+		n = n[:63]
+	}
+	n = strings.TrimRight(n, "-")
+
+	if n == "" {
+		return "", fmt.Errorf("'%v' can't be converted to a name", s)
+	}
+	return n, nil
+}
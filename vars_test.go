@@ -0,0 +1,145 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEvalVar(t *testing.T) {
+	vars := map[string]string{
+		"foo":    "abcABC",
+		"empty":  "",
+		"branch": "Feature/My_Branch",
+
+		"event.release.tag_name": "v1.2.3",
+	}
+
+	table := []struct {
+		expr   string
+		expect string
+	}{
+		{"foo", "abcABC"},
+		{" FOO ", "abcABC"},
+		{"foo:2", "cABC"},
+		{"foo:2:2", "cA"},
+		{"foo:10", ""},
+		{"foo:4:10", "BC"},
+		{"foo:6:1", ""},
+		{"missing:-default value", "default value"},
+		{"empty:-default", "default"},
+		{"foo:-default", "abcABC"},
+		{"missing:-", ""},
+		{"foo:?required", "abcABC"},
+		{"foo | lower", "abcabc"},
+		{"foo|upper", "ABCABC"},
+		{`foo | replace "abc" "x"`, "xABC"},
+		{`foo | replace "|" " "`, "abcABC"},
+		{"foo | trunc 3", "abc"},
+		{"foo | trunc 30", "abcABC"},
+		{"foo | base64", "YWJjQUJD"},
+		{"branch | gce_name", "feature-my-branch"},
+		{"event.release.tag_name:1", "1.2.3"},
+		{"Event.Release.Tag_Name | upper", "V1.2.3"},
+		{`branch | replace "/" "-" | lower | trunc 7`, "feature"},
+		{`missing:-Hello World | gce_name`, "hello-world"},
+	}
+
+	for _, test := range table {
+		out, err := evalVar(test.expr, newEnv(vars))
+		require.NoError(t, err, test.expr)
+		assert.Equal(t, test.expect, out, test.expr)
+	}
+
+	out, err := evalVar("foo | sha256", newEnv(vars))
+	require.NoError(t, err)
+	require.Equal(t, "5d59ec3d67721abcf3e05cd9859435b366a08eac6d7caa9dded371d490b5b4cf", out)
+	short, err := evalVar("foo | sha256 | trunc 7", newEnv(vars))
+	require.NoError(t, err)
+	require.Equal(t, out[:7], short)
+
+	out, err = evalVar(`now "2006-01-02"`, newEnv(vars))
+	require.NoError(t, err)
+	require.Equal(t, startTime.UTC().Format("2006-01-02"), out)
+
+	for expr, msg := range map[string]string{
+		"missing":                "undefined variable 'missing'",
+		"missing | lower":        "undefined variable 'missing'",
+		"missing:?is required":   "missing: is required",
+		"empty:?":                "empty: required",
+		"foo | nope":             "unknown function 'nope'",
+		"foo | trunc":            "function 'trunc' needs 1 arguments, got 0",
+		"foo | trunc x":          "trunc: invalid length 'x'",
+		`foo | replace "a`:       `unterminated string in 'foo | replace "a'`,
+		"lower":                  "undefined variable 'lower'",
+		"lower foo":              "function 'lower' needs an input, i.e. ${{VAR | lower}}",
+		"now":                    "undefined variable 'now'",
+		"now 1 2":                `function 'now' needs a layout, i.e. now "2006-01-02"`,
+		"1foo":                   "invalid expression '1foo'",
+		"event.":                 "invalid expression 'event.'",
+		"empty:-123 | gce_name":  "gce_name: '123' can't be converted to a name",
+		"foo:1:2:3":              "invalid expression 'foo:1:2:3'",
+		"":                       "empty expression",
+		"foo |":                  "empty expression",
+		`foo | replace "a" "b" `: "",
+	} {
+		_, err := evalVar(expr, newEnv(vars))
+		if msg == "" {
+			require.NoError(t, err, expr)
+			continue
+		}
+		require.EqualError(t, err, msg, expr)
+	}
+}
+
+func TestExpandVarsFunctions(t *testing.T) {
+	vars := map[string]string{"ref": "refs/heads/Main", "sha": "abc"}
+
+	in := `${{ REF | replace "refs/heads/" "" | lower }}-${{SHA:0:100}}-${{TAG:-latest}} ${{ 1 }} \${{ REF | upper }}`
+	require.Equal(t, `main-abc-latest ${{ 1 }} \${{ REF | upper }}`, expandVars(in, newEnv(vars)))
+
+	// errors and undefined variables expand to an empty string
+	require.Equal(t, "--", expandVars("-${{TAG:?required}}-${{TAG | lower}}", newEnv(vars)))
+}
+
+func TestSubstr(t *testing.T) {
+	require.Equal(t, "abc", substr("abc", 0, -1))
+	require.Equal(t, "", substr("abc", 3, -1))
+	require.Equal(t, "", substr("abc", 7, 3))
+	require.Equal(t, "c", substr("abc", 2, 3))
+	require.Equal(t, "", substr("abc", 1, 0))
+	require.Equal(t, "é", substr("héllo", 1, 1))
+	require.Equal(t, "llo", substr("héllo", 2, -1))
+}
+
+func TestGCEName(t *testing.T) {
+	table := []struct {
+		in, expect string
+	}{
+		{"my-app", "my-app"},
+		{"My App", "my-app"},
+		{"feature/ABC_123--x", "feature-abc-123-x"},
+		{"123-app", "app"},
+		{"-app-", "app"},
+		{"äpp", "pp"},
+	}
+	for _, test := range table {
+		out, err := gceName(test.in)
+		require.NoError(t, err, test.in)
+		assert.Equal(t, test.expect, out, test.in)
+	}
+
+	long := strings.Repeat("a", 70)
+	out, err := gceName(long[:62] + "-bcd")
+	require.NoError(t, err)
+	require.Equal(t, long[:62], out)
+
+	out, err = gceName(long)
+	require.NoError(t, err)
+	require.Len(t, out, 63)
+
+	_, err = gceName("123")
+	require.Error(t, err)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var (
+	// Windows scripts don't treat \ as escape character, because it's the
+	// path separator. PowerShell scripts use ` and cmd/bat scripts use ^.
+	windowsVariableRe = map[string]*regexp.Regexp{
+		"ps1": regexp.MustCompile("`?" + variablePattern),
+		"cmd": regexp.MustCompile(`\^?` + variablePattern),
+		"bat": regexp.MustCompile(`\^?` + variablePattern),
+	}
+)
+
+// parseScriptType validates os and script_type. script_type defaults to ps1
+// on windows and a windows script_type implies os windows.
+func parseScriptType(dy *Deploy) error {
+	dy.OS = strings.ToLower(strings.TrimSpace(expandVars(dy.OS, dy.env)))
+	dy.ScriptType = strings.ToLower(strings.TrimSpace(expandVars(dy.ScriptType, dy.env)))
+
+	switch dy.ScriptType {
+	case "":
+	case "sh":
+		if dy.OS == "windows" {
+			return fmt.Errorf("script_type: 'sh' is not supported on windows")
+		}
+	case "ps1", "cmd", "bat":
+		if dy.OS == "linux" {
+			return fmt.Errorf("script_type: '%v' is not supported on linux", dy.ScriptType)
+		}
+		dy.OS = "windows"
+	default:
+		return fmt.Errorf("script_type: must be sh, ps1, cmd or bat")
+	}
+
+	switch dy.OS {
+	case "", "linux":
+		dy.OS = "linux" // set default
+		dy.scriptType = "sh"
+	case "windows":
+		dy.scriptType = dy.ScriptType
+		if dy.scriptType == "" {
+			dy.scriptType = "ps1" // set default
+		}
+	default:
+		return fmt.Errorf("os: must be linux or windows")
+	}
+
+	if dy.SpecializeScriptPath != "" && !isWindows(dy) {
+		return fmt.Errorf("specialize_script: requires os windows")
+	}
+
+	if isWindows(dy) {
+		if dy.Files != nil {
+			return fmt.Errorf("files: is not supported on windows")
+		}
+		if dy.Container != nil {
+			return fmt.Errorf("container: is not supported on windows")
+		}
+		if hasCloudInit(dy) {
+			return fmt.Errorf("cloud_init: is not supported on windows")
+		}
+	}
+
+	return nil
+}
+
+// isWindows returns true if the deploy targets windows images.
+func isWindows(dy *Deploy) bool {
+	return dy.OS == "windows"
+}
+
+// scriptMetadataKey returns the metadata key of a startup, shutdown or
+// specialize script, i.e. startup-script or windows-startup-script-ps1.
+func scriptMetadataKey(dy *Deploy, kind string) string {
+	if !isWindows(dy) {
+		return kind + "-script"
+	}
+	if kind == "specialize" {
+		return "sysprep-specialize-script-" + dy.scriptType
+	}
+	return "windows-" + kind + "-script-" + dy.scriptType
+}
+
+// scriptURLMetadataKey returns the metadata key of an uploaded startup,
+// shutdown or specialize script, i.e. startup-script-url.
+func scriptURLMetadataKey(dy *Deploy, kind string) string {
+	if !isWindows(dy) {
+		return kind + "-script-url"
+	}
+	if kind == "specialize" {
+		return "sysprep-specialize-script-url"
+	}
+	return "windows-" + kind + "-script-url"
+}
+
+// expandScriptVars expands variables in the content of a script. Errors
+// aren't recorded, but reported with their line by findVarErrors.
+func expandScriptVars(dy *Deploy, str string) string {
+	env := dy.env.With(dy.Vars).Record(nil)
+	if !isWindows(dy) {
+		return expandVars(str, env)
+	}
+	return expandWindowsVars(str, dy.scriptType, env)
+}
+
+// scriptVariableRe returns the regexp matching variables in scripts.
+func scriptVariableRe(dy *Deploy) *regexp.Regexp {
+	if !isWindows(dy) {
+		return variableRe
+	}
+	return windowsVariableRe[dy.scriptType]
+}
+
+// expandWindowsVars replaces ${{VAR}} in windows scripts. Everything else,
+// i.e. PowerShell's $var, ${var} or $(...), is left untouched.
+func expandWindowsVars(str, scriptType string, env *Env) string {
+	re := windowsVariableRe[scriptType]
+	return re.ReplaceAllStringFunc(str, func(x string) string {
+		if strings.HasPrefix(x, "`") || strings.HasPrefix(x, "^") {
+			return x
+		}
+		return expandVar(x, env)
+	})
+}
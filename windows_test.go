@@ -0,0 +1,122 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/compute/v1"
+)
+
+func TestParseScriptType(t *testing.T) {
+	table := []struct {
+		os, scriptType   string
+		expectOS, expect string
+	}{
+		{"", "", "linux", "sh"},
+		{"linux", "sh", "linux", "sh"},
+		{"windows", "", "windows", "ps1"},
+		{"Windows", "cmd", "windows", "cmd"},
+		{"", "bat", "windows", "bat"},
+		{"", "ps1", "windows", "ps1"},
+	}
+
+	for _, test := range table {
+		d := Deploy{OS: test.os, ScriptType: test.scriptType}
+		require.NoError(t, parseScriptType(&d), test)
+		assert.Equal(t, test.expectOS, d.OS, test)
+		assert.Equal(t, test.expect, d.scriptType, test)
+	}
+
+	for _, d := range []Deploy{
+		{OS: "mac"},
+		{ScriptType: "py"},
+		{OS: "windows", ScriptType: "sh"},
+		{OS: "linux", ScriptType: "ps1"},
+		{SpecializeScriptPath: "specialize.ps1"},
+		{OS: "windows", Files: &Files{Dir: "files"}},
+		{OS: "windows", Container: &Container{Image: "nginx"}},
+		{OS: "windows", CloudInitPath: "cloud-init.yml"},
+	} {
+		require.Error(t, parseScriptType(&d), d)
+	}
+}
+
+func TestScriptMetadataKey(t *testing.T) {
+	linux := &Deploy{OS: "linux", scriptType: "sh"}
+	assert.Equal(t, "startup-script", scriptMetadataKey(linux, "startup"))
+	assert.Equal(t, "shutdown-script-url", scriptURLMetadataKey(linux, "shutdown"))
+
+	windows := &Deploy{OS: "windows", scriptType: "ps1"}
+	assert.Equal(t, "windows-startup-script-ps1", scriptMetadataKey(windows, "startup"))
+	assert.Equal(t, "windows-shutdown-script-ps1", scriptMetadataKey(windows, "shutdown"))
+	assert.Equal(t, "sysprep-specialize-script-ps1", scriptMetadataKey(windows, "specialize"))
+	assert.Equal(t, "windows-startup-script-url", scriptURLMetadataKey(windows, "startup"))
+	assert.Equal(t, "sysprep-specialize-script-url", scriptURLMetadataKey(windows, "specialize"))
+
+	windows.scriptType = "cmd"
+	assert.Equal(t, "windows-startup-script-cmd", scriptMetadataKey(windows, "startup"))
+}
+
+func TestExpandWindowsVars(t *testing.T) {
+	vars := map[string]string{"version": "v1.2.3", "dir": "app"}
+
+	ps1 := "$v = \"${{VERSION}}\"\n" +
+		"$env:PATH = \"C:\\${{DIR}};$env:PATH\"\n" +
+		"${x} = $($v) + ${env:FOO}\n" +
+		"Write-Host `${{VERSION}}\n"
+	require.Equal(t, "$v = \"v1.2.3\"\n"+
+		"$env:PATH = \"C:\\app;$env:PATH\"\n"+
+		"${x} = $($v) + ${env:FOO}\n"+
+		"Write-Host `${{VERSION}}\n", expandWindowsVars(ps1, "ps1", newEnv(vars)))
+
+	cmd := "set V=${{VERSION}}\r\ncd C:\\${{DIR}}\r\necho ^${{VERSION}} %PATH%\r\n"
+	require.Equal(t, "set V=v1.2.3\r\ncd C:\\app\r\necho ^${{VERSION}} %PATH%\r\n", expandWindowsVars(cmd, "cmd", newEnv(vars)))
+}
+
+func TestParseConfigWindows(t *testing.T) {
+	tmpFile, err := ioutil.TempFile("", "")
+	require.NoError(t, err)
+	tmpFile.WriteString("Write-Host \"${{WINDOWS_VERSION}}\" $env:COMPUTERNAME C:\\${{WINDOWS_VERSION}}\n")
+	tmpFile.Close()
+	defer os.Remove(tmpFile.Name())
+
+	config := `
+common:
+  os: windows
+
+deploys:
+  - name: test
+    region: w
+    instance_group: x
+    instance_template_base: y
+    instance_template: z
+    startup_script: ` + tmpFile.Name() + `
+    specialize_script: ` + tmpFile.Name() + `
+    vars:
+      windows_version: v1
+`
+
+	c, err := ParseConfig(strings.NewReader(config))
+	require.NoError(t, err)
+
+	d := c.Deploys[0]
+	require.Equal(t, "ps1", d.scriptType)
+	require.Equal(t, "Write-Host \"v1\" $env:COMPUTERNAME C:\\v1\n", d.startupScript)
+	require.Equal(t, d.startupScript, d.specializeScript)
+
+	p := &compute.InstanceProperties{}
+	mergeInstanceProperties(p, d)
+	require.Equal(t, "tags [], labels [], metadata keys [windows-startup-script-ps1, sysprep-specialize-script-ps1]", describeInstanceProperties(p))
+
+	for _, override := range []string{
+		"compress: true",
+		"remove_metadata: [windows-startup-script-ps1]",
+	} {
+		_, err = ParseConfig(strings.NewReader(config + "    " + override + "\n"))
+		require.Error(t, err, override)
+	}
+}